@@ -0,0 +1,97 @@
+package config
+
+import (
+	"hw/logging"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// String returns the value of the environment variable or def when it is unset.
+func String(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return def
+}
+
+func Int64(name string, def int64) int64 {
+	value := String(name, "")
+	if value == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		logging.Fatal("invalid environment variable", "name", name, "error", err)
+	}
+	return n
+}
+
+func Float(name string, def float64) float64 {
+	value := String(name, "")
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		logging.Fatal("invalid environment variable", "name", name, "error", err)
+	}
+	return f
+}
+
+func Duration(name string, def time.Duration) time.Duration {
+	value := String(name, "")
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logging.Fatal("invalid environment variable", "name", name, "error", err)
+	}
+	return d
+}
+
+// Pairs parses a comma-separated list of key=value pairs,
+// e.g. "2024-01=secret1,2024-06=secret2". Values may contain '='.
+func Pairs(name string) map[string]string {
+	pairs := make(map[string]string)
+	value := String(name, "")
+	if value == "" {
+		return pairs
+	}
+	for _, pair := range strings.Split(value, ",") {
+		key, raw, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			logging.Fatal("invalid environment variable, expected key=value pairs", "name", name, "pair", pair)
+		}
+		pairs[key] = raw
+	}
+	return pairs
+}
+
+func Bool(name string, def bool) bool {
+	value := String(name, "")
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		logging.Fatal("invalid environment variable", "name", name, "error", err)
+	}
+	return b
+}
+
+// Durations parses a comma-separated list of key=duration pairs,
+// e.g. "Blur=30s,Sharpen=30s".
+func Durations(name string) map[string]time.Duration {
+	durations := make(map[string]time.Duration)
+	for key, raw := range Pairs(name) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			logging.Fatal("invalid environment variable", "name", name, "error", err)
+		}
+		durations[key] = d
+	}
+	return durations
+}
@@ -0,0 +1,167 @@
+// Package health serves the liveness and readiness probes of the server and
+// the worker.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Check reports whether a dependency can be used.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs the checks of the dependencies a process needs to do its
+// work. Each check has timeout to finish.
+type Checker struct {
+	timeout time.Duration
+	checks  []namedCheck
+}
+
+// Report is the body of /healthz and /readyz. Checks holds the outcome of
+// every check by dependency, "ok" or the error.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name, check})
+}
+
+// Ready runs all checks at once and reports the process unavailable if any
+// of them fails.
+func (c *Checker) Ready(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	errs := make([]error, len(c.checks))
+	var wg sync.WaitGroup
+	for i, nc := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.run(ctx, nc.check)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]string, len(c.checks))}
+	for i, nc := range c.checks {
+		if errs[i] != nil {
+			report.Status = StatusUnavailable
+			report.Checks[nc.name] = errs[i].Error()
+		} else {
+			report.Checks[nc.name] = StatusOK
+		}
+	}
+	return report
+}
+
+// run returns when ctx expires even if the check ignores it.
+func (c *Checker) run(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %v", c.timeout)
+	}
+}
+
+// Live answers as long as the process serves requests. It checks no
+// dependencies, so that an outage of one does not get the process restarted.
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	send(w, http.StatusOK, Report{Status: StatusOK})
+}
+
+// ReadyHandler answers 503 while a dependency is unavailable.
+func (c *Checker) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	report := c.Ready(r.Context())
+	code := http.StatusOK
+	if report.Status != StatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	send(w, code, report)
+}
+
+func send(w http.ResponseWriter, code int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// Handle adds /healthz and /readyz to mux.
+func (c *Checker) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", c.Live)
+	mux.HandleFunc("GET /readyz", c.ReadyHandler)
+}
+
+// Serve runs an admin listener for processes that serve no HTTP otherwise,
+// until ctx is cancelled.
+func Serve(ctx context.Context, addr string, handler http.Handler) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Probe requests /readyz of the process listening on addr and fails unless
+// it is ready. It serves as the health check command of containers, which
+// have no HTTP client installed.
+func Probe(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/readyz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var report Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("invalid readiness report: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %v", report.Status, report.Checks)
+	}
+	return nil
+}
@@ -1,32 +1,62 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"hw/config"
+	"hw/health"
 	. "hw/image_processor/processor"
+	"hw/logging"
 	. "hw/messaging"
-	. "hw/models"
 	. "hw/storage"
+	"hw/tracing"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	postgresConnString := os.Getenv("POSTGRES_CONN_STRING")
+	logging.Setup("image_processor")
+	databaseURL := config.String("DATABASE_URL", os.Getenv("POSTGRES_CONN_STRING"))
 	rabbitMQAddr := os.Getenv("RABBITMQ_ADDR")
+	redisAddr := os.Getenv("REDIS_ADDR")
+	queueBackend := os.Getenv("QUEUE_BACKEND")
+	// The worker serves no API, only /healthz, /readyz and /metrics on this
+	// address.
+	adminAddr := config.String("ADMIN_ADDR", ":8001")
 
-	db := NewPostgresTaskRepo(postgresConnString)
-	c := NewConsumerRMQ(rabbitMQAddr)
-	msgs := c.Consume()
-
-	for msg := range msgs {
-		var task Task
-		err := json.Unmarshal(msg.Body, &task)
-		if err != nil {
-			db.UpdateTaskStatus(task.ID, "failed", "Failed to read task")
-			continue
+	flag.Parse()
+	if flag.Arg(0) == "healthcheck" {
+		if err := health.Probe(adminAddr); err != nil {
+			logging.Fatal("worker is not ready", "error", err)
 		}
-		status, result := Process(task)
-		db.UpdateTaskStatus(task.ID, status, result)
-
-		_ = msg.Ack(false)
+		return
+	}
+	if queueBackend == BackendMemory {
+		slog.Info("the memory queue is consumed by the server itself, nothing to do")
+		return
 	}
+	defer tracing.Setup(context.Background(), "image_processor")()
+
+	db := NewTaskRepository(databaseURL)
+	c := NewConsumer(queueBackend, rabbitMQAddr, redisAddr)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	checker := health.NewChecker(config.Duration("HEALTH_CHECK_TIMEOUT", 2*time.Second))
+	checker.Add("database", db.Ping)
+	checker.Add("queue", c.Ping)
+	mux := http.NewServeMux()
+	checker.Handle(mux)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	go func() {
+		if err := health.Serve(ctx, adminAddr, mux); err != nil {
+			logging.Fatal("failed to start admin listener", "error", err)
+		}
+	}()
+	Run(ctx, c, db, ConfigFromEnv())
 }
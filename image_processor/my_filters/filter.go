@@ -1,15 +1,26 @@
 package filter
 
 import (
+	"context"
+	"github.com/disintegration/imaging"
 	"image"
 	"image/color"
+	"math"
 )
 
-func Negative(img image.Image) *image.NRGBA {
+// minStripRows is the least number of rows the filters process between
+// checks of their context, so that a timed out task stops within a fraction
+// of its processing time instead of running to the end.
+const minStripRows = 64
+
+func Negative(ctx context.Context, img image.Image) (*image.NRGBA, error) {
 	bounds := img.Bounds()
 	negativeImg := image.NewNRGBA(bounds)
 
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
 			r, g, b, _ := img.At(x, y).RGBA()
 			negativeImg.Set(bounds.Max.X-(x-bounds.Min.X+1), y, color.NRGBA{
@@ -20,5 +31,55 @@ func Negative(img image.Image) *image.NRGBA {
 			})
 		}
 	}
-	return negativeImg
+	return negativeImg, nil
+}
+
+func Grayscale(ctx context.Context, img image.Image) (*image.NRGBA, error) {
+	return inStrips(ctx, img, 0, imaging.Grayscale)
+}
+
+func Blur(ctx context.Context, img image.Image, sigma float64) (*image.NRGBA, error) {
+	return inStrips(ctx, img, blurRadius(sigma), func(img image.Image) *image.NRGBA {
+		return imaging.Blur(img, sigma)
+	})
+}
+
+func Sharpen(ctx context.Context, img image.Image, sigma float64) (*image.NRGBA, error) {
+	return inStrips(ctx, img, blurRadius(sigma), func(img image.Image) *image.NRGBA {
+		return imaging.Sharpen(img, sigma)
+	})
+}
+
+// blurRadius is how far the Gaussian kernel of the imaging library reaches.
+func blurRadius(sigma float64) int {
+	if sigma <= 0 {
+		return 0
+	}
+	return int(math.Ceil(sigma * 3))
+}
+
+// inStrips applies a filter of the imaging library, which cannot be
+// interrupted, to horizontal strips of img one after another and gives up
+// between strips once ctx is done. Each strip is filtered with margin rows of
+// its neighbours on either side, as far as the filter reaches, so the result
+// is the same as filtering the whole image at once.
+func inStrips(ctx context.Context, img image.Image, margin int, apply func(image.Image) *image.NRGBA) (*image.NRGBA, error) {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	// Strips several times higher than the margins keep the rows filtered
+	// twice to a small share.
+	rows := max(minStripRows, 8*margin)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += rows {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		strip := image.Rect(bounds.Min.X, max(y-margin, bounds.Min.Y), bounds.Max.X, min(y+rows+margin, bounds.Max.Y))
+		filtered := apply(imaging.Crop(img, strip))
+		for row := y; row < min(y+rows, bounds.Max.Y); row++ {
+			from := filtered.PixOffset(0, row-strip.Min.Y)
+			to := dst.PixOffset(0, row-bounds.Min.Y)
+			copy(dst.Pix[to:to+4*bounds.Dx()], filtered.Pix[from:from+4*bounds.Dx()])
+		}
+	}
+	return dst, nil
 }
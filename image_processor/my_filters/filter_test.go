@@ -0,0 +1,67 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"github.com/disintegration/imaging"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+func noise(width, height int) *image.NRGBA {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.Intn(256))
+	}
+	return img
+}
+
+// TestStripsMatchWholeImage checks that filtering in strips gives the result
+// of the imaging library, for images spanning several strips.
+func TestStripsMatchWholeImage(t *testing.T) {
+	img := noise(37, 5*minStripRows+11)
+	filters := map[string][2]func(context.Context) (*image.NRGBA, error){
+		"Grayscale": {
+			func(ctx context.Context) (*image.NRGBA, error) { return Grayscale(ctx, img) },
+			func(context.Context) (*image.NRGBA, error) { return imaging.Grayscale(img), nil },
+		},
+		"Blur": {
+			func(ctx context.Context) (*image.NRGBA, error) { return Blur(ctx, img, 4.5) },
+			func(context.Context) (*image.NRGBA, error) { return imaging.Blur(img, 4.5), nil },
+		},
+		"Sharpen": {
+			func(ctx context.Context) (*image.NRGBA, error) { return Sharpen(ctx, img, 2) },
+			func(context.Context) (*image.NRGBA, error) { return imaging.Sharpen(img, 2), nil },
+		},
+	}
+	for name, f := range filters {
+		got, err := f[0](context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want, _ := f[1](context.Background())
+		if got.Bounds() != want.Bounds() || !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%s differs from the imaging library", name)
+		}
+	}
+}
+
+func TestFiltersStopWhenCancelled(t *testing.T) {
+	img := noise(16, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Negative(ctx, img); err != context.Canceled {
+		t.Errorf("Negative returned %v", err)
+	}
+	if _, err := Grayscale(ctx, img); err != context.Canceled {
+		t.Errorf("Grayscale returned %v", err)
+	}
+	if _, err := Blur(ctx, img, 1); err != context.Canceled {
+		t.Errorf("Blur returned %v", err)
+	}
+	if _, err := Sharpen(ctx, img, 1); err != context.Canceled {
+		t.Errorf("Sharpen returned %v", err)
+	}
+}
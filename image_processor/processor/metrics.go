@@ -0,0 +1,88 @@
+package processor
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	. "hw/messaging"
+	"math"
+	"time"
+)
+
+// filters are the values of the filter label. Names of unknown filters come
+// from requests, so they are reported as "unknown" to bound the number of
+// series.
+var filters = map[string]bool{"Grayscale": true, "Blur": true, "Sharpen": true, "Negative": true}
+
+var (
+	tasksProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tasks_processed_total",
+		Help: "Tasks processed by the worker, by filter and outcome (ready or failed).",
+	}, []string{"filter", "outcome"})
+	processingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "task_processing_duration_seconds",
+		Help:    "Time taken to process a task, by filter.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"filter"})
+	decodeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "image_decode_duration_seconds",
+		Help:    "Time taken to decode a submitted image.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+	encodeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "image_encode_duration_seconds",
+		Help:    "Time taken to encode a processed image as PNG.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+	tasksDeferred = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tasks_deferred_total",
+		Help: "Tasks handed back to the queue because their owner had too many tasks running.",
+	})
+	imageMegapixels = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "image_megapixels",
+		Help:    "Size of the images submitted for processing.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 32, 64},
+	})
+)
+
+// queueDepthTimeout bounds the query of the queue depth on every scrape.
+const queueDepthTimeout = 2 * time.Second
+
+// observeQueue exports the number of tasks waiting in the queue of c. It is
+// read from the broker when the metrics are scraped.
+func observeQueue(c Consumer) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "queue_depth",
+		Help: "Tasks waiting in the queue to be delivered to a worker.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), queueDepthTimeout)
+		defer cancel()
+		depth, err := c.Depth(ctx)
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(depth)
+	})
+}
+
+func filterLabel(name string) string {
+	if filters[name] {
+		return name
+	}
+	return "unknown"
+}
+
+func observeSince(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// observeAbandoned exports the number of steps that timed out but are still
+// running.
+func observeAbandoned() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "processing_steps_abandoned",
+		Help: "Processing steps that timed out but are still running.",
+	}, func() float64 {
+		return float64(abandonedSteps.Load())
+	})
+}
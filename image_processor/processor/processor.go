@@ -2,50 +2,213 @@ package processor
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
-	"github.com/disintegration/imaging"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	. "hw/image_processor/my_filters"
+	"hw/imagecheck"
 	. "hw/models"
 	"image"
 	"image/png"
+	"sync/atomic"
+	"time"
 )
 
-func Process(task Task) (status, result string) {
+type Config struct {
+	// TaskTimeout bounds the whole task, FilterTimeouts bound the filter
+	// step of individual filters by name.
+	TaskTimeout    time.Duration
+	FilterTimeouts map[string]time.Duration
+	Limits         imagecheck.Limits
+	MaxSigma       float64
+	// MaxStartedPerUser caps the tasks of one user that all workers process
+	// at once, so that a user with a backlog cannot occupy every worker.
+	// Zero sets no cap.
+	MaxStartedPerUser int
+	// MaxAbandonedSteps is how many steps that timed out may keep running in
+	// the background before the worker stops taking tasks until they end.
+	// Zero sets no limit.
+	MaxAbandonedSteps int
+}
+
+// filterFunc applies a filter, giving up with the error of ctx once it is
+// done.
+type filterFunc func(ctx context.Context, img image.Image) (image.Image, error)
+
+// nrgba adapts the filters, which return a concrete image type.
+func nrgba(apply func(ctx context.Context, img image.Image) (*image.NRGBA, error)) filterFunc {
+	return func(ctx context.Context, img image.Image) (image.Image, error) {
+		filtered, err := apply(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		return filtered, nil
+	}
+}
+
+var tracer = otel.Tracer("hw/image_processor/processor")
+
+// Process applies the filter of the task to its image. Decoding, filtering
+// and encoding are each traced as a child span of the task.
+func Process(ctx context.Context, task Task, cfg Config) (status, result string) {
+	filter := filterLabel(task.Payload.Filter.Name)
+	ctx, span := tracer.Start(ctx, "Process", trace.WithAttributes(attribute.String("filter", filter)))
+	defer func(start time.Time) {
+		tasksProcessed.WithLabelValues(filter, status).Inc()
+		observeSince(processingDuration.WithLabelValues(filter), start)
+		span.SetAttributes(attribute.String("task.status", status))
+		if status != "ready" {
+			span.SetStatus(codes.Error, result)
+		}
+		span.End()
+	}(time.Now())
+
+	if cfg.TaskTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.TaskTimeout)
+		defer cancel()
+	}
+
 	imageData, err := base64.StdEncoding.DecodeString(task.Payload.Image)
 	if err != nil {
 		return "failed", "Invalid image data"
 	}
 
-	img, _, err := image.Decode(bytes.NewReader(imageData))
+	config, _, err := imagecheck.Inspect(imageData, cfg.Limits)
+	if err != nil {
+		return "failed", err.Error()
+	}
+	imageMegapixels.Observe(float64(config.Width) * float64(config.Height) / 1e6)
+
+	apply, err := selectFilter(task, cfg.MaxSigma)
+	if err != nil {
+		return "failed", err.Error()
+	}
+
+	img, err := runStep(ctx, "decoding", func(context.Context) (image.Image, error) {
+		defer observeSince(decodeDuration, time.Now())
+		img, _, err := image.Decode(bytes.NewReader(imageData))
+		if err != nil {
+			return nil, errors.New("Failed to decode image")
+		}
+		return img, nil
+	})
+	if err != nil {
+		return "failed", err.Error()
+	}
+
+	filterCtx := ctx
+	if timeout, ok := cfg.FilterTimeouts[task.Payload.Filter.Name]; ok {
+		var cancel context.CancelFunc
+		filterCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	img, err = runStep(filterCtx, task.Payload.Filter.Name+" filter", func(ctx context.Context) (image.Image, error) {
+		return apply(ctx, img)
+	})
+	if err != nil {
+		return "failed", err.Error()
+	}
+
+	var buf bytes.Buffer
+	_, err = runStep(ctx, "encoding", func(context.Context) (image.Image, error) {
+		defer observeSince(encodeDuration, time.Now())
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, errors.New("Failed to encode image")
+		}
+		return nil, nil
+	})
 	if err != nil {
-		return "failed", "Failed to decode image"
+		return "failed", err.Error()
 	}
+	result = base64.StdEncoding.EncodeToString(buf.Bytes())
+	return "ready", result
+}
 
+func selectFilter(task Task, maxSigma float64) (filterFunc, error) {
 	switch task.Payload.Filter.Name {
 	case "Grayscale":
-		img = imaging.Grayscale(img)
+		return nrgba(Grayscale), nil
 	case "Blur":
-		sigma, ok := task.GetFloatParameter("sigma")
-		if !ok {
-			return "failed", "Invalid parameters"
+		sigma, err := sigmaParameter(task, maxSigma)
+		if err != nil {
+			return nil, err
 		}
-		img = imaging.Blur(img, sigma)
+		return nrgba(func(ctx context.Context, img image.Image) (*image.NRGBA, error) { return Blur(ctx, img, sigma) }), nil
 	case "Sharpen":
-		sigma, ok := task.GetFloatParameter("sigma")
-		if !ok {
-			return "failed", "Invalid parameters"
+		sigma, err := sigmaParameter(task, maxSigma)
+		if err != nil {
+			return nil, err
 		}
-		img = imaging.Sharpen(img, sigma)
+		return nrgba(func(ctx context.Context, img image.Image) (*image.NRGBA, error) { return Sharpen(ctx, img, sigma) }), nil
 	case "Negative":
-		img = Negative(img)
-	default:
-		return "failed", "Unknown filter"
+		return nrgba(Negative), nil
 	}
+	return nil, errors.New("Unknown filter")
+}
 
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, img); err != nil {
-		return "failed", "Failed to encode image"
+func sigmaParameter(task Task, maxSigma float64) (float64, error) {
+	sigma, ok := task.GetFloatParameter("sigma")
+	if !ok {
+		return 0, errors.New("Invalid parameters")
 	}
-	result = base64.StdEncoding.EncodeToString(buf.Bytes())
-	return "ready", result
+	if maxSigma > 0 && sigma > maxSigma {
+		return 0, fmt.Errorf("Invalid parameters: sigma %g exceeds the limit of %g", sigma, maxSigma)
+	}
+	return sigma, nil
+}
+
+// abandonedSteps counts the steps that were given up on but are still
+// running.
+var abandonedSteps atomic.Int64
+
+// runStep runs a processing step in its own span and gives up once the
+// context is done. Filters stop by themselves soon after, but decoding and
+// encoding cannot be interrupted, so an abandoned step finishes in the
+// background. Run takes no new task while too many of them are running.
+func runStep(ctx context.Context, name string, step func(ctx context.Context) (image.Image, error)) (img image.Image, err error) {
+	ctx, span := tracer.Start(ctx, name)
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	type outcome struct {
+		img image.Image
+		err error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		img, err := step(ctx)
+		done <- outcome{img, err}
+	}()
+
+	select {
+	case o := <-done:
+		if o.err != nil && ctx.Err() != nil {
+			return nil, stepError(ctx, name)
+		}
+		return o.img, o.err
+	case <-ctx.Done():
+		abandonedSteps.Add(1)
+		go func() {
+			<-done
+			abandonedSteps.Add(-1)
+		}()
+		return nil, stepError(ctx, name)
+	}
+}
+
+func stepError(ctx context.Context, name string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Processing timed out during %s", name)
+	}
+	return fmt.Errorf("Processing cancelled during %s", name)
 }
@@ -0,0 +1,189 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"hw/config"
+	"hw/imagecheck"
+	. "hw/messaging"
+	. "hw/models"
+	"log/slog"
+	"time"
+)
+
+// TaskUpdater marks tasks as started and records their outcome.
+type TaskUpdater interface {
+	StartTask(ctx context.Context, id uuid.UUID, maxStarted int) (bool, error)
+	UpdateTaskStatus(ctx context.Context, id uuid.UUID, status, result string) error
+	FailTask(ctx context.Context, id uuid.UUID, reason string) error
+}
+
+// updateAttempts is how often the outcome of a task is written before the
+// message is handed back to the queue, so that a short database outage does
+// not throw away the work already done.
+const updateAttempts = 3
+
+// abandonedPoll is how often a worker waiting for abandoned steps to end
+// checks on them.
+const abandonedPoll = 100 * time.Millisecond
+
+// deferDelay is how long a task held back by the per-user cap waits before it
+// is handed back to the queue at the lowest priority, so that the worker does
+// not spin on the tasks of a single user while nothing else is queued. Above
+// the lowest priority the task is deferred right away, because it is queued
+// again one priority lower and so cannot come back ahead of other tasks.
+const deferDelay = 200 * time.Millisecond
+
+// ConfigFromEnv reads the processing limits from the environment.
+func ConfigFromEnv() Config {
+	return Config{
+		TaskTimeout:    config.Duration("TASK_TIMEOUT", time.Minute),
+		FilterTimeouts: config.Durations("FILTER_TIMEOUTS"),
+		Limits: imagecheck.Limits{
+			MaxPixels: config.Int64("MAX_IMAGE_PIXELS", 50_000_000),
+			MaxMemory: config.Int64("MAX_IMAGE_MEMORY", 1<<30),
+		},
+		MaxSigma:          config.Float("MAX_FILTER_SIGMA", 50),
+		MaxStartedPerUser: int(config.Int64("MAX_RUNNING_TASKS_PER_USER", 2)),
+		MaxAbandonedSteps: int(config.Int64("MAX_ABANDONED_STEPS", 2)),
+	}
+}
+
+// Run processes the tasks delivered by the consumer one at a time until its
+// channel is closed or ctx is cancelled. A message is acknowledged only once
+// the outcome of its task is stored; otherwise it is requeued and processed
+// again. The depth of the queue is exported as a metric.
+func Run(ctx context.Context, c Consumer, tasks TaskUpdater, cfg Config) {
+	observeQueue(c)
+	observeAbandoned()
+	messages := c.Consume()
+	for {
+		if !waitForAbandoned(ctx, cfg.MaxAbandonedSteps) {
+			return
+		}
+		var msg Message
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok = <-messages:
+			if !ok {
+				return
+			}
+		}
+
+		handle(ctx, msg, tasks, cfg)
+	}
+}
+
+// waitForAbandoned waits until fewer than limit abandoned steps are running,
+// so that steps which cannot be interrupted do not pile up while new tasks
+// time out in turn. It reports false if ctx is done first.
+func waitForAbandoned(ctx context.Context, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	if abandonedSteps.Load() >= int64(limit) {
+		slog.WarnContext(ctx, "waiting for abandoned steps to end", "abandoned", abandonedSteps.Load())
+	}
+	for abandonedSteps.Load() >= int64(limit) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(abandonedPoll):
+		}
+	}
+	return true
+}
+
+// handle processes a single message in a span that continues the trace of
+// the request that created the task. Lines logged while handling it carry
+// the ID of that request.
+func handle(ctx context.Context, msg Message, tasks TaskUpdater, cfg Config) {
+	ctx, span := StartProcessing(ctx, msg)
+	defer span.End()
+
+	var task Task
+	if err := json.Unmarshal(msg.Body(), &task); err != nil {
+		slog.ErrorContext(ctx, "dropping malformed task", "error", err)
+		span.SetStatus(codes.Error, "malformed task")
+		failMalformed(ctx, tasks, msg.Body())
+		_ = msg.Nack(false)
+		return
+	}
+	span.SetAttributes(attribute.String("task.id", task.ID.String()))
+	started, err := tasks.StartTask(ctx, task.ID, cfg.MaxStartedPerUser)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to start task, requeueing", "task_id", task.ID, "error", err)
+		span.RecordError(err)
+		wait(ctx, deferDelay)
+		_ = msg.Nack(true)
+		return
+	}
+	if !started {
+		slog.DebugContext(ctx, "owner has too many tasks running, deferring", "task_id", task.ID, "priority", msg.Priority())
+		tasksDeferred.Inc()
+		if msg.Priority() == 0 {
+			wait(ctx, deferDelay)
+		}
+		_ = msg.Defer()
+		return
+	}
+	start := time.Now()
+	status, result := Process(ctx, task, cfg)
+	if err := updateStatus(ctx, tasks, task.ID, status, result); err != nil {
+		slog.ErrorContext(ctx, "failed to store the outcome of task, requeueing", "task_id", task.ID, "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to store the outcome")
+		_ = msg.Nack(true)
+		return
+	}
+	_ = msg.Ack()
+	attrs := []any{"task_id", task.ID, "filter", task.Payload.Filter.Name, "status", status, "duration_ms", time.Since(start).Milliseconds()}
+	if status == "failed" {
+		attrs = append(attrs, "reason", result)
+	}
+	slog.InfoContext(ctx, "processed task", attrs...)
+}
+
+// failMalformed marks the task of a message that is dropped as failed, so
+// that it does not stay in progress, if the task ID can still be read.
+func failMalformed(ctx context.Context, tasks TaskUpdater, body []byte) {
+	var header struct {
+		ID uuid.UUID `json:"task_id"`
+	}
+	if json.Unmarshal(body, &header) != nil || header.ID == uuid.Nil {
+		return
+	}
+	if err := tasks.FailTask(ctx, header.ID, "Malformed task"); err != nil {
+		slog.ErrorContext(ctx, "failed to fail malformed task", "task_id", header.ID, "error", err)
+	}
+}
+
+// wait sleeps for d or until ctx is done.
+func wait(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+func updateStatus(ctx context.Context, tasks TaskUpdater, id uuid.UUID, status, result string) error {
+	var err error
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+		if err = tasks.UpdateTaskStatus(ctx, id, status, result); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package processor
+
+import (
+	"context"
+	"github.com/google/uuid"
+	. "hw/messaging"
+	. "hw/models"
+	"testing"
+)
+
+type testMessage struct {
+	body     []byte
+	nacked   bool
+	priority uint8
+}
+
+func (m *testMessage) Body() []byte               { return m.body }
+func (m *testMessage) Headers() map[string]string { return nil }
+func (m *testMessage) Ack() error                 { return nil }
+func (m *testMessage) Nack(requeue bool) error {
+	m.nacked = !requeue
+	return nil
+}
+func (m *testMessage) Priority() uint8 { return m.priority }
+func (m *testMessage) Defer() error    { return nil }
+
+// testTasks records the tasks started and failed by the worker. Tasks in
+// capped cannot be started, as if their owner was over the per-user cap.
+type testTasks struct {
+	capped  map[uuid.UUID]bool
+	started []uuid.UUID
+	failed  []uuid.UUID
+}
+
+func (t *testTasks) StartTask(ctx context.Context, id uuid.UUID, maxStarted int) (bool, error) {
+	if t.capped[id] {
+		return false, nil
+	}
+	t.started = append(t.started, id)
+	return true, nil
+}
+
+func (t *testTasks) UpdateTaskStatus(ctx context.Context, id uuid.UUID, status, result string) error {
+	return nil
+}
+
+func (t *testTasks) FailTask(ctx context.Context, id uuid.UUID, reason string) error {
+	t.failed = append(t.failed, id)
+	return nil
+}
+
+func TestMalformedTaskIsFailed(t *testing.T) {
+	id := uuid.New()
+	msg := &testMessage{body: []byte(`{"task_id": "` + id.String() + `", "priority": "high"}`)}
+	tasks := &testTasks{}
+	handle(context.Background(), msg, tasks, Config{})
+	if !msg.nacked {
+		t.Error("malformed message was not dropped")
+	}
+	if len(tasks.failed) != 1 || tasks.failed[0] != id {
+		t.Errorf("expected task %s to fail, failed %v", id, tasks.failed)
+	}
+
+	msg = &testMessage{body: []byte(`not json`)}
+	tasks = &testTasks{}
+	handle(context.Background(), msg, tasks, Config{})
+	if !msg.nacked || len(tasks.failed) != 0 {
+		t.Errorf("message without a task ID: dropped %v, failed %v", msg.nacked, tasks.failed)
+	}
+}
+
+// TestCappedBacklogDoesNotBlockOthers queues the backlog of a user over the
+// per-user cap ahead of a task of another user with a lower priority, which
+// must still be started.
+func TestCappedBacklogDoesNotBlockOthers(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+	tasks := &testTasks{capped: make(map[uuid.UUID]bool)}
+	for i := 0; i < 5; i++ {
+		task := &Task{ID: uuid.New(), Priority: 5}
+		tasks.capped[task.ID] = true
+		queue.Publish(ctx, task)
+	}
+	other := &Task{ID: uuid.New(), Priority: 3}
+	queue.Publish(ctx, other)
+
+	messages := queue.Consume()
+	for i := 0; i < 50 && len(tasks.started) == 0; i++ {
+		handle(ctx, <-messages, tasks, Config{})
+	}
+	if len(tasks.started) != 1 || tasks.started[0] != other.ID {
+		t.Fatalf("expected the task of the other user to start, started %v", tasks.started)
+	}
+}
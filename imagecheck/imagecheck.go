@@ -0,0 +1,122 @@
+package imagecheck
+
+import (
+	"bytes"
+	"fmt"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// Limits bound the size of images accepted for processing.
+// Zero values disable the corresponding check.
+type Limits struct {
+	MaxPixels int64
+	MaxMemory int64
+}
+
+type ImageTooLargeError struct {
+	Message string
+}
+
+func (e *ImageTooLargeError) Error() string {
+	return e.Message
+}
+
+func NewImageTooLargeError(format string, args ...any) error {
+	return &ImageTooLargeError{Message: fmt.Sprintf(format, args...)}
+}
+
+type UnsupportedFormatError struct{}
+
+func (e *UnsupportedFormatError) Error() string {
+	return "Unsupported image format"
+}
+
+func NewUnsupportedFormatError() error {
+	return &UnsupportedFormatError{}
+}
+
+type InvalidImageError struct {
+	Message string
+}
+
+func (e *InvalidImageError) Error() string {
+	return e.Message
+}
+
+func NewInvalidImageError(message string) error {
+	return &InvalidImageError{Message: message}
+}
+
+var signatures = []struct {
+	format string
+	magic  string
+}{
+	{"png", "\x89PNG\r\n\x1a\n"},
+	{"jpeg", "\xff\xd8\xff"},
+	{"gif", "GIF87a"},
+	{"gif", "GIF89a"},
+	{"bmp", "BM"},
+	{"tiff", "II*\x00"},
+	{"tiff", "MM\x00*"},
+}
+
+// DetectFormat identifies the image format from its magic bytes.
+func DetectFormat(data []byte) (string, bool) {
+	for _, sig := range signatures {
+		if bytes.HasPrefix(data, []byte(sig.magic)) {
+			return sig.format, true
+		}
+	}
+	return "", false
+}
+
+// Inspect checks the magic bytes, then reads only the image header and checks
+// the dimensions against the limits, so oversized images are rejected before
+// they are decoded.
+func Inspect(data []byte, limits Limits) (image.Config, string, error) {
+	detected, ok := DetectFormat(data)
+	if !ok {
+		return image.Config{}, "", NewUnsupportedFormatError()
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != detected {
+		return image.Config{}, "", NewInvalidImageError("Failed to read image header")
+	}
+
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	if limits.MaxPixels > 0 && pixels > limits.MaxPixels {
+		return cfg, format, NewImageTooLargeError("Image is too large: %dx%d exceeds the limit of %d pixels",
+			cfg.Width, cfg.Height, limits.MaxPixels)
+	}
+	if memory := EstimateMemory(cfg); limits.MaxMemory > 0 && memory > limits.MaxMemory {
+		return cfg, format, NewImageTooLargeError("Image is too large: processing %dx%d needs about %d MiB, the limit is %d MiB",
+			cfg.Width, cfg.Height, memory>>20, limits.MaxMemory>>20)
+	}
+	return cfg, format, nil
+}
+
+// EstimateMemory approximates the peak memory needed to process an image:
+// the decoded source plus two 8-bit RGBA buffers used by the filters.
+func EstimateMemory(cfg image.Config) int64 {
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	return pixels * (bytesPerPixel(cfg.ColorModel) + 2*4)
+}
+
+func bytesPerPixel(model color.Model) int64 {
+	switch model {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	default:
+		return 4
+	}
+}
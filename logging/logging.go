@@ -0,0 +1,89 @@
+// Package logging configures log/slog for the server and the worker and
+// carries the ID of the API request that a log line belongs to.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// RequestIDKey is the attribute under which the request ID is logged.
+const RequestIDKey = "request_id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns ctx carrying the request ID, which is added to every
+// line logged with ctx.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request ID and the trace of the context to each
+// record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String(RequestIDKey, id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Setup makes the default logger write JSON, or text with LOG_FORMAT=text,
+// to stderr at the level named by LOG_LEVEL (debug, info, warn or error).
+// Every line names the service. Output of the log package goes through the
+// same logger at the info level.
+func Setup(service string) {
+	level := slog.LevelInfo
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			Fatal("invalid LOG_LEVEL", "value", value, "error", err)
+		}
+	}
+	handler, err := newHandler(os.Getenv("LOG_FORMAT"), os.Stderr, &slog.HandlerOptions{Level: level})
+	if err != nil {
+		Fatal("invalid LOG_FORMAT", "error", err)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}).With("service", service))
+}
+
+func newHandler(format string, w io.Writer, opts *slog.HandlerOptions) (slog.Handler, error) {
+	switch strings.ToLower(format) {
+	case "", "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown format %q, expected json or text", format)
+}
+
+// Fatal logs an error and exits. It is meant for errors in the configuration
+// or at startup, which the process cannot recover from.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,101 @@
+package messaging
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"hw/logging"
+	. "hw/models"
+)
+
+const taskQueue = "task_queue"
+
+const (
+	BackendRabbitMQ = "rabbitmq"
+	BackendRedis    = "redis"
+	BackendMemory   = "memory"
+)
+
+// Producers and consumers report through Ping whether their connection to
+// the queue is usable.
+type Producer interface {
+	// Publish queues the task along with the headers taken from ctx.
+	Publish(ctx context.Context, task *Task) error
+	Ping(ctx context.Context) error
+}
+
+type Consumer interface {
+	Consume() <-chan Message
+	Ping(ctx context.Context) error
+	// Depth returns the number of tasks waiting to be delivered.
+	Depth(ctx context.Context) (int64, error)
+}
+
+// Message is a single delivery from a Consumer. Every message must be
+// either acknowledged or rejected exactly once.
+type Message interface {
+	Body() []byte
+	Headers() map[string]string
+	Ack() error
+	Nack(requeue bool) error
+	// Priority is the priority the message was delivered at.
+	Priority() uint8
+	// Defer hands the message back to the queue one priority lower than it
+	// was delivered at, so that tasks a worker holds back sink below those
+	// of lower priorities instead of being delivered again ahead of them.
+	Defer() error
+}
+
+// requestIDHeader carries the ID of the API request that created a task, so
+// that the log lines of the worker can be joined with those of the server.
+const requestIDHeader = "request_id"
+
+// headers returns the values that travel with a task published with ctx:
+// the request ID and the trace context.
+func headers(ctx context.Context) map[string]string {
+	headers := make(map[string]string)
+	if id := logging.RequestID(ctx); id != "" {
+		headers[requestIDHeader] = id
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	return headers
+}
+
+// Context returns ctx with the values carried by the headers of msg.
+func Context(ctx context.Context, msg Message) context.Context {
+	headers := msg.Headers()
+	if id := headers[requestIDHeader]; id != "" {
+		ctx = logging.WithRequestID(ctx, id)
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// NewProducer creates a Producer for the given queue backend.
+// An empty backend name selects RabbitMQ.
+func NewProducer(backend, rabbitMQAddr, redisAddr string) Producer {
+	switch backend {
+	case "", BackendRabbitMQ:
+		return tracedProducer{NewProducerRMQ(rabbitMQAddr), BackendRabbitMQ}
+	case BackendRedis:
+		return tracedProducer{NewProducerRedis(redisAddr), BackendRedis}
+	case BackendMemory:
+		return tracedProducer{SharedMemoryQueue(), BackendMemory}
+	}
+	logging.Fatal("unknown queue backend", "backend", backend)
+	return nil
+}
+
+// NewConsumer creates a Consumer for the given queue backend.
+// An empty backend name selects RabbitMQ.
+func NewConsumer(backend, rabbitMQAddr, redisAddr string) Consumer {
+	switch backend {
+	case "", BackendRabbitMQ:
+		return NewConsumerRMQ(rabbitMQAddr)
+	case BackendRedis:
+		return NewConsumerRedis(redisAddr)
+	case BackendMemory:
+		return SharedMemoryQueue()
+	}
+	logging.Fatal("unknown queue backend", "backend", backend)
+	return nil
+}
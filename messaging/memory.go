@@ -0,0 +1,136 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	. "hw/models"
+	"sync"
+)
+
+var _ Producer = &MemoryQueue{}
+var _ Consumer = &MemoryQueue{}
+var _ Message = memoryMessage{}
+
+// MemoryQueue delivers tasks between goroutines of one process, highest
+// priority first. It is meant for tests and single-node deployments where
+// the worker runs inside the server; queued tasks are lost on restart.
+type MemoryQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	levels [MaxPriority + 1][]memoryMessage
+}
+
+type memoryMessage struct {
+	queue    *MemoryQueue
+	priority uint8
+	body     []byte
+	headers  map[string]string
+}
+
+var (
+	sharedQueue     *MemoryQueue
+	sharedQueueOnce sync.Once
+)
+
+// SharedMemoryQueue returns the queue used by the memory backend of
+// NewProducer and NewConsumer, so that both ends meet within the process.
+func SharedMemoryQueue() *MemoryQueue {
+	sharedQueueOnce.Do(func() {
+		sharedQueue = NewMemoryQueue()
+	})
+	return sharedQueue
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	q := &MemoryQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *MemoryQueue) push(msg memoryMessage) {
+	q.mu.Lock()
+	q.levels[msg.priority] = append(q.levels[msg.priority], msg)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+func (q *MemoryQueue) Publish(ctx context.Context, task *Task) error {
+	body, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	q.push(memoryMessage{q, min(task.Priority, MaxPriority), body, headers(ctx)})
+	return nil
+}
+
+// pop blocks until a task is queued and takes the one of the highest
+// priority.
+func (q *MemoryQueue) pop() memoryMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for p := int(MaxPriority); p >= 0; p-- {
+			if level := q.levels[p]; len(level) > 0 {
+				q.levels[p] = level[1:]
+				return level[0]
+			}
+		}
+		q.cond.Wait()
+	}
+}
+
+// Consume hands out one message at a time: the next one is taken from the
+// queue only after the previous one was received.
+func (q *MemoryQueue) Consume() <-chan Message {
+	msgs := make(chan Message)
+	go func() {
+		for {
+			msgs <- q.pop()
+		}
+	}()
+	return msgs
+}
+
+// Ping always succeeds, the queue lives in the process.
+func (q *MemoryQueue) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (q *MemoryQueue) Depth(ctx context.Context) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var depth int64
+	for _, level := range q.levels {
+		depth += int64(len(level))
+	}
+	return depth, nil
+}
+
+func (m memoryMessage) Body() []byte {
+	return m.body
+}
+
+func (m memoryMessage) Headers() map[string]string {
+	return m.headers
+}
+
+func (m memoryMessage) Ack() error {
+	return nil
+}
+
+func (m memoryMessage) Nack(requeue bool) error {
+	if requeue {
+		m.queue.push(m)
+	}
+	return nil
+}
+
+func (m memoryMessage) Priority() uint8 {
+	return m.priority
+}
+
+func (m memoryMessage) Defer() error {
+	m.priority = deferredPriority(m.priority)
+	m.queue.push(m)
+	return nil
+}
@@ -0,0 +1,52 @@
+package messaging
+
+import (
+	. "hw/models"
+	"math/bits"
+)
+
+const (
+	MaxPriority     uint8 = 9
+	DefaultPriority uint8 = 5
+	// MaxUserPriority is the highest priority users may request. Those
+	// above it are reserved for administrators, so that their tasks can
+	// overtake any backlog.
+	MaxUserPriority uint8 = 7
+)
+
+// ClampPriority limits the priority requested by a user with the given role
+// to the range allowed for that role.
+func ClampPriority(requested uint8, role string) uint8 {
+	if role != RoleAdmin {
+		return min(requested, MaxUserPriority)
+	}
+	return min(requested, MaxPriority)
+}
+
+// deferredPriority is the priority a deferred message is queued at again.
+func deferredPriority(priority uint8) uint8 {
+	if priority == 0 {
+		return 0
+	}
+	return min(priority, MaxPriority) - 1
+}
+
+// FairPriority lowers the requested priority of a task according to how many
+// tasks its owner already has waiting. The demotion grows logarithmically with
+// the backlog, so a user submitting thousands of images quickly drops to the
+// lowest priority while interactive users with a task or two keep theirs.
+// Workers additionally cap the tasks each user has being processed at once,
+// see processor.Config.
+func FairPriority(requested uint8, pending int) uint8 {
+	if requested > MaxPriority {
+		requested = MaxPriority
+	}
+	if pending <= 0 {
+		return requested
+	}
+	penalty := bits.Len(uint(pending))
+	if penalty >= int(requested) {
+		return 0
+	}
+	return requested - uint8(penalty)
+}
@@ -1,30 +1,43 @@
 package messaging
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/streadway/amqp"
+	"hw/logging"
 	. "hw/models"
-	"log"
+	"sync/atomic"
 )
 
+// priorityQueue is declared with x-max-priority. The arguments of a queue
+// cannot change once it is declared, so it does not reuse the name of
+// task_queue, which earlier versions declared without priorities. Tasks left
+// there are moved over by `make migrate-queue`.
+const priorityQueue = "task_queue_priority"
+
 var _ Producer = ProducerRMQ{}
 var _ Consumer = ConsumerRMQ{}
+var _ Message = deliveryRMQ{}
 
-type Producer interface {
-	Publish(task *Task) error
+type ProducerRMQ struct {
+	ch *channelRMQ
 }
 
-type Consumer interface {
-	Consume() <-chan amqp.Delivery
+type ConsumerRMQ struct {
+	ch *channelRMQ
 }
 
-type ProducerRMQ struct {
-	ch *amqp.Channel
+// channelRMQ remembers why the channel was closed, which amqp.Channel does not
+// expose. The client does not reconnect, so a closed channel stays closed.
+type channelRMQ struct {
+	*amqp.Channel
+	closed atomic.Pointer[amqp.Error]
 }
 
-type ConsumerRMQ struct {
-	ch *amqp.Channel
+type deliveryRMQ struct {
+	amqp.Delivery
+	ch *channelRMQ
 }
 
 func NewProducerRMQ(rabbitMQAddr string) ProducerRMQ {
@@ -37,11 +50,11 @@ func NewConsumerRMQ(rabbitMQAddr string) ConsumerRMQ {
 
 func failOnError(err error, msg string) {
 	if err != nil {
-		log.Fatalf("%s: %v", msg, err)
+		logging.Fatal(msg, "error", err)
 	}
 }
 
-func createChannel(rabbitMQAddr string) *amqp.Channel {
+func createChannel(rabbitMQAddr string) *channelRMQ {
 	conn, err := amqp.Dial(rabbitMQAddr)
 	failOnError(err, "failed to connect to RabbitMQ")
 
@@ -49,20 +62,98 @@ func createChannel(rabbitMQAddr string) *amqp.Channel {
 	failOnError(err, "failed to open a channel")
 
 	_, err = ch.QueueDeclare(
-		"task_queue",
+		priorityQueue,
 		false,
 		false,
 		false,
 		false,
-		nil,
+		amqp.Table{"x-max-priority": int32(MaxPriority)},
 	)
 	failOnError(err, "failed to declare a queue")
-	return ch
+
+	c := &channelRMQ{Channel: ch}
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		err, ok := <-closed
+		if !ok || err == nil {
+			err = amqp.ErrClosed
+		}
+		c.closed.Store(err)
+	}()
+	return c
+}
+
+func (c *channelRMQ) ping() error {
+	if err := c.closed.Load(); err != nil {
+		return err
+	}
+	return nil
 }
 
-func (c ConsumerRMQ) Consume() <-chan amqp.Delivery {
-	msgs, err := c.ch.Consume(
-		"task_queue",
+func (d deliveryRMQ) Body() []byte {
+	return d.Delivery.Body
+}
+
+func (d deliveryRMQ) Headers() map[string]string {
+	headers := make(map[string]string, len(d.Delivery.Headers))
+	for key, value := range d.Delivery.Headers {
+		if s, ok := value.(string); ok {
+			headers[key] = s
+		}
+	}
+	return headers
+}
+
+func (d deliveryRMQ) Ack() error {
+	return d.Delivery.Ack(false)
+}
+
+// Nack requeues the message by publishing a copy of it, because the broker
+// would put the message back at the head of the queue and deliver it again
+// straight away, ahead of those that were waiting behind it.
+func (d deliveryRMQ) Nack(requeue bool) error {
+	if !requeue {
+		return d.Delivery.Nack(false, false)
+	}
+	return d.republish(d.Delivery.Priority)
+}
+
+func (d deliveryRMQ) Priority() uint8 {
+	return d.Delivery.Priority
+}
+
+func (d deliveryRMQ) Defer() error {
+	return d.republish(deferredPriority(d.Delivery.Priority))
+}
+
+// republish queues a copy of the message with the given priority and
+// acknowledges the original.
+func (d deliveryRMQ) republish(priority uint8) error {
+	err := d.ch.Publish(
+		"",
+		priorityQueue,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType: d.ContentType,
+			Priority:    priority,
+			Headers:     d.Delivery.Headers,
+			Body:        d.Delivery.Body,
+		})
+	if err != nil {
+		return d.Delivery.Nack(false, true)
+	}
+	return d.Ack()
+}
+
+func (c ConsumerRMQ) Consume() <-chan Message {
+	// Without a prefetch limit the broker pushes the whole queue to the
+	// worker at once and priorities have no effect.
+	err := c.ch.Qos(1, 0, false)
+	failOnError(err, "failed to set QoS")
+
+	deliveries, err := c.ch.Consume(
+		priorityQueue,
 		"",
 		false,
 		false,
@@ -71,22 +162,47 @@ func (c ConsumerRMQ) Consume() <-chan amqp.Delivery {
 		nil,
 	)
 	failOnError(err, "failed to register a consumer")
+
+	msgs := make(chan Message)
+	go func() {
+		defer close(msgs)
+		for d := range deliveries {
+			msgs <- deliveryRMQ{d, c.ch}
+		}
+	}()
 	return msgs
 }
 
-func (b ProducerRMQ) Publish(task *Task) error {
+func (c ConsumerRMQ) Ping(ctx context.Context) error {
+	return c.ch.ping()
+}
+
+// Depth counts the messages ready for delivery, without those delivered but
+// not yet acknowledged.
+func (c ConsumerRMQ) Depth(ctx context.Context) (int64, error) {
+	queue, err := c.ch.QueueInspect(priorityQueue)
+	return int64(queue.Messages), err
+}
+
+func (b ProducerRMQ) Publish(ctx context.Context, task *Task) error {
 	body, err := json.Marshal(task)
 	if err != nil {
 		return fmt.Errorf("failed to marshal task: %w", err)
 	}
 
+	table := amqp.Table{}
+	for key, value := range headers(ctx) {
+		table[key] = value
+	}
 	err = b.ch.Publish(
 		"",
-		"task_queue",
+		priorityQueue,
 		false,
 		false,
 		amqp.Publishing{
 			ContentType: "application/json",
+			Priority:    task.Priority,
+			Headers:     table,
 			Body:        body,
 		})
 	if err != nil {
@@ -95,3 +211,7 @@ func (b ProducerRMQ) Publish(task *Task) error {
 
 	return nil
 }
+
+func (b ProducerRMQ) Ping(ctx context.Context) error {
+	return b.ch.ping()
+}
@@ -0,0 +1,420 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	. "hw/models"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ Producer = ProducerRedis{}
+var _ Consumer = ConsumerRedis{}
+var _ Message = streamMessage{}
+
+const (
+	consumerGroup = "image_processor"
+	bodyField     = "body"
+	// Headers are stored in fields named with headerPrefix.
+	headerPrefix = "header:"
+
+	// Pending entries idle for longer than reclaimIdle belong to a worker
+	// that most likely crashed, so they are handed over to a live one.
+	reclaimIdle     = time.Minute
+	reclaimInterval = 30 * time.Second
+	readBlock       = 5 * time.Second
+	// legacyBatch is how many entries of the legacy stream are moved at once.
+	legacyBatch = 100
+)
+
+type ProducerRedis struct {
+	rdb *redis.Client
+}
+
+type ConsumerRedis struct {
+	rdb  *redis.Client
+	name string
+}
+
+type streamMessage struct {
+	rdb    *redis.Client
+	stream string
+	msg    redis.XMessage
+}
+
+func NewProducerRedis(redisAddr string) ProducerRedis {
+	return ProducerRedis{createStreams(redisAddr)}
+}
+
+func NewConsumerRedis(redisAddr string) ConsumerRedis {
+	hostname, _ := os.Hostname()
+	return ConsumerRedis{
+		rdb:  createStreams(redisAddr),
+		name: fmt.Sprintf("%s-%s", hostname, uuid.NewString()),
+	}
+}
+
+// priorityStream returns the name of the stream holding tasks of the given
+// priority. Streams have no notion of priority, so every level gets its own.
+func priorityStream(priority uint8) string {
+	return fmt.Sprintf("%s:%d", taskQueue, priority)
+}
+
+// priorityStreams lists the streams from the highest priority to the lowest.
+func priorityStreams() []string {
+	streams := make([]string, 0, MaxPriority+1)
+	for p := int(MaxPriority); p >= 0; p-- {
+		streams = append(streams, priorityStream(uint8(p)))
+	}
+	return streams
+}
+
+func createStreams(redisAddr string) *redis.Client {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+	})
+	ctx := context.Background()
+	err := rdb.Ping(ctx).Err()
+	failOnError(err, "failed to connect to Redis")
+
+	for _, stream := range priorityStreams() {
+		err = rdb.XGroupCreateMkStream(ctx, stream, consumerGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			failOnError(err, "failed to create a consumer group")
+		}
+	}
+	return rdb
+}
+
+func (m streamMessage) Body() []byte {
+	body, _ := m.msg.Values[bodyField].(string)
+	return []byte(body)
+}
+
+func (m streamMessage) Headers() map[string]string {
+	headers := make(map[string]string)
+	for field, value := range m.msg.Values {
+		if key, ok := strings.CutPrefix(field, headerPrefix); ok {
+			headers[key], _ = value.(string)
+		}
+	}
+	return headers
+}
+
+func (m streamMessage) Ack() error {
+	ctx := context.Background()
+	if err := m.rdb.XAck(ctx, m.stream, consumerGroup, m.msg.ID).Err(); err != nil {
+		return err
+	}
+	return m.rdb.XDel(ctx, m.stream, m.msg.ID).Err()
+}
+
+func (m streamMessage) Nack(requeue bool) error {
+	if !requeue {
+		return m.Ack()
+	}
+	return m.republish(m.stream)
+}
+
+// Priority is read from the name of the stream the entry was delivered from.
+func (m streamMessage) Priority() uint8 {
+	priority, err := strconv.ParseUint(strings.TrimPrefix(m.stream, taskQueue+":"), 10, 8)
+	if err != nil {
+		return 0
+	}
+	return min(uint8(priority), MaxPriority)
+}
+
+func (m streamMessage) Defer() error {
+	return m.republish(priorityStream(deferredPriority(m.Priority())))
+}
+
+// republish adds a copy of the entry to the given stream and acknowledges
+// the original.
+func (m streamMessage) republish(stream string) error {
+	err := m.rdb.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: stream,
+		Values: m.msg.Values,
+	}).Err()
+	if err != nil {
+		return err
+	}
+	return m.Ack()
+}
+
+func (c ConsumerRedis) Consume() <-chan Message {
+	msgs := make(chan Message)
+	go func() {
+		defer close(msgs)
+		ctx := context.Background()
+		var lastReclaim time.Time
+		for {
+			if time.Since(lastReclaim) >= reclaimInterval {
+				c.moveLegacy(ctx)
+				for _, msg := range c.reclaim(ctx) {
+					msgs <- msg
+				}
+				lastReclaim = time.Now()
+			}
+
+			batch, err := c.next(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to read from stream", "error", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			for _, msg := range batch {
+				msgs <- msg
+			}
+		}
+	}()
+	return msgs
+}
+
+// readHighest reads one new entry from the first of the streams in KEYS
+// that has any. XREADGROUP over several streams would deliver an entry of
+// each of them to the consumer, and so take lower priority tasks away from
+// the other workers.
+var readHighest = redis.NewScript(`
+for _, stream in ipairs(KEYS) do
+	local reply = redis.call('XREADGROUP', 'GROUP', ARGV[1], ARGV[2], 'COUNT', 1, 'STREAMS', stream, '>')
+	if reply then
+		return reply[1]
+	end
+end
+return false
+`)
+
+// next reads the entry of the highest priority in a single round trip and,
+// when all streams are empty, blocks on all of them at once.
+func (c ConsumerRedis) next(ctx context.Context) ([]streamMessage, error) {
+	streams := priorityStreams()
+	reply, err := readHighest.Run(ctx, c.rdb, streams, consumerGroup, c.name).Slice()
+	if err == redis.Nil {
+		return c.read(ctx, streams, readBlock)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(reply) != 2 {
+		return nil, fmt.Errorf("unexpected XREADGROUP reply of length %d", len(reply))
+	}
+	stream, _ := reply[0].(string)
+	entries, _ := reply[1].([]interface{})
+	var batch []streamMessage
+	for _, msg := range parseEntries(entries) {
+		batch = append(batch, streamMessage{c.rdb, stream, msg})
+	}
+	return batch, nil
+}
+
+func (c ConsumerRedis) read(ctx context.Context, streams []string, block time.Duration) ([]streamMessage, error) {
+	args := append([]string{}, streams...)
+	for range streams {
+		args = append(args, ">")
+	}
+	res, err := c.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    consumerGroup,
+		Consumer: c.name,
+		Streams:  args,
+		Count:    1,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var batch []streamMessage
+	for _, stream := range res {
+		for _, msg := range stream.Messages {
+			batch = append(batch, streamMessage{c.rdb, stream.Stream, msg})
+		}
+	}
+	return batch, nil
+}
+
+// moveLegacyEntries moves up to ARGV[1] entries, following the ID in ARGV[2],
+// from the stream in KEYS[1] that versions without priorities used to the
+// priority streams in KEYS[2] onwards, lowest priority first, each to the one
+// named by the priority of its task. Entries a consumer of the group in
+// ARGV[3] took less than ARGV[4] milliseconds ago are left to it. Entries are
+// moved in one script, so that workers moving them at the same time do not
+// queue a task twice. It returns the number of entries read and the ID of the
+// last one.
+var moveLegacyEntries = redis.NewScript(`
+local busy = {}
+local ok, pending = pcall(redis.call, 'XPENDING', KEYS[1], ARGV[3], '-', '+', 1000)
+if ok then
+	for _, p in ipairs(pending) do
+		if p[3] < tonumber(ARGV[4]) then
+			busy[p[1]] = true
+		end
+	end
+end
+local entries = redis.call('XRANGE', KEYS[1], ARGV[2], '+', 'COUNT', ARGV[1])
+local last = ARGV[2]
+for _, entry in ipairs(entries) do
+	last = entry[1]
+	if not busy[entry[1]] then
+		local fields = entry[2]
+		local priority = 0
+		for i = 1, #fields, 2 do
+			if fields[i] == 'body' then
+				local decoded, task = pcall(cjson.decode, fields[i + 1])
+				if decoded and type(task) == 'table' and type(task.priority) == 'number' then
+					priority = math.max(0, math.min(#KEYS - 2, math.floor(task.priority)))
+				end
+			end
+		end
+		redis.call('XADD', KEYS[priority + 2], '*', unpack(fields))
+		redis.call('XDEL', KEYS[1], entry[1])
+	end
+end
+return {#entries, last}
+`)
+
+// moveLegacy moves the tasks left in the taskQueue stream, by versions
+// without priorities or by such versions still running during an upgrade, to
+// the priority streams. Those versions acknowledged entries by deleting them,
+// so the stream only holds tasks that were not processed yet. Tasks without a
+// priority are moved to the lowest one.
+func (c ConsumerRedis) moveLegacy(ctx context.Context) {
+	streams := priorityStreams()
+	slices.Reverse(streams)
+	keys := append([]string{taskQueue}, streams...)
+	start := "-"
+	for {
+		reply, err := moveLegacyEntries.Run(ctx, c.rdb, keys, legacyBatch, start, consumerGroup, reclaimIdle.Milliseconds()).Slice()
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to move tasks from the legacy stream", "error", err)
+			return
+		}
+		if len(reply) != 2 {
+			slog.ErrorContext(ctx, "unexpected reply moving tasks from the legacy stream", "length", len(reply))
+			return
+		}
+		read, _ := reply[0].(int64)
+		last, _ := reply[1].(string)
+		if read < legacyBatch {
+			return
+		}
+		start = "(" + last
+	}
+}
+
+// reclaim takes over entries that were delivered to other consumers of the
+// group but have not been acknowledged within reclaimIdle.
+func (c ConsumerRedis) reclaim(ctx context.Context) []streamMessage {
+	var claimed []streamMessage
+	for _, stream := range priorityStreams() {
+		start := "0-0"
+		for {
+			msgs, next, err := c.autoClaim(ctx, stream, start)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to reclaim pending entries", "error", err)
+				break
+			}
+			for _, msg := range msgs {
+				claimed = append(claimed, streamMessage{c.rdb, stream, msg})
+			}
+			if next == "0-0" {
+				break
+			}
+			start = next
+		}
+	}
+	return claimed
+}
+
+// autoClaim issues XAUTOCLAIM directly: the typed helper of go-redis v8
+// cannot parse the three-element reply returned by Redis 7.
+func (c ConsumerRedis) autoClaim(ctx context.Context, stream, start string) ([]redis.XMessage, string, error) {
+	reply, err := c.rdb.Do(ctx, "XAUTOCLAIM", stream, consumerGroup, c.name,
+		reclaimIdle.Milliseconds(), start, "COUNT", 100).Slice()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(reply) < 2 {
+		return nil, "", fmt.Errorf("unexpected XAUTOCLAIM reply of length %d", len(reply))
+	}
+	next, _ := reply[0].(string)
+	entries, _ := reply[1].([]interface{})
+	return parseEntries(entries), next, nil
+}
+
+// parseEntries converts stream entries returned by commands that go-redis
+// does not parse itself.
+func parseEntries(entries []interface{}) []redis.XMessage {
+	var msgs []redis.XMessage
+	for _, entry := range entries {
+		// Entries deleted while pending are reported as nil by Redis 6.2.
+		fields, ok := entry.([]interface{})
+		if !ok || len(fields) != 2 {
+			continue
+		}
+		id, _ := fields[0].(string)
+		pairs, _ := fields[1].([]interface{})
+		values := make(map[string]interface{}, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			key, _ := pairs[i].(string)
+			values[key] = pairs[i+1]
+		}
+		msgs = append(msgs, redis.XMessage{ID: id, Values: values})
+	}
+	return msgs
+}
+
+func (b ProducerRedis) Publish(ctx context.Context, task *Task) error {
+	body, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task: %w", err)
+	}
+
+	values := map[string]interface{}{bodyField: body}
+	for key, value := range headers(ctx) {
+		values[headerPrefix+key] = value
+	}
+	err = b.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: priorityStream(min(task.Priority, MaxPriority)),
+		Values: values,
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to publish task: %w", err)
+	}
+
+	return nil
+}
+
+func (b ProducerRedis) Ping(ctx context.Context) error {
+	return b.rdb.Ping(ctx).Err()
+}
+
+func (c ConsumerRedis) Ping(ctx context.Context) error {
+	return c.rdb.Ping(ctx).Err()
+}
+
+// Depth counts the entries of all priority streams that were not delivered
+// yet. Acknowledged entries are deleted, so the rest are pending.
+func (c ConsumerRedis) Depth(ctx context.Context) (int64, error) {
+	var depth int64
+	for _, stream := range priorityStreams() {
+		length, err := c.rdb.XLen(ctx, stream).Result()
+		if err != nil {
+			return 0, err
+		}
+		pending, err := c.rdb.XPending(ctx, stream, consumerGroup).Result()
+		if err != nil {
+			return 0, err
+		}
+		depth += length - pending.Count
+	}
+	return depth, nil
+}
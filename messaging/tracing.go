@@ -0,0 +1,48 @@
+package messaging
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	. "hw/models"
+)
+
+var tracer = otel.Tracer("hw/messaging")
+
+// tracedProducer records a span for every task it publishes. The span is
+// the parent of the one in which the worker processes the task, since its
+// context is what travels in the headers of the message.
+type tracedProducer struct {
+	Producer
+	system string
+}
+
+func (p tracedProducer) Publish(ctx context.Context, task *Task) error {
+	ctx, span := tracer.Start(ctx, taskQueue+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String(p.system),
+			semconv.MessagingDestinationName(taskQueue),
+			semconv.MessagingOperationTypePublish,
+		))
+	defer span.End()
+	err := p.Producer.Publish(ctx, task)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// StartProcessing starts the span in which the worker processes msg, as a
+// child of the span that published it.
+func StartProcessing(ctx context.Context, msg Message) (context.Context, trace.Span) {
+	return tracer.Start(Context(ctx, msg), taskQueue+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingDestinationName(taskQueue),
+			semconv.MessagingOperationTypeDeliver,
+		))
+}
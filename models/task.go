@@ -1,7 +1,11 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"github.com/google/uuid"
+	"time"
 )
 
 type Filter struct {
@@ -15,11 +19,22 @@ type ImageProcessorPayload struct {
 }
 
 type Task struct {
-	ID      uuid.UUID `json:"task_id"`
-	UserID  uuid.UUID `json:"user_id"`
-	Payload ImageProcessorPayload
-	Status  string `json:"status"`
-	Result  string `json:"result"`
+	ID       uuid.UUID `json:"task_id"`
+	UserID   uuid.UUID `json:"user_id"`
+	Payload  ImageProcessorPayload
+	Priority uint8  `json:"priority"`
+	CacheKey string `json:"cache_key,omitempty"`
+	Status   string `json:"status"`
+	Result   string `json:"result"`
+	// ExpiresAt is when the result is deleted. Tasks without it are kept
+	// forever.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the result of the task is gone or about to be
+// deleted.
+func (t *Task) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
 }
 
 func (t *Task) GetFloatParameter(name string) (float64, bool) {
@@ -30,3 +45,20 @@ func (t *Task) GetFloatParameter(name string) (float64, bool) {
 	answer, ok := value.(float64)
 	return answer, ok
 }
+
+// CacheKey identifies the result of applying a filter to an image submitted
+// by a user. The image is hashed as the file bytes decoded from base64, so
+// the same picture saved differently gets a different key. The filter is
+// hashed in its canonical JSON encoding (map keys sorted), so equal filters
+// match however they were spelled in the request. Keys are scoped to the
+// user, so that a cache hit does not reveal that someone else submitted the
+// same image.
+func CacheKey(userID uuid.UUID, image []byte, filter Filter) string {
+	canonical, _ := json.Marshal(filter)
+	h := sha256.New()
+	h.Write(userID[:])
+	h.Write(canonical)
+	h.Write([]byte{0})
+	h.Write(image)
+	return hex.EncodeToString(h.Sum(nil))
+}
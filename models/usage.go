@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// Usage is the consumption of a user in the current quota period. Limits
+// that are not configured are omitted.
+type Usage struct {
+	Period        string    `json:"period"`
+	ResetsAt      time.Time `json:"resets_at"`
+	Tasks         int64     `json:"tasks"`
+	MaxTasks      int64     `json:"max_tasks,omitempty"`
+	Megapixels    float64   `json:"megapixels"`
+	MaxMegapixels float64   `json:"max_megapixels,omitempty"`
+}
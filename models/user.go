@@ -2,8 +2,24 @@ package models
 
 import "github.com/google/uuid"
 
+const (
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleAuditor = "auditor"
+)
+
 type User struct {
 	ID       uuid.UUID `json:"user_id"`
 	Login    string    `json:"username"`
-	Password string    `json:"password"`
+	Password string    `json:"password,omitempty"`
+	Role     string    `json:"role"`
+	Disabled bool      `json:"disabled"`
+}
+
+// OIDCIdentity is a user authenticated by an OpenID Connect provider. Login
+// is the username proposed for a new account.
+type OIDCIdentity struct {
+	Issuer  string
+	Subject string
+	Login   string
 }
@@ -0,0 +1,184 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	. "hw/storage"
+	"io"
+	"net/http"
+	"time"
+)
+
+type ProfileRequest struct {
+	Login string `json:"username"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// AccountDeletionRequest confirms the deletion with the password. Accounts
+// without a password, which sign in through OIDC, send no body and must have
+// signed in recently instead.
+type AccountDeletionRequest struct {
+	CurrentPassword string `json:"current_password"`
+}
+
+// passwordError writes the response to a failed check of the current
+// password.
+func passwordError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*InvalidCredentialsError); ok {
+		http.Error(w, "Wrong current password", http.StatusForbidden)
+	} else if _, ok := err.(*NoPasswordError); ok {
+		http.Error(w, err.Error(), http.StatusForbidden)
+	} else if locked, ok := err.(*LoginLockedError); ok {
+		setRetryAfter(w, locked.RetryAfter)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	} else {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// getMeHandler returns the profile of the current user.
+// @Summary Get profile
+// @Description Returns the account of the current user.
+// @Tags user
+// @Produce  json
+// @Success 200 {object} models.User "Profile"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /me [get]
+func (s *Server) getMeHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := s.storage.GetUser(r.Context(), r.Context().Value("user_id").(uuid.UUID))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sendObject(w, user)
+}
+
+// patchMeHandler updates the profile of the current user.
+// @Summary Update profile
+// @Description Changes the username of the current user.
+// @Tags user
+// @Accept  json
+// @Produce  json
+// @Param request body ProfileRequest true "New username"
+// @Success 200 {object} models.User "Profile"
+// @Failure 400 {string} string "Invalid request or username"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 409 {string} string "User already exists"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /me [patch]
+func (s *Server) patchMeHandler(w http.ResponseWriter, r *http.Request) {
+	var request ProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Login == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(uuid.UUID)
+	if err := s.storage.RenameUser(r.Context(), userID, request.Login); err != nil {
+		if _, ok := err.(*UserExistsError); ok {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else if _, ok := err.(*InvalidLoginError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	s.getMeHandler(w, r)
+}
+
+// postPasswordHandler changes the password of the current user.
+// @Summary Change password
+// @Description Changes the password and revokes all other sessions of the current user.
+// @Description Wrong current passwords count as failed logins and lock the account out in the same way.
+// @Tags user
+// @Accept  json
+// @Param request body PasswordChangeRequest true "Current and new password"
+// @Success 204 "Password changed"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Wrong current password or account has no password"
+// @Failure 429 {string} string "Too many failed attempts, see Retry-After"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /me/password [post]
+func (s *Server) postPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var request PasswordChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.NewPassword == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(uuid.UUID)
+	sessionID := r.Context().Value("session_id").(uuid.UUID)
+	err := s.storage.ChangePassword(r.Context(), userID, sessionID, clientIP(r), request.CurrentPassword, request.NewPassword)
+	if err != nil {
+		passwordError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteMeHandler deletes the account of the current user.
+// @Summary Delete account
+// @Description Deletes the current user with all their tasks, images, results and API keys and revokes all sessions.
+// @Description Requires the current password, or for accounts without a password a session opened recently.
+// @Description Wrong passwords count as failed logins and lock the account out in the same way.
+// @Tags user
+// @Accept  json
+// @Param request body AccountDeletionRequest false "Current password"
+// @Success 204 "Account deleted"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Wrong current password or session too old"
+// @Failure 429 {string} string "Too many failed attempts, see Retry-After"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /me [delete]
+func (s *Server) deleteMeHandler(w http.ResponseWriter, r *http.Request) {
+	var request AccountDeletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(uuid.UUID)
+	sessionID := r.Context().Value("session_id").(uuid.UUID)
+	err := s.storage.VerifyPassword(r.Context(), userID, clientIP(r), request.CurrentPassword)
+	if _, ok := err.(*NoPasswordError); ok {
+		var recent bool
+		recent, err = s.recentLogin(r.Context(), userID, sessionID)
+		if err == nil && !recent {
+			http.Error(w, "Sign in again to delete the account", http.StatusForbidden)
+			return
+		}
+	}
+	if err != nil {
+		passwordError(w, err)
+		return
+	}
+	if err := s.storage.DeleteAccount(r.Context(), userID); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recentLogin reports whether the session was opened, rather than refreshed,
+// within the last Config.RecentLogin.
+func (s *Server) recentLogin(ctx context.Context, userID, sessionID uuid.UUID) (bool, error) {
+	sessions, err := s.storage.ListSessions(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, session := range sessions {
+		if session.SessionID == sessionID {
+			return time.Since(session.CreatedAt) < s.config.RecentLogin, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,179 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	. "hw/storage"
+	"net/http"
+	"strconv"
+)
+
+type TaskInfo struct {
+	ID       uuid.UUID `json:"task_id"`
+	UserID   uuid.UUID `json:"user_id"`
+	Priority uint8     `json:"priority"`
+	Status   string    `json:"status"`
+}
+
+type FailTaskRequest struct {
+	Reason string `json:"reason"`
+}
+
+// getAdminUsersHandler lists all users.
+// @Summary List users
+// @Description Lists all users with their roles. Requires the admin or auditor role.
+// @Tags admin
+// @Produce  json
+// @Success 200 {array} models.User "Users"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /admin/users [get]
+func (s *Server) getAdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := s.storage.ListUsers(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sendObject(w, users)
+}
+
+// getAdminTasksHandler lists tasks of all users.
+// @Summary List tasks
+// @Description Lists tasks of all users without their images, newest first. Requires the admin or auditor role.
+// @Tags admin
+// @Produce  json
+// @Param status query string false "Only tasks with this status"
+// @Param limit query int false "Maximum number of tasks (default 100)"
+// @Success 200 {array} TaskInfo "Tasks"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /admin/tasks [get]
+func (s *Server) getAdminTasksHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tasks, err := s.storage.ListTasks(r.Context(), r.URL.Query().Get("status"), limit)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	infos := make([]TaskInfo, 0, len(tasks))
+	for _, task := range tasks {
+		infos = append(infos, TaskInfo{task.ID, task.UserID, task.Priority, task.Status})
+	}
+	sendObject(w, infos)
+}
+
+func (s *Server) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	userID, err := uuid.Parse(chi.URLParam(r, "user_id"))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if disabled && userID == r.Context().Value("user_id").(uuid.UUID) {
+		http.Error(w, "You cannot disable your own account", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.storage.SetUserDisabled(r.Context(), userID, disabled); err != nil {
+		if _, ok := err.(*UserNotFoundError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if disabled {
+		if err := s.storage.DeleteUserSessions(r.Context(), userID); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postDisableUserHandler disables an account.
+// @Summary Disable a user
+// @Description Disables an account and revokes its sessions. Its API keys stop working. Requires the admin role.
+// @Tags admin
+// @Param user_id path string true "User ID"
+// @Success 204 "User disabled"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "User not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /admin/users/{user_id}/disable [post]
+func (s *Server) postDisableUserHandler(w http.ResponseWriter, r *http.Request) {
+	s.setUserDisabled(w, r, true)
+}
+
+// postEnableUserHandler enables a disabled account.
+// @Summary Enable a user
+// @Description Enables a previously disabled account. Requires the admin role.
+// @Tags admin
+// @Param user_id path string true "User ID"
+// @Success 204 "User enabled"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "User not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /admin/users/{user_id}/enable [post]
+func (s *Server) postEnableUserHandler(w http.ResponseWriter, r *http.Request) {
+	s.setUserDisabled(w, r, false)
+}
+
+// postFailTaskHandler marks a stuck task as failed.
+// @Summary Fail a task
+// @Description Marks a task that is still in progress as failed. Requires the admin role.
+// @Tags admin
+// @Accept  json
+// @Param task_id path string true "Task ID"
+// @Param request body FailTaskRequest false "Reason reported as the task result"
+// @Success 204 "Task failed"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "Task not found"
+// @Failure 409 {string} string "Task is not in progress"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /admin/tasks/{task_id}/fail [post]
+func (s *Server) postFailTaskHandler(w http.ResponseWriter, r *http.Request) {
+	taskID, err := uuid.Parse(chi.URLParam(r, "task_id"))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	request := FailTaskRequest{Reason: "Failed by an administrator"}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.storage.FailTask(r.Context(), taskID, request.Reason); err != nil {
+		switch err.(type) {
+		case *TaskNotFoundError:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case *TaskNotInProgressError:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
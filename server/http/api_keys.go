@@ -0,0 +1,161 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	. "hw/models"
+	. "hw/storage"
+	"net/http"
+	"slices"
+)
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type CreatedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+func parseAPIKeyRequest(r *http.Request) (*APIKeyRequest, error) {
+	var request APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return nil, err
+	}
+	if request.Name == "" || len(request.Name) > 100 || len(request.Scopes) == 0 {
+		return nil, errInvalidRequest
+	}
+	for _, scope := range request.Scopes {
+		if !slices.Contains(APIKeyScopes, scope) {
+			return nil, errInvalidRequest
+		}
+	}
+	return &request, nil
+}
+
+// postAPIKeyHandler creates an API key.
+// @Summary Create an API key
+// @Description Creates a long-lived API key for non-interactive clients. The key is returned only once.
+// @Description Send it as "Authorization: Bearer <key>" or "X-API-Key: <key>".
+// @Tags api-keys
+// @Accept  json
+// @Produce  json
+// @Param request body APIKeyRequest true "Name and scopes (tasks:read, tasks:write)"
+// @Success 201 {object} CreatedAPIKey "API key"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /api-keys [post]
+func (s *Server) postAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	request, err := parseAPIKeyRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	key := APIKey{
+		UserID: r.Context().Value("user_id").(uuid.UUID),
+		Name:   request.Name,
+		Scopes: request.Scopes,
+	}
+	secret, err := s.storage.AddAPIKey(r.Context(), &key)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	sendObject(w, CreatedAPIKey{key, secret})
+}
+
+// getAPIKeysHandler lists API keys.
+// @Summary List API keys
+// @Description Lists the active API keys of the current user.
+// @Tags api-keys
+// @Produce  json
+// @Success 200 {array} models.APIKey "API keys"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /api-keys [get]
+func (s *Server) getAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.storage.ListAPIKeys(r.Context(), r.Context().Value("user_id").(uuid.UUID))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sendObject(w, keys)
+}
+
+// patchAPIKeyHandler renames an API key or changes its scopes.
+// @Summary Update an API key
+// @Description Changes the name and scopes of an API key.
+// @Tags api-keys
+// @Accept  json
+// @Produce  json
+// @Param key_id path string true "API key ID"
+// @Param request body APIKeyRequest true "Name and scopes (tasks:read, tasks:write)"
+// @Success 200 {object} models.APIKey "API key"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "API key not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /api-keys/{key_id} [patch]
+func (s *Server) patchAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, err := uuid.Parse(chi.URLParam(r, "key_id"))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	request, err := parseAPIKeyRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	key := APIKey{
+		ID:     keyID,
+		UserID: r.Context().Value("user_id").(uuid.UUID),
+		Name:   request.Name,
+		Scopes: request.Scopes,
+	}
+	if err := s.storage.UpdateAPIKey(r.Context(), &key); err != nil {
+		if _, ok := err.(*APIKeyNotFoundError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	sendObject(w, key)
+}
+
+// deleteAPIKeyHandler revokes an API key.
+// @Summary Revoke an API key
+// @Description Revokes an API key. Requests using it are rejected from then on.
+// @Tags api-keys
+// @Param key_id path string true "API key ID"
+// @Success 204 "API key revoked"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "API key not found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /api-keys/{key_id} [delete]
+func (s *Server) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, err := uuid.Parse(chi.URLParam(r, "key_id"))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	userID := r.Context().Value("user_id").(uuid.UUID)
+	if err := s.storage.RevokeAPIKey(r.Context(), userID, keyID); err != nil {
+		if _, ok := err.(*APIKeyNotFoundError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,28 @@
+package http
+
+import (
+	"net/http"
+)
+
+// getHealthzHandler reports that the server is alive.
+// @Summary Liveness probe
+// @Description Succeeds as long as the server answers requests. Dependencies are not checked.
+// @Tags health
+// @Produce  json
+// @Success 200 {object} health.Report "Alive"
+// @Router /healthz [get]
+func (s *Server) getHealthzHandler(w http.ResponseWriter, r *http.Request) {
+	s.config.Health.Live(w, r)
+}
+
+// getReadyzHandler reports whether the server can handle requests.
+// @Summary Readiness probe
+// @Description Checks the database, Redis and the task queue, each with a timeout, and reports the outcome of every check.
+// @Tags health
+// @Produce  json
+// @Success 200 {object} health.Report "Ready"
+// @Failure 503 {object} health.Report "A dependency is unavailable"
+// @Router /readyz [get]
+func (s *Server) getReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	s.config.Health.ReadyHandler(w, r)
+}
@@ -2,22 +2,65 @@ package http
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	httpSwagger "github.com/swaggo/http-swagger"
+	"hw/health"
+	"hw/imagecheck"
 	. "hw/messaging"
 	. "hw/models"
 	_ "hw/server/docs"
 	. "hw/storage"
+	"image"
+	"log/slog"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Server struct {
 	storage Storage
 	broker  Producer
+	config  Config
+}
+
+type Config struct {
+	// MaxRequestBytes bounds the size of a POST /task body.
+	MaxRequestBytes int64
+	ImageLimits     imagecheck.Limits
+	// TaskRateLimit applies to POST /task per user, AuthRateLimit to
+	// /login and /register per client address.
+	TaskRateLimit RateLimit
+	AuthRateLimit RateLimit
+	// PasswordLogin enables /register and /login. OIDC enables /oidc/login
+	// when it is not nil.
+	PasswordLogin bool
+	OIDC          *OIDC
+	// RecentLogin is how long after signing in users without a password
+	// may delete their account.
+	RecentLogin time.Duration
+	// TaskRetention sets when new tasks expire, depending on the role of
+	// their owner.
+	TaskRetention Retention
+	// Health checks the dependencies for /readyz.
+	Health *health.Checker
+}
+
+// TaskRequest is the body of POST /task. Priority ranges from 0 to 9 and
+// defaults to 5 when omitted; priorities above 7 are reserved for admins and
+// lowered to 7 for other users. NoCache forces processing even when the same
+// image was already processed with the same filter.
+type TaskRequest struct {
+	ImageProcessorPayload
+	Priority *uint8 `json:"priority,omitempty"`
+	NoCache  bool   `json:"no_cache,omitempty"`
 }
 
 type Response struct {
@@ -26,59 +69,124 @@ type Response struct {
 	Code  int
 }
 
-func NewServer(storage Storage, broker Producer) *Server {
-	return &Server{storage, broker}
+func NewServer(storage Storage, broker Producer, config Config) *Server {
+	return &Server{storage, broker, config}
 }
 
+// AuthMiddleware accepts both session access tokens and API keys, sent as
+// "Authorization: Bearer <token>" or, for API keys, "X-API-Key: <key>".
 func (s *Server) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(true, next)
+}
+
+// SessionMiddleware accepts only session access tokens. It guards endpoints
+// that manage credentials, which API keys must not reach.
+func (s *Server) SessionMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(false, next)
+}
+
+func (s *Server) authenticate(allowAPIKeys bool, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Unauthorized: Missing token", http.StatusUnauthorized)
-			return
+		token := r.Header.Get("X-API-Key")
+		if token == "" {
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" {
+				http.Error(w, "Unauthorized: Missing token", http.StatusUnauthorized)
+				return
+			}
+			if !strings.HasPrefix(authHeader, "Bearer ") {
+				http.Error(w, "Unauthorized: Invalid token format", http.StatusUnauthorized)
+				return
+			}
+			token = strings.TrimPrefix(authHeader, "Bearer ")
 		}
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			http.Error(w, "Unauthorized: Invalid token format", http.StatusUnauthorized)
+
+		if strings.HasPrefix(token, APIKeyPrefix) {
+			if !allowAPIKeys {
+				http.Error(w, "Forbidden: API keys cannot access this endpoint", http.StatusForbidden)
+				return
+			}
+			key, err := s.storage.UseAPIKey(r.Context(), token)
+			if err != nil {
+				http.Error(w, "Unauthorized: Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			ctx := context.WithValue(r.Context(), "user_id", key.UserID)
+			ctx = context.WithValue(ctx, "role", key.Role)
+			ctx = context.WithValue(ctx, "api_key", &key)
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		userID, err := s.storage.GetUserBySession(token)
+		session, err := s.storage.GetSession(r.Context(), token)
 		if err != nil {
 			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "user_id", userID)
+		ctx := context.WithValue(r.Context(), "user_id", session.UserID)
+		ctx = context.WithValue(ctx, "role", session.Role)
+		ctx = context.WithValue(ctx, "session_id", session.SessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
+// RequireScope rejects requests authenticated with an API key that lacks the
+// scope. Session tokens carry every scope.
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := r.Context().Value("api_key").(*APIKey); ok && !key.HasScope(scope) {
+			http.Error(w, "Forbidden: API key lacks the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// RequireRole rejects requests of users that have none of the roles.
+func RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, _ := r.Context().Value("role").(string)
+		if !slices.Contains(roles, role) {
+			http.Error(w, "Forbidden: insufficient role", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+var errInvalidRequest = errors.New("invalid request")
+
 func parseUserRequest(r *http.Request) (*User, error) {
 	var user User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
 		return nil, err
 	}
 	if user.Login == "" || user.Password == "" {
-		return nil, errors.New("invalid request")
+		return nil, errInvalidRequest
 	}
 	return &user, nil
 }
 
 func sendJSON(w http.ResponseWriter, key, value string) {
 	response := map[string]string{key: value}
+	sendObject(w, response)
+}
+
+func sendObject(w http.ResponseWriter, response any) {
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(response)
 }
 
 // postRegisterHandler registers a new user.
 // @Summary Register a new user
-// @Description Creates a new user account.
+// @Description Creates a new user account. Usernames are compared case-insensitively and may contain 3 to 50 letters, digits and the characters ._-@
 // @Tags user
 // @Accept  json
 // @Produce  json
 // @Success 201 "User registered successfully"
 // @Failure 400 {string} string "Invalid request"
+// @Failure 429 {string} string "Too many requests, see Retry-After"
 // @Failure 500 {string} string "Failed to store user"
 // @Router /register [post]
 func (s *Server) postRegisterHandler(w http.ResponseWriter, r *http.Request) {
@@ -89,9 +197,13 @@ func (s *Server) postRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	newUser.ID = uuid.New()
-	if err := s.storage.AddUser(newUser); err != nil {
+	newUser.Role = RoleUser
+	newUser.Disabled = false
+	if err := s.storage.AddUser(r.Context(), newUser); err != nil {
 		if _, ok := err.(*UserExistsError); ok {
 			http.Error(w, "User already exists", http.StatusBadRequest)
+		} else if _, ok := err.(*InvalidLoginError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 		} else {
 			http.Error(w, "Failed to store user", http.StatusInternalServerError)
 		}
@@ -102,12 +214,14 @@ func (s *Server) postRegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 // postLoginHandler logs in an existing user.
 // @Summary Log in a user
-// @Description Authenticates a user and returns a token.
+// @Description Authenticates a user and returns a short-lived access token and a refresh token.
 // @Tags user
 // @Accept  json
 // @Produce  json
-// @Success 200 {object} map[string]string "Token"
+// @Success 200 {object} models.Tokens "Tokens"
 // @Failure 400 {string} string "Invalid credentials"
+// @Failure 403 {string} string "Account is disabled"
+// @Failure 429 {string} string "Too many requests or failed attempts, see Retry-After"
 // @Failure 500 {string} string "Internal Server Error"
 // @Router /login [post]
 func (s *Server) postLoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -117,16 +231,25 @@ func (s *Server) postLoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := s.storage.Login(user)
+	session := &Session{
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+	tokens, err := s.storage.Login(r.Context(), user, session)
 	if err != nil {
 		if _, ok := err.(*InvalidCredentialsError); ok {
 			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if _, ok := err.(*UserDisabledError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else if locked, ok := err.(*LoginLockedError); ok {
+			setRetryAfter(w, locked.RetryAfter)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
 		} else {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		}
 		return
 	}
-	sendJSON(w, "token", token)
+	sendObject(w, tokens)
 }
 
 func (s *Server) getTaskInfo(r *http.Request) Response {
@@ -135,7 +258,7 @@ func (s *Server) getTaskInfo(r *http.Request) Response {
 	if err != nil {
 		return Response{nil, err.Error(), http.StatusBadRequest}
 	}
-	task, err := s.storage.GetTask(taskID)
+	task, err := s.storage.GetTask(r.Context(), taskID)
 	if err != nil {
 		if _, ok := err.(*TaskNotFoundError); ok {
 			return Response{nil, "Task not found", http.StatusNotFound}
@@ -144,15 +267,19 @@ func (s *Server) getTaskInfo(r *http.Request) Response {
 		}
 	}
 	userID := r.Context().Value("user_id").(uuid.UUID)
-	if task.UserID != userID {
+	role, _ := r.Context().Value("role").(string)
+	if task.UserID != userID && role != RoleAdmin && role != RoleAuditor {
 		return Response{nil, "Forbidden: You are not the owner of this task", http.StatusForbidden}
 	}
+	if task.Expired(time.Now()) {
+		return Response{nil, "Task expired", http.StatusGone}
+	}
 	return Response{Data: &task}
 }
 
 // getStatusHandler retrieves the status of a task.
 // @Summary GetTask task status
-// @Description Retrieves the current status of the task by its ID.
+// @Description Retrieves the current status of the task by its ID. Expired tasks return 410.
 // @Tags tasks
 // @Accept  json
 // @Produce  json
@@ -161,6 +288,7 @@ func (s *Server) getTaskInfo(r *http.Request) Response {
 // @Failure 400 {string} string "Invalid request"
 // @Failure 401 {string} string "Unauthorized"
 // @Failure 404 {string} string "Task not found"
+// @Failure 410 {string} string "Task expired"
 // @Failure 500 {string} string "Internal Server Error"
 // @Router /status/{task_id} [get]
 func (s *Server) getStatusHandler(w http.ResponseWriter, r *http.Request) {
@@ -174,7 +302,7 @@ func (s *Server) getStatusHandler(w http.ResponseWriter, r *http.Request) {
 
 // getResultHandler retrieves the result of a task.
 // @Summary GetTask task result
-// @Description Retrieves the current result of the task by its ID.
+// @Description Retrieves the current result of the task by its ID. Results are deleted when the task expires, after which 410 is returned.
 // @Tags tasks
 // @Accept  json
 // @Produce  json
@@ -183,6 +311,7 @@ func (s *Server) getStatusHandler(w http.ResponseWriter, r *http.Request) {
 // @Failure 400 {string} string "Invalid request"
 // @Failure 401 {string} string "Unauthorized"
 // @Failure 404 {string} string "Task not found"
+// @Failure 410 {string} string "Task expired"
 // @Failure 500 {string} string "Internal Server Error"
 // @Router /result/{task_id} [get]
 func (s *Server) getResultHandler(w http.ResponseWriter, r *http.Request) {
@@ -194,41 +323,165 @@ func (s *Server) getResultHandler(w http.ResponseWriter, r *http.Request) {
 	sendJSON(w, "result", response.Data.Result)
 }
 
-func (s *Server) createTask(r *http.Request) Response {
-	task := &Task{
-		ID:     uuid.New(),
-		UserID: r.Context().Value("user_id").(uuid.UUID),
-		Status: "in_progress",
+// validateImage rejects images the worker would refuse anyway before anything
+// is stored or queued and returns the decoded image with its dimensions.
+func (s *Server) validateImage(encoded string) ([]byte, image.Config, Response) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, image.Config{}, Response{nil, "Invalid image data", http.StatusBadRequest}
 	}
-	if err := json.NewDecoder(r.Body).Decode(&task.Payload); err != nil {
+	config, _, err := imagecheck.Inspect(data, s.config.ImageLimits)
+	var tooLarge *imagecheck.ImageTooLargeError
+	switch {
+	case err == nil:
+		return data, config, Response{}
+	case errors.As(err, &tooLarge):
+		return nil, config, Response{nil, err.Error(), http.StatusRequestEntityTooLarge}
+	default:
+		return nil, config, Response{nil, err.Error(), http.StatusUnsupportedMediaType}
+	}
+}
+
+// completeFromCache marks the task ready if an identical submission has
+// already been processed.
+func (s *Server) completeFromCache(ctx context.Context, task *Task) error {
+	result, found, err := s.storage.FindCachedResult(ctx, task.CacheKey)
+	if err != nil {
+		return err
+	}
+	if found {
+		resultCacheLookups.WithLabelValues("hit").Inc()
+		task.Status = "ready"
+		task.Result = result
+	} else {
+		resultCacheLookups.WithLabelValues("miss").Inc()
+	}
+	return nil
+}
+
+func (s *Server) createTask(w http.ResponseWriter, r *http.Request) Response {
+	if s.config.MaxRequestBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxRequestBytes)
+	}
+	var request TaskRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return Response{nil, "Request body is too large", http.StatusRequestEntityTooLarge}
+		}
 		return Response{nil, "Invalid request", http.StatusBadRequest}
 	}
+	data, config, response := s.validateImage(request.Image)
+	if response.Error != "" {
+		return response
+	}
+	priority := DefaultPriority
+	if request.Priority != nil {
+		if *request.Priority > MaxPriority {
+			return Response{nil, "Invalid priority", http.StatusBadRequest}
+		}
+		priority = *request.Priority
+	}
+
+	role, _ := r.Context().Value("role").(string)
+	priority = ClampPriority(priority, role)
+	userID := r.Context().Value("user_id").(uuid.UUID)
+	task := &Task{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Payload:   request.ImageProcessorPayload,
+		CacheKey:  CacheKey(userID, data, request.Filter),
+		Status:    "in_progress",
+		ExpiresAt: s.config.TaskRetention.ExpiresAt(role, time.Now()),
+	}
+	if request.NoCache {
+		resultCacheLookups.WithLabelValues("bypassed").Inc()
+	} else if err := s.completeFromCache(r.Context(), task); err != nil {
+		return Response{nil, "Failed to add task", http.StatusInternalServerError}
+	}
 
-	if err := s.storage.AddTask(task); err != nil {
+	// Results served from the cache are not processed, so their pixels do
+	// not count towards the quota. The quota is taken back if the task
+	// cannot be created after all.
+	pixels := int64(config.Width) * int64(config.Height)
+	if task.Status == "ready" {
+		pixels = 0
+	}
+	if err := s.storage.ConsumeQuota(r.Context(), task.UserID, pixels); err != nil {
+		if exceeded, ok := err.(*QuotaExceededError); ok {
+			setRetryAfter(w, exceeded.RetryAfter)
+			return Response{nil, exceeded.Error(), http.StatusTooManyRequests}
+		}
 		return Response{nil, "Failed to add task", http.StatusInternalServerError}
 	}
+	// Once the quota is taken the task is stored and published, or the quota
+	// refunded, even if the client goes away in the meantime. The context
+	// still carries the request ID and trace into the message headers.
+	ctx := context.WithoutCancel(r.Context())
+	refund := func() {
+		if err := s.storage.RefundQuota(ctx, task.UserID, pixels); err != nil {
+			slog.ErrorContext(ctx, "failed to refund quota", "user_id", task.UserID, "error", err)
+		}
+	}
+
+	if task.Status == "ready" {
+		if err := s.storage.AddTask(ctx, task); err != nil {
+			refund()
+			return Response{nil, "Failed to add task", http.StatusInternalServerError}
+		}
+		tasksCreated.WithLabelValues("cache").Inc()
+		return Response{Data: task}
+	}
 
-	err := s.broker.Publish(task)
+	pending, err := s.storage.CountUserTasks(ctx, task.UserID, task.Status)
 	if err != nil {
+		refund()
+		return Response{nil, "Failed to add task", http.StatusInternalServerError}
+	}
+	task.Priority = FairPriority(priority, pending)
+
+	if err := s.storage.AddTask(ctx, task); err != nil {
+		refund()
+		return Response{nil, "Failed to add task", http.StatusInternalServerError}
+	}
+
+	err = s.broker.Publish(ctx, task)
+	if err != nil {
+		// The task will never be processed, so it must not stay in progress
+		// and count towards the tasks the user has pending.
+		if err := s.storage.FailTask(ctx, task.ID, "Failed to enqueue task"); err != nil {
+			slog.ErrorContext(ctx, "failed to fail unpublished task", "task_id", task.ID, "error", err)
+		}
+		refund()
 		return Response{nil, "Failed to enqueue task", http.StatusInternalServerError}
 	}
+	tasksCreated.WithLabelValues("queue").Inc()
 	return Response{Data: task}
 }
 
 // postTaskHandler handles task creation requests.
 // @Summary Create a new task
 // @Description Creates a new task, sends it to ImageProcessor and returns the task ID.
+// @Description The priority of the task is lowered while its owner has many tasks in progress.
+// @Description Priorities above 7 are reserved for admins and lowered to 7 for other users.
+// @Description If the user already had the same image processed with the same filter, the task is completed
+// @Description immediately from the cached result unless no_cache is set.
 // @Tags tasks
 // @Accept  json
 // @Produce  json
+// @Param task body TaskRequest true "Image, filter and optional priority (0-9)"
 // @Success 201 {object} map[string]string "Task ID"
 // @Failure 400 {string} string "Invalid request"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 413 {string} string "Request body or image is too large"
+// @Failure 415 {string} string "Unsupported image format"
+// @Failure 429 {string} string "Rate limit or quota exceeded, see Retry-After"
 // @Failure 500 {string} string "Failed to add task"
 // @Router /task [post]
 func (s *Server) postTaskHandler(w http.ResponseWriter, r *http.Request) {
-	response := s.createTask(r)
+	response := s.createTask(w, r)
 	if response.Error != "" {
+		taskCreationFailures.WithLabelValues(strconv.Itoa(response.Code)).Inc()
 		http.Error(w, response.Error, response.Code)
 		return
 	}
@@ -236,22 +489,81 @@ func (s *Server) postTaskHandler(w http.ResponseWriter, r *http.Request) {
 	sendJSON(w, "task_id", response.Data.ID.String())
 }
 
-func CreateAndRunServer(server *Server, addr string) error {
+// shutdownTimeout is how long requests in flight may take to finish once ctx
+// is cancelled. Requests still running after that have their context
+// cancelled, which aborts their database queries.
+const shutdownTimeout = 10 * time.Second
+
+// CreateAndRunServer serves the API until ctx is cancelled.
+func CreateAndRunServer(ctx context.Context, server *Server, addr string) error {
+	baseCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	httpServer := &http.Server{
+		Addr:        addr,
+		Handler:     server.routes(),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancelShutdown()
+		err := httpServer.Shutdown(shutdownCtx)
+		cancel()
+		shutdown <- err
+	}()
+
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdown
+}
+
+func (s *Server) routes() http.Handler {
 	r := chi.NewRouter()
+	r.Use(traceRequest)
+	r.Use(requestID)
+	r.Use(instrument)
 
 	r.Get("/swagger/*", httpSwagger.WrapHandler)
+	r.Handle("/metrics", promhttp.Handler())
+	r.Get("/healthz", s.getHealthzHandler)
+	r.Get("/readyz", s.getReadyzHandler)
 	r.Route("/", func(r chi.Router) {
-		r.Post("/register", server.postRegisterHandler)
-		r.Post("/login", server.postLoginHandler)
-		r.Get("/status/{task_id}", server.AuthMiddleware(server.getStatusHandler))
-		r.Get("/result/{task_id}", server.AuthMiddleware(server.getResultHandler))
-		r.Post("/task", server.AuthMiddleware(server.postTaskHandler))
+		if s.config.PasswordLogin {
+			r.Post("/register", s.RateLimitByIP("register", s.config.AuthRateLimit, s.postRegisterHandler))
+			r.Post("/login", s.RateLimitByIP("login", s.config.AuthRateLimit, s.postLoginHandler))
+		}
+		if s.config.OIDC != nil {
+			r.Get("/oidc/login", s.RateLimitByIP("oidc", s.config.AuthRateLimit, s.getOIDCLoginHandler))
+			r.Get("/oidc/callback", s.getOIDCCallbackHandler)
+			r.Get("/oidc/link", s.SessionMiddleware(s.getOIDCLinkHandler))
+		}
+		r.Post("/token/refresh", s.postRefreshHandler)
+		r.Post("/logout", s.SessionMiddleware(s.postLogoutHandler))
+		r.Post("/logout/all", s.SessionMiddleware(s.postLogoutAllHandler))
+		r.Get("/sessions", s.SessionMiddleware(s.getSessionsHandler))
+		r.Post("/api-keys", s.SessionMiddleware(s.postAPIKeyHandler))
+		r.Get("/api-keys", s.SessionMiddleware(s.getAPIKeysHandler))
+		r.Patch("/api-keys/{key_id}", s.SessionMiddleware(s.patchAPIKeyHandler))
+		r.Delete("/api-keys/{key_id}", s.SessionMiddleware(s.deleteAPIKeyHandler))
+		r.Route("/admin", func(r chi.Router) {
+			r.Get("/users", s.SessionMiddleware(RequireRole(s.getAdminUsersHandler, RoleAdmin, RoleAuditor)))
+			r.Get("/tasks", s.SessionMiddleware(RequireRole(s.getAdminTasksHandler, RoleAdmin, RoleAuditor)))
+			r.Post("/users/{user_id}/disable", s.SessionMiddleware(RequireRole(s.postDisableUserHandler, RoleAdmin)))
+			r.Post("/users/{user_id}/enable", s.SessionMiddleware(RequireRole(s.postEnableUserHandler, RoleAdmin)))
+			r.Post("/tasks/{task_id}/fail", s.SessionMiddleware(RequireRole(s.postFailTaskHandler, RoleAdmin)))
+		})
+		r.Get("/status/{task_id}", s.AuthMiddleware(RequireScope(ScopeTasksRead, s.getStatusHandler)))
+		r.Get("/result/{task_id}", s.AuthMiddleware(RequireScope(ScopeTasksRead, s.getResultHandler)))
+		r.Post("/task", s.AuthMiddleware(RequireScope(ScopeTasksWrite,
+			s.RateLimitByUser("task", s.config.TaskRateLimit, s.postTaskHandler))))
+		r.Get("/me", s.AuthMiddleware(s.getMeHandler))
+		r.Patch("/me", s.SessionMiddleware(s.patchMeHandler))
+		r.Delete("/me", s.SessionMiddleware(s.deleteMeHandler))
+		r.Post("/me/password", s.SessionMiddleware(s.postPasswordHandler))
+		r.Get("/me/usage", s.AuthMiddleware(s.getUsageHandler))
 	})
-
-	httpServer := &http.Server{
-		Addr:    addr,
-		Handler: r,
-	}
-
-	return httpServer.ListenAndServe()
+	return r
 }
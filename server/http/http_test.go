@@ -0,0 +1,298 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"hw/health"
+	"hw/image_processor/processor"
+	"hw/imagecheck"
+	. "hw/messaging"
+	. "hw/models"
+	. "hw/storage"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testAPI serves the API on top of the in-memory storage and queue. Tasks are
+// only processed once process is called.
+type testAPI struct {
+	*httptest.Server
+	storage Storage
+	queue   *MemoryQueue
+	broker  *unavailableQueue
+}
+
+// unavailableQueue publishes to the MemoryQueue unless down is set, in which
+// case Publish fails as it does when the broker cannot be reached.
+type unavailableQueue struct {
+	*MemoryQueue
+	down atomic.Bool
+}
+
+func (q *unavailableQueue) Publish(ctx context.Context, task *Task) error {
+	if q.down.Load() {
+		return errors.New("queue is unavailable")
+	}
+	return q.MemoryQueue.Publish(ctx, task)
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	signer, err := NewTokenSigner(map[string]string{"test": "test-secret"}, "test", "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewStorage(StorageMemory, DatabaseConfig{
+		TokenSigner:     signer,
+		PasswordParams:  PasswordParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+		CheckRevocation: true,
+		Quota:           Quota{Period: QuotaDaily},
+	})
+	queue := NewMemoryQueue()
+	broker := &unavailableQueue{MemoryQueue: queue}
+	server := NewServer(storage, broker, Config{
+		MaxRequestBytes: 1 << 20,
+		ImageLimits:     imagecheck.Limits{MaxPixels: 1_000_000, MaxMemory: 1 << 26},
+		PasswordLogin:   true,
+		Health:          health.NewChecker(time.Second),
+	})
+	api := &testAPI{httptest.NewServer(server.routes()), storage, queue, broker}
+	t.Cleanup(api.Close)
+	return api
+}
+
+// process runs the worker until the queue is empty.
+func (api *testAPI) process(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		processor.Run(ctx, api.queue, api.storage, processor.Config{TaskTimeout: 10 * time.Second})
+		close(done)
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		depth, _ := api.queue.Depth(ctx)
+		tasks, _ := api.storage.ListTasks(ctx, "in_progress", 1)
+		if depth == 0 && len(tasks) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tasks were not processed in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func (api *testAPI) do(t *testing.T, method, path, token string, body any) (*http.Response, map[string]any) {
+	t.Helper()
+	var reader bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.Reset(data)
+	}
+	req, err := http.NewRequest(method, api.URL+path, &reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var decoded map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&decoded)
+	return resp, decoded
+}
+
+func (api *testAPI) expect(t *testing.T, code int, method, path, token string, body any) map[string]any {
+	t.Helper()
+	resp, decoded := api.do(t, method, path, token, body)
+	if resp.StatusCode != code {
+		t.Fatalf("%s %s: expected %d, got %d", method, path, code, resp.StatusCode)
+	}
+	return decoded
+}
+
+func (api *testAPI) newUser(t *testing.T) string {
+	t.Helper()
+	user := map[string]string{"username": "user_" + uuid.NewString()[:8], "password": "password228"}
+	api.expect(t, http.StatusCreated, "POST", "/register", "", user)
+	tokens := api.expect(t, http.StatusOK, "POST", "/login", "", user)
+	token, _ := tokens["token"].(string)
+	if token == "" {
+		t.Fatalf("login returned no token: %v", tokens)
+	}
+	return token
+}
+
+func testImage(t *testing.T) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for x := 0; x < 8; x++ {
+		img.Set(x, x, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func taskRequest(image, filter string) map[string]any {
+	return map[string]any{"image": image, "filter": map[string]any{"name": filter}, "no_cache": true}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	api := newTestAPI(t)
+	user := map[string]string{"username": "Alice_" + uuid.NewString()[:8], "password": "password228"}
+
+	api.expect(t, http.StatusCreated, "POST", "/register", "", user)
+	api.expect(t, http.StatusBadRequest, "POST", "/register", "", user)
+	api.expect(t, http.StatusBadRequest, "POST", "/register", "", map[string]string{"username": "x"})
+
+	api.expect(t, http.StatusOK, "POST", "/login", "", user)
+	wrong := map[string]string{"username": user["username"], "password": "wrong"}
+	api.expect(t, http.StatusBadRequest, "POST", "/login", "", wrong)
+	unknown := map[string]string{"username": "user_" + uuid.NewString()[:8], "password": "password228"}
+	api.expect(t, http.StatusBadRequest, "POST", "/login", "", unknown)
+}
+
+func TestCreateTask(t *testing.T) {
+	api := newTestAPI(t)
+	token := api.newUser(t)
+	image := testImage(t)
+
+	api.expect(t, http.StatusUnauthorized, "POST", "/task", "", taskRequest(image, "Negative"))
+	api.expect(t, http.StatusBadRequest, "POST", "/task", token, "not a task")
+	api.expect(t, http.StatusUnsupportedMediaType, "POST", "/task", token,
+		taskRequest(base64.StdEncoding.EncodeToString([]byte("not an image")), "Negative"))
+
+	created := api.expect(t, http.StatusCreated, "POST", "/task", token, taskRequest(image, "Negative"))
+	if _, err := uuid.Parse(fmt.Sprint(created["task_id"])); err != nil {
+		t.Fatalf("POST /task returned %v", created)
+	}
+	if depth, _ := api.queue.Depth(context.Background()); depth != 1 {
+		t.Fatalf("expected one queued task, got %d", depth)
+	}
+
+	request := taskRequest(image, "Negative")
+	request["priority"] = MaxPriority
+	created = api.expect(t, http.StatusCreated, "POST", "/task", token, request)
+	tasks, _ := api.storage.ListTasks(context.Background(), "in_progress", 100)
+	for _, task := range tasks {
+		if task.ID.String() != created["task_id"] {
+			continue
+		}
+		if task.Priority > MaxUserPriority {
+			t.Fatalf("priority %d was not reserved for admins", task.Priority)
+		}
+		return
+	}
+	t.Fatalf("task %v was not stored", created["task_id"])
+}
+
+// TestCreateTaskRejectsCraftedTIFF uploads a TIFF whose only IFD entry claims
+// 2 GiB of strip offsets. The header check must reject it without allocating
+// what the entry claims.
+func TestCreateTaskRejectsCraftedTIFF(t *testing.T) {
+	api := newTestAPI(t)
+	token := api.newUser(t)
+	tiff := binary.LittleEndian.AppendUint32([]byte("II*\x00"), 8)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 273) // StripOffsets
+	tiff = binary.LittleEndian.AppendUint16(tiff, 4)   // LONG
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1<<29-1)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 26)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 0)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	resp, _ := api.do(t, "POST", "/task", token, taskRequest(base64.StdEncoding.EncodeToString(tiff), "Negative"))
+	runtime.ReadMemStats(&after)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge && resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 413 or 415, got %d", resp.StatusCode)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+		t.Fatalf("checking the image allocated %d MiB", allocated>>20)
+	}
+}
+
+func TestCreateTaskWhenQueueIsDown(t *testing.T) {
+	api := newTestAPI(t)
+	token := api.newUser(t)
+	api.broker.down.Store(true)
+
+	api.expect(t, http.StatusInternalServerError, "POST", "/task", token, taskRequest(testImage(t), "Negative"))
+	if usage := api.expect(t, http.StatusOK, "GET", "/me/usage", token, nil); usage["tasks"] != 0.0 || usage["megapixels"] != 0.0 {
+		t.Fatalf("the task that was not queued counts towards the quota: %v", usage)
+	}
+	if tasks, _ := api.storage.ListTasks(context.Background(), "in_progress", 100); len(tasks) != 0 {
+		t.Fatalf("the task that was not queued is in progress: %+v", tasks)
+	}
+	if tasks, _ := api.storage.ListTasks(context.Background(), "failed", 100); len(tasks) != 1 {
+		t.Fatalf("expected the task that was not queued to fail, got %+v", tasks)
+	}
+}
+
+func TestGetTask(t *testing.T) {
+	api := newTestAPI(t)
+	token := api.newUser(t)
+	created := api.expect(t, http.StatusCreated, "POST", "/task", token, taskRequest(testImage(t), "Negative"))
+	id := fmt.Sprint(created["task_id"])
+
+	status := api.expect(t, http.StatusOK, "GET", "/status/"+id, token, nil)
+	if status["status"] != "in_progress" {
+		t.Fatalf("expected in_progress, got %v", status)
+	}
+	api.process(t)
+	status = api.expect(t, http.StatusOK, "GET", "/status/"+id, token, nil)
+	if status["status"] != "ready" {
+		t.Fatalf("expected ready, got %v", status)
+	}
+	result := api.expect(t, http.StatusOK, "GET", "/result/"+id, token, nil)
+	data, err := base64.StdEncoding.DecodeString(fmt.Sprint(result["result"]))
+	if err != nil {
+		t.Fatalf("invalid result: %v", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("result is not a PNG: %v", err)
+	}
+
+	api.expect(t, http.StatusUnauthorized, "GET", "/status/"+id, "", nil)
+	api.expect(t, http.StatusForbidden, "GET", "/status/"+id, api.newUser(t), nil)
+	api.expect(t, http.StatusNotFound, "GET", "/status/"+uuid.NewString(), token, nil)
+	api.expect(t, http.StatusBadRequest, "GET", "/status/not-a-uuid", token, nil)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	api := newTestAPI(t)
+	token := api.newUser(t)
+
+	api.expect(t, http.StatusForbidden, "DELETE", "/me", token, nil)
+	api.expect(t, http.StatusForbidden, "DELETE", "/me", token, map[string]string{"current_password": "wrong"})
+	api.expect(t, http.StatusNoContent, "DELETE", "/me", token, map[string]string{"current_password": "password228"})
+	api.expect(t, http.StatusUnauthorized, "GET", "/me", token, nil)
+}
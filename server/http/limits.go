@@ -0,0 +1,63 @@
+package http
+
+import (
+	"github.com/google/uuid"
+	. "hw/storage"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// rateLimit rejects the request with 429 when the bucket named key is empty.
+// The request is let through if Redis is unavailable.
+func (s *Server) rateLimit(w http.ResponseWriter, r *http.Request, key string, limit RateLimit, next http.HandlerFunc) {
+	err := s.storage.Allow(r.Context(), key, limit)
+	if limited, ok := err.(*RateLimitedError); ok {
+		setRetryAfter(w, limited.RetryAfter)
+		http.Error(w, limited.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		slog.WarnContext(r.Context(), "rate limiter unavailable", "error", err)
+	}
+	next(w, r)
+}
+
+// RateLimitByIP limits the requests of each client address to the endpoint.
+func (s *Server) RateLimitByIP(endpoint string, limit RateLimit, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.rateLimit(w, r, endpoint+":"+clientIP(r), limit, next)
+	}
+}
+
+// RateLimitByUser limits the requests of each user to the endpoint. It must
+// run after AuthMiddleware.
+func (s *Server) RateLimitByUser(endpoint string, limit RateLimit, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(uuid.UUID)
+		s.rateLimit(w, r, endpoint+":"+userID.String(), limit, next)
+	}
+}
+
+// getUsageHandler returns the quota usage of the current user.
+// @Summary Get quota usage
+// @Description Returns the tasks and megapixels submitted in the current quota period and the configured limits.
+// @Tags user
+// @Produce  json
+// @Success 200 {object} models.Usage "Usage"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /me/usage [get]
+func (s *Server) getUsageHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.storage.GetUsage(r.Context(), r.Context().Value("user_id").(uuid.UUID))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sendObject(w, usage)
+}
@@ -0,0 +1,61 @@
+package http
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"hw/logging"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// RequestIDHeader carries the ID of a request. Clients may set it to have
+// their own IDs logged, and it is set on every response.
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID bounds the IDs accepted from clients, which end up in logs
+// and message headers.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// probeRoutes are requested every few seconds by orchestrators and
+// scrapers, so they are logged at the debug level only.
+var probeRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// requestID assigns an ID to the request, which is added to every line
+// logged while handling it and to the tasks it publishes, and logs the
+// request once it is answered.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := logging.WithRequestID(r.Context(), id)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String(logging.RequestIDKey, id))
+
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		route := chi.RouteContext(ctx).RoutePattern()
+		level := slog.LevelInfo
+		if probeRoutes[route] {
+			level = slog.LevelDebug
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		slog.Log(ctx, level, "request",
+			"method", r.Method,
+			"route", route,
+			"status", code,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"ip", clientIP(r))
+	})
+}
@@ -0,0 +1,57 @@
+package http
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP requests, by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	tasksCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tasks_created_total",
+		Help: "Tasks created, by whether they were queued or completed from the result cache.",
+	}, []string{"source"})
+	taskCreationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "task_creation_failures_total",
+		Help: "Rejected or failed task submissions, by status code.",
+	}, []string{"code"})
+	resultCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "result_cache_lookups_total",
+		Help: "Result cache lookups by outcome (hit, miss or bypassed).",
+	}, []string{"outcome"})
+)
+
+// instrument counts requests and measures their latency. Requests are
+// labelled with the route pattern rather than the path, which contains IDs.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		if route == "" {
+			route = "unmatched"
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(code)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,244 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+	. "hw/models"
+	. "hw/storage"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// oidcStateTTL bounds the time a user has to sign in at the provider.
+const oidcStateTTL = 10 * time.Minute
+
+// oidcStateCookie binds the login state to the browser that started the
+// login, so that an authorization response cannot be replayed into another
+// browser to sign it in to the attacker's account.
+const oidcStateCookie = "oidc_state"
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the address of GET /oidc/callback as seen by the browser.
+	RedirectURL string
+	Scopes      []string
+	// UsernameClaim names the ID token claim used as the username of new
+	// accounts. The subject is used when the claim is missing.
+	UsernameClaim string
+}
+
+// OIDC signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE.
+type OIDC struct {
+	config   OIDCConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDC fetches the provider metadata from the discovery document of the
+// issuer.
+func NewOIDC(ctx context.Context, cfg OIDCConfig) (*OIDC, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDC{
+		config: cfg,
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       append([]string{oidc.ScopeOpenID}, cfg.Scopes...),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// identity extracts the user from a verified ID token.
+func (o *OIDC) identity(token *oidc.IDToken) (OIDCIdentity, error) {
+	var claims map[string]any
+	if err := token.Claims(&claims); err != nil {
+		return OIDCIdentity{}, err
+	}
+	login, _ := claims[o.config.UsernameClaim].(string)
+	if login == "" {
+		login = token.Subject
+	}
+	return OIDCIdentity{Issuer: token.Issuer, Subject: token.Subject, Login: login}, nil
+}
+
+// stateCookie sets the login state cookie, or removes it with an empty state.
+func (o *OIDC) stateCookie(w http.ResponseWriter, state string) {
+	cookie := &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		Secure:   strings.HasPrefix(o.config.RedirectURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if state == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// getOIDCLoginHandler starts the OIDC login.
+// @Summary Log in with OIDC
+// @Description Redirects to the identity provider. After signing in there, the user is sent back to /oidc/callback.
+// @Description The callback must come from the same browser, which is recognized by a cookie.
+// @Tags user
+// @Success 302 "Redirect to the identity provider"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /oidc/login [get]
+func (s *Server) getOIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	s.startOIDC(w, r, uuid.Nil)
+}
+
+// getOIDCLinkHandler starts linking the current user to an OIDC identity.
+// @Summary Link OIDC identity
+// @Description Redirects to the identity provider like /oidc/login. The identity the user signs in with there is then
+// @Description linked to the current account, which can sign in with it from now on. Accounts are never linked otherwise.
+// @Tags user
+// @Success 302 "Redirect to the identity provider"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /oidc/link [get]
+func (s *Server) getOIDCLinkHandler(w http.ResponseWriter, r *http.Request) {
+	s.startOIDC(w, r, r.Context().Value("user_id").(uuid.UUID))
+}
+
+// startOIDC redirects to the identity provider to sign in, or to link the
+// identity to userID unless it is uuid.Nil.
+func (s *Server) startOIDC(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+	state, err := randomString()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	login := OIDCLoginState{Verifier: oauth2.GenerateVerifier(), Nonce: nonce, UserID: userID}
+	if err := s.storage.SaveOIDCState(r.Context(), state, login, oidcStateTTL); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	s.config.OIDC.stateCookie(w, state)
+	url := s.config.OIDC.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.Verifier))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// getOIDCCallbackHandler completes the OIDC login.
+// @Summary OIDC callback
+// @Description Exchanges the authorization code for an ID token and opens a session. The account is created on the first login.
+// @Description When the login was started by /oidc/link, the identity is linked to that account instead and no session is opened.
+// @Tags user
+// @Produce  json
+// @Param code query string true "Authorization code"
+// @Param state query string true "State issued by /oidc/login"
+// @Success 200 {object} models.Tokens "Tokens"
+// @Success 204 "Identity linked"
+// @Failure 400 {string} string "Invalid request or state not issued to this browser"
+// @Failure 401 {string} string "Authorization failed"
+// @Failure 403 {string} string "Account is disabled"
+// @Failure 409 {string} string "User already exists, or account or identity already linked"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /oidc/callback [get]
+func (s *Server) getOIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	o := s.config.OIDC
+	query := r.URL.Query()
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Login state was not issued to this browser", http.StatusBadRequest)
+		return
+	}
+	o.stateCookie(w, "")
+	if errorCode := query.Get("error"); errorCode != "" {
+		http.Error(w, "Authorization failed: "+errorCode, http.StatusUnauthorized)
+		return
+	}
+	login, err := s.storage.TakeOIDCState(r.Context(), state)
+	if err != nil {
+		if _, ok := err.(*InvalidTokenError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	token, err := o.oauth2.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC code exchange failed", "error", err)
+		http.Error(w, "Authorization failed", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := o.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != login.Nonce {
+		slog.WarnContext(r.Context(), "invalid OIDC ID token", "error", err)
+		http.Error(w, "Authorization failed", http.StatusUnauthorized)
+		return
+	}
+	identity, err := o.identity(idToken)
+	if err != nil {
+		http.Error(w, "Authorization failed", http.StatusUnauthorized)
+		return
+	}
+
+	if login.UserID != uuid.Nil {
+		if err := s.storage.LinkOIDC(r.Context(), login.UserID, identity); err != nil {
+			if _, ok := err.(*OIDCLinkedError); ok {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	session := &Session{
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+	tokens, err := s.storage.LoginOIDC(r.Context(), identity, session)
+	if err != nil {
+		if _, ok := err.(*UserExistsError); ok {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else if _, ok := err.(*InvalidLoginError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if _, ok := err.(*UserDisabledError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	sendObject(w, tokens)
+}
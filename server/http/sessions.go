@@ -0,0 +1,133 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	. "hw/storage"
+	"net"
+	"net/http"
+	"time"
+)
+
+type SessionInfo struct {
+	SessionID uuid.UUID `json:"session_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"`
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// postLogoutHandler revokes the session of the presented token.
+// @Summary Log out
+// @Description Revokes the current session token.
+// @Tags user
+// @Produce  json
+// @Success 204 "Session revoked"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /logout [post]
+func (s *Server) postLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(uuid.UUID)
+	sessionID := r.Context().Value("session_id").(uuid.UUID)
+	if err := s.storage.DeleteSession(r.Context(), userID, sessionID); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postLogoutAllHandler revokes every session of the user.
+// @Summary Log out everywhere
+// @Description Revokes all sessions of the current user, including the current one.
+// @Tags user
+// @Produce  json
+// @Success 204 "Sessions revoked"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /logout/all [post]
+func (s *Server) postLogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(uuid.UUID)
+	if err := s.storage.DeleteUserSessions(r.Context(), userID); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getSessionsHandler lists the active sessions of the user.
+// @Summary List sessions
+// @Description Lists the active sessions of the current user with their creation time and client.
+// @Tags user
+// @Produce  json
+// @Success 200 {array} SessionInfo "Active sessions"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /sessions [get]
+func (s *Server) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(uuid.UUID)
+	currentID := r.Context().Value("session_id").(uuid.UUID)
+	sessions, err := s.storage.ListSessions(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, SessionInfo{
+			SessionID: session.SessionID,
+			CreatedAt: session.CreatedAt,
+			UserAgent: session.UserAgent,
+			IP:        session.IP,
+			Current:   session.SessionID == currentID,
+		})
+	}
+	sendObject(w, infos)
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// postRefreshHandler rotates a refresh token.
+// @Summary Refresh tokens
+// @Description Exchanges a refresh token for a new access token and refresh token.
+// @Description Each refresh token can be used once; reusing one revokes its session.
+// @Tags user
+// @Accept  json
+// @Produce  json
+// @Param request body RefreshRequest true "Refresh token"
+// @Success 200 {object} models.Tokens "Tokens"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Invalid refresh token"
+// @Failure 403 {string} string "Account is disabled"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /token/refresh [post]
+func (s *Server) postRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var request RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.storage.RefreshSession(r.Context(), request.RefreshToken)
+	if err != nil {
+		if _, ok := err.(*InvalidTokenError); ok {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		} else if _, ok := err.(*UserDisabledError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	sendObject(w, tokens)
+}
@@ -0,0 +1,69 @@
+package http
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+var tracer = otel.Tracer("hw/server/http")
+
+// TraceIDHeader carries the ID of the trace of a request, under which its
+// spans can be looked up.
+const TraceIDHeader = "X-Trace-ID"
+
+// traceRequest records a span for every request. Probes and scrapes are not
+// traced.
+//
+// Every request starts a trace of its own, linked to the trace of the client
+// if it sent a traceparent header. Continuing the trace of the client would
+// let it decide the sampling, by the sampled flag or by a trace ID chosen to
+// fall under TRACE_SAMPLE_RATIO, and so make the server record every request.
+func traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probeRoutes[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		opts := []trace.SpanStartOption{
+			trace.WithNewRoot(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			),
+		}
+		if client := trace.SpanContextFromContext(ctx); client.IsValid() {
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: client}))
+		}
+		ctx, span := tracer.Start(ctx, r.Method, opts...)
+		defer span.End()
+		if sc := span.SpanContext(); sc.IsValid() {
+			w.Header().Set(TraceIDHeader, sc.TraceID().String())
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		// The route is only known once the request is routed.
+		route := chi.RouteContext(ctx).RoutePattern()
+		if route != "" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(code))
+		if code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(code))
+		}
+	})
+}
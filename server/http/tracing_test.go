@@ -0,0 +1,38 @@
+package http
+
+import (
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestClientCannotForceSampling sends a sampled traceparent, with a trace ID
+// that any ratio would sample, to a server that samples nothing.
+func TestClientCannotForceSampling(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(0))),
+		sdktrace.WithSpanProcessor(recorder),
+	))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	router := chi.NewRouter()
+	router.Use(traceRequest)
+	router.Get("/status/{task_id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	clientTraceID := "00000000000000000000000000000001"
+	req := httptest.NewRequest("GET", "/status/1", nil)
+	req.Header.Set("traceparent", "00-"+clientTraceID+"-0000000000000001-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Fatalf("the client forced %d spans to be recorded", len(spans))
+	}
+	if traceID := w.Header().Get(TraceIDHeader); traceID == clientTraceID {
+		t.Fatal("the server continued the trace of the client")
+	}
+}
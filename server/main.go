@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"hw/config"
+	"hw/health"
+	"hw/image_processor/processor"
+	"hw/imagecheck"
+	"hw/logging"
 	. "hw/messaging"
 	_ "hw/server/docs"
 	"hw/server/http"
 	. "hw/storage"
-	"log"
+	"hw/tracing"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // @title Task Management API
@@ -17,17 +28,166 @@ import (
 // @BasePath /
 // @schemes http
 func main() {
-	postgresConnString := os.Getenv("POSTGRES_CONN_STRING")
+	logging.Setup("server")
+	databaseURL := config.String("DATABASE_URL", os.Getenv("POSTGRES_CONN_STRING"))
 	redisAddr := os.Getenv("REDIS_ADDR")
-	jwtSecret := os.Getenv("JWT_SECRET")
+	jwtKeys := config.Pairs("JWT_KEYS")
+	if jwtSecret := os.Getenv("JWT_SECRET"); jwtSecret != "" {
+		jwtKeys["default"] = jwtSecret
+	}
+	accessTokenTTL := config.Duration("ACCESS_TOKEN_TTL", 5*time.Minute)
+	refreshTokenTTL := config.Duration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
 	rabbitMQAddr := os.Getenv("RABBITMQ_ADDR")
+	queueBackend := os.Getenv("QUEUE_BACKEND")
+	storageBackend := config.String("STORAGE_BACKEND", StorageDatabase)
 
 	addr := flag.String("addr", ":8000", "address for server")
-	s := NewDatabaseStorage(postgresConnString, redisAddr, jwtSecret)
-	b := NewProducerRMQ(rabbitMQAddr)
-	server := http.NewServer(s, b)
-	log.Printf("Starting server on %s", *addr)
-	if err := http.CreateAndRunServer(server, *addr); err != nil {
-		log.Fatalf("failed to start server: %v", err)
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "migrate":
+		runMigrate(databaseURL, flag.Args()[1:])
+		return
+	case "healthcheck":
+		if err := health.Probe(*addr); err != nil {
+			logging.Fatal("server is not ready", "error", err)
+		}
+		return
+	}
+	defer tracing.Setup(context.Background(), "server")()
+	passwordParams := DefaultPasswordParams
+	passwordParams.Memory = uint32(config.Int64("PASSWORD_ARGON2_MEMORY", int64(passwordParams.Memory)))
+	passwordParams.Iterations = uint32(config.Int64("PASSWORD_ARGON2_ITERATIONS", int64(passwordParams.Iterations)))
+	passwordParams.Parallelism = uint8(config.Int64("PASSWORD_ARGON2_PARALLELISM", int64(passwordParams.Parallelism)))
+
+	signer, err := NewTokenSigner(
+		jwtKeys,
+		config.String("JWT_ACTIVE_KEY", "default"),
+		config.String("JWT_ISSUER", "image-processor"),
+		config.String("JWT_AUDIENCE", "image-processor-api"),
+	)
+	if err != nil {
+		logging.Fatal("invalid JWT configuration", "error", err)
+	}
+
+	quota := Quota{
+		Period:    config.String("QUOTA_PERIOD", QuotaDaily),
+		MaxTasks:  config.Int64("QUOTA_MAX_TASKS", 0),
+		MaxPixels: int64(config.Float("QUOTA_MAX_MEGAPIXELS", 0) * 1e6),
+	}
+	if quota.Period != QuotaDaily && quota.Period != QuotaMonthly {
+		logging.Fatal("invalid QUOTA_PERIOD", "value", quota.Period, "expected", []string{QuotaDaily, QuotaMonthly})
+	}
+
+	if storageBackend == StorageDatabase && config.Bool("MIGRATE_ON_START", true) {
+		m := NewMigrator(databaseURL)
+		if err := m.Up(); err != nil {
+			logging.Fatal("migration failed", "error", err)
+		}
+		m.Close()
+	}
+
+	s := NewStorage(storageBackend, DatabaseConfig{
+		DatabaseURL:     databaseURL,
+		RedisAddr:       redisAddr,
+		TokenSigner:     signer,
+		PasswordParams:  passwordParams,
+		AccessTokenTTL:  accessTokenTTL,
+		RefreshTokenTTL: refreshTokenTTL,
+		CheckRevocation: config.Bool("TOKEN_REVOCATION_CHECK", true),
+		Quota:           quota,
+		LoginThrottle: LoginThrottle{
+			MaxAccountFailures: config.Int64("LOGIN_MAX_ACCOUNT_FAILURES", 5),
+			MaxIPFailures:      config.Int64("LOGIN_MAX_IP_FAILURES", 20),
+			Window:             config.Duration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+			Lockout:            config.Duration("LOGIN_LOCKOUT", 30*time.Second),
+			MaxLockout:         config.Duration("LOGIN_MAX_LOCKOUT", time.Hour),
+		},
+	})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if adminLogin := os.Getenv("ADMIN_LOGIN"); adminLogin != "" {
+		// The password docker-compose.yml used to default to is public.
+		adminPassword := os.Getenv("ADMIN_PASSWORD")
+		if adminPassword == "" || adminPassword == "insecure-development-password" {
+			logging.Fatal("ADMIN_PASSWORD must be set to a password of its own", "login", adminLogin)
+		}
+		if err := s.EnsureAdmin(ctx, adminLogin, adminPassword); err != nil {
+			logging.Fatal("failed to bootstrap admin", "login", adminLogin, "error", err)
+		}
+	}
+	janitor := Janitor{
+		Interval:    config.Duration("TASK_PURGE_INTERVAL", 10*time.Minute),
+		BatchSize:   int(config.Int64("TASK_PURGE_BATCH_SIZE", 500)),
+		DeleteAfter: config.Duration("TASK_DELETE_AFTER", 30*24*time.Hour),
+	}
+	if janitor.Interval > 0 && janitor.BatchSize > 0 {
+		go janitor.Run(ctx, s)
+	}
+	b := NewProducer(queueBackend, rabbitMQAddr, redisAddr)
+	checker := health.NewChecker(config.Duration("HEALTH_CHECK_TIMEOUT", 2*time.Second))
+	if storageBackend == StorageDatabase {
+		checker.Add("database", s.Ping)
+		if redisAddr != "" {
+			checker.Add("redis", s.PingRedis)
+		}
+	}
+	checker.Add("queue", b.Ping)
+	// Nothing outside the process can consume the memory queue, so the
+	// worker runs inside the server.
+	if config.Bool("EMBEDDED_WORKER", queueBackend == BackendMemory) {
+		c := NewConsumer(queueBackend, rabbitMQAddr, redisAddr)
+		go processor.Run(ctx, c, s, processor.ConfigFromEnv())
+	}
+	cfg := http.Config{
+		MaxRequestBytes: config.Int64("MAX_REQUEST_BYTES", 32<<20),
+		ImageLimits: imagecheck.Limits{
+			MaxPixels: config.Int64("MAX_IMAGE_PIXELS", 50_000_000),
+			MaxMemory: config.Int64("MAX_IMAGE_MEMORY", 1<<30),
+		},
+		TaskRateLimit: RateLimit{
+			Rate:  config.Float("TASK_RATE_LIMIT", 5),
+			Burst: int(config.Int64("TASK_RATE_BURST", 20)),
+		},
+		AuthRateLimit: RateLimit{
+			Rate:  config.Float("AUTH_RATE_LIMIT", 1),
+			Burst: int(config.Int64("AUTH_RATE_BURST", 20)),
+		},
+		PasswordLogin: config.Bool("PASSWORD_LOGIN", true),
+		RecentLogin:   config.Duration("RECENT_LOGIN", 5*time.Minute),
+		TaskRetention: Retention{
+			Default: config.Duration("TASK_RETENTION", 0),
+			ByRole:  config.Durations("TASK_RETENTION_BY_ROLE"),
+		},
+		Health: checker,
+	}
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		cfg.OIDC = newOIDC(http.OIDCConfig{
+			Issuer:        issuer,
+			ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+			Scopes:        strings.Fields(config.String("OIDC_SCOPES", "profile email")),
+			UsernameClaim: config.String("OIDC_USERNAME_CLAIM", "preferred_username"),
+		})
+	}
+	server := http.NewServer(s, b, cfg)
+	slog.Info("starting server", "addr", *addr)
+	if err := http.CreateAndRunServer(ctx, server, *addr); err != nil {
+		logging.Fatal("failed to start server", "error", err)
+	}
+}
+
+// newOIDC retries the provider discovery for a while, since the identity
+// provider may start after the server.
+func newOIDC(cfg http.OIDCConfig) *http.OIDC {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		var oidc *http.OIDC
+		if oidc, err = http.NewOIDC(context.Background(), cfg); err == nil {
+			return oidc
+		}
+		time.Sleep(time.Second)
 	}
+	logging.Fatal("failed to discover OIDC provider", "issuer", cfg.Issuer, "error", err)
+	return nil
 }
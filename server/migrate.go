@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"hw/logging"
+	. "hw/storage"
+	"os"
+	"strconv"
+)
+
+const migrateUsage = "usage: server migrate up | down [steps] | status"
+
+// runMigrate implements the migrate subcommand.
+func runMigrate(databaseURL string, args []string) {
+	if len(args) == 0 {
+		usage()
+	}
+	m := NewMigrator(databaseURL)
+	defer m.Close()
+
+	switch args[0] {
+	case "up":
+		if err := m.Up(); err != nil {
+			logging.Fatal("migration failed", "error", err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				usage()
+			}
+		}
+		if err := m.Down(steps); err != nil {
+			logging.Fatal("rollback failed", "error", err)
+		}
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			logging.Fatal("failed to read migration status", "error", err)
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d %-30s %s\n", status.Version, status.Name, applied)
+		}
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, migrateUsage)
+	os.Exit(2)
+}
@@ -1,6 +1,7 @@
 import requests
 import json
 import base64
+import os
 import sys
 import uuid
 import time
@@ -8,6 +9,11 @@ import time
 BASE_URL = "http://localhost:8000"
 
 def get_headers():
+    api_key = os.environ.get('API_KEY')
+    if api_key:
+        return {'Content-Type': 'application/json',
+                'Authorization': f'Bearer {api_key}'}
+
     username = f'user_{uuid.uuid4()}'
     password = 'password228'
     user_data = {'username': username, 'password': password}
@@ -4,52 +4,332 @@ import (
 	"context"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
+	"hw/logging"
 	. "hw/models"
-	"log"
+	"log/slog"
+	"time"
 )
 
 var _ Storage = &DatabaseStorage{}
 
 type Storage interface {
-	GetTask(id uuid.UUID) (Task, error)
-	AddTask(task *Task) error
-	UpdateTaskStatus(id uuid.UUID, status, result string)
+	GetTask(ctx context.Context, id uuid.UUID) (Task, error)
+	AddTask(ctx context.Context, task *Task) error
+	UpdateTaskStatus(ctx context.Context, id uuid.UUID, status, result string) error
+	StartTask(ctx context.Context, id uuid.UUID, maxStarted int) (bool, error)
+	CountUserTasks(ctx context.Context, userID uuid.UUID, status string) (int, error)
+	FindCachedResult(ctx context.Context, cacheKey string) (result string, found bool, err error)
+	ListTasks(ctx context.Context, status string, limit int) ([]Task, error)
+	FailTask(ctx context.Context, id uuid.UUID, reason string) error
+	PurgeExpiredTasks(ctx context.Context, limit int) (int, error)
+	DeleteExpiredTasks(ctx context.Context, expiredBefore time.Time, limit int) (int, error)
+	Ping(ctx context.Context) error
+	PingRedis(ctx context.Context) error
 
-	AddUser(user *User) error
-	Login(user *User) (string, error)
+	AddUser(ctx context.Context, user *User) error
+	Login(ctx context.Context, user *User, session *Session) (Tokens, error)
+	LoginOIDC(ctx context.Context, identity OIDCIdentity, session *Session) (Tokens, error)
+	LinkOIDC(ctx context.Context, userID uuid.UUID, identity OIDCIdentity) error
+	GetUser(ctx context.Context, id uuid.UUID) (User, error)
+	ListUsers(ctx context.Context) ([]User, error)
+	SetUserDisabled(ctx context.Context, id uuid.UUID, disabled bool) error
+	EnsureAdmin(ctx context.Context, login, password string) error
+	RenameUser(ctx context.Context, id uuid.UUID, login string) error
+	VerifyPassword(ctx context.Context, userID uuid.UUID, ip, password string) error
+	ChangePassword(ctx context.Context, userID, sessionID uuid.UUID, ip, currentPassword, newPassword string) error
+	DeleteAccount(ctx context.Context, userID uuid.UUID) error
 
-	GetUserBySession(token string) (uuid.UUID, error)
+	GetSession(ctx context.Context, token string) (Session, error)
+	RefreshSession(ctx context.Context, refreshToken string) (Tokens, error)
+	ListSessions(ctx context.Context, userID uuid.UUID) ([]Session, error)
+	DeleteSession(ctx context.Context, userID, sessionID uuid.UUID) error
+	DeleteUserSessions(ctx context.Context, userID uuid.UUID) error
+	DeleteOtherSessions(ctx context.Context, userID, keepSessionID uuid.UUID) error
+	SaveOIDCState(ctx context.Context, state string, login OIDCLoginState, ttl time.Duration) error
+	TakeOIDCState(ctx context.Context, state string) (OIDCLoginState, error)
+
+	AddAPIKey(ctx context.Context, key *APIKey) (string, error)
+	ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]APIKey, error)
+	UpdateAPIKey(ctx context.Context, key *APIKey) error
+	RevokeAPIKey(ctx context.Context, userID, keyID uuid.UUID) error
+	UseAPIKey(ctx context.Context, secret string) (APIKey, error)
+
+	Allow(ctx context.Context, key string, limit RateLimit) error
+	ConsumeQuota(ctx context.Context, userID uuid.UUID, pixels int64) error
+	RefundQuota(ctx context.Context, userID uuid.UUID, pixels int64) error
+	GetUsage(ctx context.Context, userID uuid.UUID) (Usage, error)
 }
 
+// DatabaseStorage combines the repositories into a Storage and implements
+// the operations that span several of them.
 type DatabaseStorage struct {
-	PostgresTaskRepository
-	PostgresUserRepository
-	RedisSessionRepository
+	TaskRepository
+	UserRepository
+	SessionRepository
+	APIKeyRepository
+	LimitRepository
+	// redis is nil when sessions and limits are kept in process memory.
+	redis *redis.Client
+}
+
+type DatabaseConfig struct {
+	// DatabaseURL is a Postgres connection string, or the path of an SQLite
+	// database prefixed with SQLiteScheme.
+	DatabaseURL string
+	// RedisAddr may be left empty to keep sessions and limits in process
+	// memory when a single server is run.
+	RedisAddr       string
+	TokenSigner     TokenSigner
+	PasswordParams  PasswordParams
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// CheckRevocation makes every request consult the Redis denylist so that
+	// logouts take effect before the access token expires.
+	CheckRevocation bool
+	Quota           Quota
+	LoginThrottle   LoginThrottle
+}
+
+const (
+	StorageDatabase = "database"
+	StorageMemory   = "memory"
+)
+
+// NewStorage creates the Storage for the given backend. An empty backend
+// name selects the database.
+func NewStorage(backend string, cfg DatabaseConfig) Storage {
+	switch backend {
+	case "", StorageDatabase:
+		return NewDatabaseStorage(cfg)
+	case StorageMemory:
+		return NewMemoryStorage(cfg)
+	}
+	logging.Fatal("unknown storage backend", "backend", backend)
+	return nil
 }
 
-func NewDatabaseStorage(connString, redisAddr, jwtSecret string) *DatabaseStorage {
-	taskRepo := NewPostgresTaskRepo(connString)
+// NewDatabaseStorage keeps users, tasks and API keys in the Postgres or
+// SQLite database named by cfg.DatabaseURL, and sessions and limits in Redis
+// or, without a Redis address, in process memory.
+func NewDatabaseStorage(cfg DatabaseConfig) *DatabaseStorage {
+	ds := &DatabaseStorage{}
+	if path, ok := sqlitePath(cfg.DatabaseURL); ok {
+		db := openSQLite(path)
+		ds.TaskRepository = tracedTaskRepository{SQLiteTaskRepository{db}}
+		ds.UserRepository = SQLiteUserRepository{db, cfg.PasswordParams}
+		ds.APIKeyRepository = SQLiteAPIKeyRepository{db}
+	} else {
+		taskRepo := NewPostgresTaskRepo(cfg.DatabaseURL)
+		ds.TaskRepository = tracedTaskRepository{taskRepo}
+		ds.UserRepository = PostgresUserRepository{taskRepo.pgPool, cfg.PasswordParams}
+		ds.APIKeyRepository = PostgresAPIKeyRepository{taskRepo.pgPool}
+	}
+
+	if cfg.RedisAddr == "" {
+		ds.SessionRepository = NewMemorySessionRepository(cfg.TokenSigner, cfg.AccessTokenTTL, cfg.RefreshTokenTTL, cfg.CheckRevocation)
+		ds.LimitRepository = NewMemoryLimitRepository(cfg.Quota, cfg.LoginThrottle)
+		return ds
+	}
 	rdb := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
+		Addr: cfg.RedisAddr,
 	})
 	_, err := rdb.Ping(context.Background()).Result()
 	if err != nil {
-		log.Fatalf("failed to connect to Redis: %v", err)
+		logging.Fatal("failed to connect to Redis", "error", err)
+	}
+	ds.SessionRepository = &RedisSessionRepository{
+		redisClient:     rdb,
+		signer:          cfg.TokenSigner,
+		accessTTL:       cfg.AccessTokenTTL,
+		refreshTTL:      cfg.RefreshTokenTTL,
+		checkRevocation: cfg.CheckRevocation,
+	}
+	ds.LimitRepository = &RedisLimitRepository{rdb, cfg.Quota, cfg.LoginThrottle}
+	ds.redis = rdb
+	return ds
+}
+
+// NewTaskRepository opens the task table of the Postgres or SQLite database
+// named by databaseURL.
+func NewTaskRepository(databaseURL string) TaskRepository {
+	if path, ok := sqlitePath(databaseURL); ok {
+		return tracedTaskRepository{NewSQLiteTaskRepo(path)}
+	}
+	return tracedTaskRepository{NewPostgresTaskRepo(databaseURL)}
+}
+
+// PingRedis checks the connection to Redis. It succeeds without Redis.
+func (ds *DatabaseStorage) PingRedis(ctx context.Context) error {
+	if ds.redis == nil {
+		return nil
+	}
+	return ds.redis.Ping(ctx).Err()
+}
+
+// AddUser stores a new user under the normalized login.
+func (ds *DatabaseStorage) AddUser(ctx context.Context, user *User) error {
+	login, err := NormalizeLogin(user.Login)
+	if err != nil {
+		return err
 	}
-	return &DatabaseStorage{
-		PostgresTaskRepository{taskRepo.pgPool},
-		PostgresUserRepository{taskRepo.pgPool},
-		RedisSessionRepository{
-			redisClient: rdb,
-			jwtSecret:   []byte(jwtSecret),
-		},
+	user.Login = login
+	return ds.UserRepository.AddUser(ctx, user)
+}
+
+func (ds *DatabaseStorage) RenameUser(ctx context.Context, id uuid.UUID, login string) error {
+	login, err := NormalizeLogin(login)
+	if err != nil {
+		return err
 	}
+	return ds.UserRepository.RenameUser(ctx, id, login)
 }
 
-func (ds *DatabaseStorage) Login(user *User) (string, error) {
-	err := ds.ValidateUser(user)
+func (ds *DatabaseStorage) EnsureAdmin(ctx context.Context, login, password string) error {
+	login, err := NormalizeLogin(login)
 	if err != nil {
-		return "", err
+		return err
+	}
+	return ds.UserRepository.EnsureAdmin(ctx, login, password)
+}
+
+// Login validates the credentials and opens a session described by the
+// client information in session. Failed attempts are counted per account
+// and per client address, which are locked out after too many of them.
+func (ds *DatabaseStorage) Login(ctx context.Context, user *User, session *Session) (Tokens, error) {
+	// Logins that are not valid any more are looked up as given, so that
+	// accounts created under older rules can still sign in.
+	if login, err := NormalizeLogin(user.Login); err == nil {
+		user.Login = login
+	}
+	if err := ds.CheckLogin(ctx, user.Login, session.IP); err != nil {
+		return Tokens{}, err
+	}
+	err := ds.ValidateUser(ctx, user)
+	if _, ok := err.(*InvalidCredentialsError); ok {
+		if err := ds.RecordLoginFailure(ctx, user.Login, session.IP); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, NewInvalidCredentialsError()
+	} else if err != nil {
+		return Tokens{}, err
+	}
+	if err := ds.RecordLoginSuccess(ctx, user.Login); err != nil {
+		return Tokens{}, err
+	}
+	session.UserID = user.ID
+	session.Role = user.Role
+	return ds.AddSession(ctx, session)
+}
+
+// oidcLoginAttempts is how many logins are tried for a new OIDC user before
+// giving up, the claimed one and then numbered variants of it.
+const oidcLoginAttempts = 5
+
+// LoginOIDC opens a session for a user authenticated by an OIDC provider,
+// creating the account on the first login unless it was linked before. A new
+// account whose claimed login is taken, by a local user or by a user of
+// another issuer, gets the login with a number appended instead, so that
+// registering the login of somebody else does not lock them out.
+func (ds *DatabaseStorage) LoginOIDC(ctx context.Context, identity OIDCIdentity, session *Session) (Tokens, error) {
+	login, err := proposeLogin(identity.Login)
+	if err != nil {
+		return Tokens{}, err
+	}
+	identity.Login = login
+	user, err := ds.GetOIDCUser(ctx, identity)
+	for attempt := 1; attempt < oidcLoginAttempts; attempt++ {
+		if _, ok := err.(*UserExistsError); !ok {
+			break
+		}
+		identity.Login = suffixLogin(login)
+		user, err = ds.GetOIDCUser(ctx, identity)
+	}
+	if err != nil {
+		return Tokens{}, err
+	} else if user.Disabled {
+		return Tokens{}, NewUserDisabledError()
+	}
+	session.UserID = user.ID
+	session.Role = user.Role
+	return ds.AddSession(ctx, session)
+}
+
+// LinkOIDC lets the signed in user sign in through the OIDC provider from
+// now on.
+func (ds *DatabaseStorage) LinkOIDC(ctx context.Context, userID uuid.UUID, identity OIDCIdentity) error {
+	if err := ds.LinkOIDCUser(ctx, userID, identity); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "linked user to OIDC subject", "user_id", userID, "subject", identity.Subject, "issuer", identity.Issuer)
+	return nil
+}
+
+// RefreshSession rotates the session tokens, picking up role changes and
+// refusing to refresh sessions of disabled users.
+func (ds *DatabaseStorage) RefreshSession(ctx context.Context, refreshToken string) (Tokens, error) {
+	return ds.SessionRepository.RefreshSession(ctx, refreshToken, func(session *Session) error {
+		user, err := ds.GetUser(ctx, session.UserID)
+		if _, ok := err.(*UserNotFoundError); ok {
+			return NewInvalidTokenError("invalid refresh token")
+		} else if err != nil {
+			return err
+		} else if user.Disabled {
+			return NewUserDisabledError()
+		}
+		session.Role = user.Role
+		return nil
+	})
+}
+
+// throttlePassword runs check, which verifies a password of the signed in
+// user, under the same lockout as Login. Wrong passwords count as failed
+// logins of the account, so that a stolen session cannot be used to guess
+// the password.
+func (ds *DatabaseStorage) throttlePassword(ctx context.Context, userID uuid.UUID, ip string, check func() error) error {
+	user, err := ds.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := ds.CheckLogin(ctx, user.Login, ip); err != nil {
+		return err
+	}
+	err = check()
+	if _, ok := err.(*InvalidCredentialsError); ok {
+		if err := ds.RecordLoginFailure(ctx, user.Login, ip); err != nil {
+			return err
+		}
+		return NewInvalidCredentialsError()
+	} else if err != nil {
+		return err
+	}
+	return ds.RecordLoginSuccess(ctx, user.Login)
+}
+
+// VerifyPassword checks the password of a signed in user before a sensitive
+// change. Accounts without a password get a NoPasswordError.
+func (ds *DatabaseStorage) VerifyPassword(ctx context.Context, userID uuid.UUID, ip, password string) error {
+	return ds.throttlePassword(ctx, userID, ip, func() error {
+		return ds.CheckPassword(ctx, userID, password)
+	})
+}
+
+// ChangePassword updates the password and revokes every session of the user
+// except the one making the change.
+func (ds *DatabaseStorage) ChangePassword(ctx context.Context, userID, sessionID uuid.UUID, ip, currentPassword, newPassword string) error {
+	err := ds.throttlePassword(ctx, userID, ip, func() error {
+		return ds.UpdatePassword(ctx, userID, currentPassword, newPassword)
+	})
+	if err != nil {
+		return err
+	}
+	return ds.DeleteOtherSessions(ctx, userID, sessionID)
+}
+
+// DeleteAccount removes the user and all their data and revokes their
+// sessions.
+func (ds *DatabaseStorage) DeleteAccount(ctx context.Context, userID uuid.UUID) error {
+	if err := ds.DeleteUser(ctx, userID); err != nil {
+		return err
 	}
-	return ds.AddSession(user.ID.String())
+	return ds.DeleteUserSessions(ctx, userID)
 }
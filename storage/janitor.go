@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Retention is how long tasks are kept after they are created. ByRole
+// overrides Default for the users of a role, which serve as plans. A zero
+// duration keeps tasks forever.
+type Retention struct {
+	Default time.Duration
+	ByRole  map[string]time.Duration
+}
+
+// ExpiresAt returns when a task created now by a user with the role expires,
+// or nil if it is kept forever.
+func (r Retention) ExpiresAt(role string, now time.Time) *time.Time {
+	retention, ok := r.ByRole[role]
+	if !ok {
+		retention = r.Default
+	}
+	if retention <= 0 {
+		return nil
+	}
+	expiresAt := now.Add(retention)
+	return &expiresAt
+}
+
+// Janitor purges expired tasks every Interval, at most BatchSize tasks per
+// statement so that no transaction locks many rows for long. Tasks expired for
+// longer than DeleteAfter are deleted altogether; a zero DeleteAfter keeps
+// them.
+type Janitor struct {
+	Interval    time.Duration
+	BatchSize   int
+	DeleteAfter time.Duration
+}
+
+// Run purges expired tasks until ctx is cancelled.
+func (j Janitor) Run(ctx context.Context, tasks TaskRepository) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		j.purge(ctx, tasks)
+		if j.DeleteAfter > 0 {
+			j.delete(ctx, tasks, time.Now().Add(-j.DeleteAfter))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j Janitor) purge(ctx context.Context, tasks TaskRepository) {
+	total := 0
+	for ctx.Err() == nil {
+		n, err := tasks.PurgeExpiredTasks(ctx, j.BatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "failed to purge expired tasks", "error", err)
+			}
+			break
+		}
+		total += n
+		if n < j.BatchSize {
+			break
+		}
+	}
+	if total > 0 {
+		slog.InfoContext(ctx, "purged expired tasks", "count", total)
+	}
+}
+
+func (j Janitor) delete(ctx context.Context, tasks TaskRepository, expiredBefore time.Time) {
+	total := 0
+	for ctx.Err() == nil {
+		n, err := tasks.DeleteExpiredTasks(ctx, expiredBefore, j.BatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "failed to delete expired tasks", "error", err)
+			}
+			break
+		}
+		total += n
+		if n < j.BatchSize {
+			break
+		}
+	}
+	if total > 0 {
+		slog.InfoContext(ctx, "deleted expired tasks", "count", total)
+	}
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	. "hw/models"
+	"time"
+)
+
+// TokenSigner issues and verifies HS256 access tokens. Keys are identified by
+// the kid header, so a new key can be made active while tokens signed with
+// the previous one stay valid until they expire.
+type TokenSigner struct {
+	keys        map[string][]byte
+	activeKeyID string
+	issuer      string
+	audience    string
+}
+
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+func NewTokenSigner(keys map[string]string, activeKeyID, issuer, audience string) (TokenSigner, error) {
+	signer := TokenSigner{
+		keys:        make(map[string][]byte, len(keys)),
+		activeKeyID: activeKeyID,
+		issuer:      issuer,
+		audience:    audience,
+	}
+	for kid, secret := range keys {
+		if secret == "" {
+			return TokenSigner{}, fmt.Errorf("empty signing key %q", kid)
+		}
+		signer.keys[kid] = []byte(secret)
+	}
+	if _, ok := signer.keys[activeKeyID]; !ok {
+		return TokenSigner{}, fmt.Errorf("active signing key %q is not configured", activeKeyID)
+	}
+	return signer, nil
+}
+
+func (s TokenSigner) Sign(claims AccessClaims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims.Issuer = s.issuer
+	claims.Audience = jwt.ClaimStrings{s.audience}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = s.activeKeyID
+	return token.SignedString(s.keys[s.activeKeyID])
+}
+
+// Verify checks the signature, expiry, issuer and audience of the token.
+// Tokens without an expiration time are rejected.
+func (s TokenSigner) Verify(tokenString string) (AccessClaims, error) {
+	var claims AccessClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := s.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(s.issuer),
+		jwt.WithAudience(s.audience),
+	)
+	if err != nil {
+		return AccessClaims{}, err
+	}
+	return claims, nil
+}
+
+// SignSession issues an access token for the session.
+func (s TokenSigner) SignSession(session *Session, ttl time.Duration) (string, error) {
+	claims := AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:      session.SessionID.String(),
+			Subject: session.UserID.String(),
+		},
+		UserID: session.UserID.String(),
+		Role:   session.Role,
+	}
+	return s.Sign(claims, ttl)
+}
+
+// VerifySession verifies an access token. Only the user and session ids and
+// the role are filled in.
+func (s TokenSigner) VerifySession(token string) (Session, error) {
+	claims, err := s.Verify(token)
+	if err != nil {
+		return Session{}, NewInvalidTokenError("invalid token")
+	}
+	sessionID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return Session{}, NewInvalidTokenError("invalid token")
+	}
+	userID, err := uuid.Parse(claims.UserID)
+	if err != nil {
+		return Session{}, NewInvalidTokenError("invalid token")
+	}
+	return Session{UserID: userID, SessionID: sessionID, Role: claims.Role}, nil
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"fmt"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"math/rand/v2"
+	"strings"
+	"unicode"
+)
+
+const (
+	MinLoginLength = 3
+	// MaxLoginLength is the length of users.login.
+	MaxLoginLength = 50
+)
+
+// loginPunctuation lists the characters other than letters and digits that
+// logins may contain.
+const loginPunctuation = "._-@"
+
+type InvalidLoginError struct {
+	Message string
+}
+
+func (e *InvalidLoginError) Error() string {
+	return e.Message
+}
+
+func NewInvalidLoginError(message string) error {
+	return &InvalidLoginError{message}
+}
+
+var loginFolder = cases.Fold()
+
+// NormalizeLogin returns the canonical form of a username, which is what is
+// stored and compared: Unicode NFC, case-folded. Logins consist of letters,
+// digits and the characters in loginPunctuation, and all their letters must
+// come from one script, so that for example a Cyrillic "а" cannot stand in
+// for a Latin "a".
+func NormalizeLogin(login string) (string, error) {
+	login = norm.NFC.String(loginFolder.String(norm.NFC.String(login)))
+
+	length := 0
+	var script *unicode.RangeTable
+	for _, r := range login {
+		length++
+		switch {
+		case unicode.IsDigit(r) || strings.ContainsRune(loginPunctuation, r):
+		case unicode.IsLetter(r) || unicode.Is(unicode.Mn, r):
+			if s := scriptOf(r); s != nil && s != unicode.Common && s != unicode.Inherited {
+				if script != nil && script != s {
+					return "", NewInvalidLoginError("Username mixes letters of different scripts")
+				}
+				script = s
+			}
+		default:
+			return "", NewInvalidLoginError(fmt.Sprintf("Username may only contain letters, digits and %q", loginPunctuation))
+		}
+	}
+	if length < MinLoginLength || length > MaxLoginLength {
+		return "", NewInvalidLoginError(fmt.Sprintf("Username must be %d to %d characters long", MinLoginLength, MaxLoginLength))
+	}
+	return login, nil
+}
+
+func scriptOf(r rune) *unicode.RangeTable {
+	for _, table := range unicode.Scripts {
+		if unicode.Is(table, r) {
+			return table
+		}
+	}
+	return nil
+}
+
+// proposeLogin makes a login out of a username claimed by an identity
+// provider, which does not have to follow the rules for logins, by replacing
+// the characters logins cannot contain and cutting it to length.
+func proposeLogin(claimed string) (string, error) {
+	claimed = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || strings.ContainsRune(loginPunctuation, r) {
+			return r
+		}
+		return '_'
+	}, norm.NFC.String(claimed))
+	if runes := []rune(claimed); len(runes) > MaxLoginLength {
+		claimed = string(runes[:MaxLoginLength])
+	}
+	return NormalizeLogin(claimed)
+}
+
+// suffixLogin appends a random number to a login proposed by proposeLogin,
+// cutting it so that it still fits. Digits belong to no script, so the
+// result is a valid login as well.
+func suffixLogin(login string) string {
+	suffix := fmt.Sprintf("-%06d", rand.IntN(1_000_000))
+	if runes := []rune(login); len(runes)+len(suffix) > MaxLoginLength {
+		login = string(runes[:MaxLoginLength-len(suffix)])
+	}
+	return login + suffix
+}
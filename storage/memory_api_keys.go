@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"github.com/google/uuid"
+	. "hw/models"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+var _ APIKeyRepository = MemoryAPIKeyRepository{}
+
+type memoryAPIKey struct {
+	APIKey
+	hash    string
+	revoked bool
+}
+
+type MemoryAPIKeyRepository struct {
+	db *memoryDB
+}
+
+func (k *memoryAPIKey) public() APIKey {
+	key := k.APIKey
+	key.Scopes = slices.Clone(k.Scopes)
+	return key
+}
+
+func (r MemoryAPIKeyRepository) AddAPIKey(ctx context.Context, key *APIKey) (string, error) {
+	secret, err := generateAPIKey()
+	if err != nil {
+		return "", err
+	}
+	key.ID = uuid.New()
+	key.CreatedAt = time.Now().UTC()
+
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	saved := &memoryAPIKey{APIKey: *key, hash: tokenDigest(secret)}
+	saved.Scopes = slices.Clone(key.Scopes)
+	r.db.apiKeys[key.ID] = saved
+	return secret, nil
+}
+
+func (r MemoryAPIKeyRepository) ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]APIKey, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+	keys := []APIKey{}
+	for _, key := range r.db.apiKeys {
+		if key.UserID == userID && !key.revoked {
+			keys = append(keys, key.public())
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (r MemoryAPIKeyRepository) UpdateAPIKey(ctx context.Context, key *APIKey) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	saved, ok := r.db.apiKeys[key.ID]
+	if !ok || saved.UserID != key.UserID || saved.revoked {
+		return NewAPIKeyNotFoundError()
+	}
+	saved.Name = key.Name
+	saved.Scopes = slices.Clone(key.Scopes)
+	key.CreatedAt = saved.CreatedAt
+	key.LastUsedAt = saved.LastUsedAt
+	return nil
+}
+
+func (r MemoryAPIKeyRepository) RevokeAPIKey(ctx context.Context, userID, keyID uuid.UUID) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	saved, ok := r.db.apiKeys[keyID]
+	if !ok || saved.UserID != userID || saved.revoked {
+		return NewAPIKeyNotFoundError()
+	}
+	saved.revoked = true
+	return nil
+}
+
+func (r MemoryAPIKeyRepository) UseAPIKey(ctx context.Context, secret string) (APIKey, error) {
+	if !strings.HasPrefix(secret, APIKeyPrefix) {
+		return APIKey{}, NewAPIKeyNotFoundError()
+	}
+	digest := tokenDigest(secret)
+
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	for _, saved := range r.db.apiKeys {
+		if saved.hash != digest || saved.revoked {
+			continue
+		}
+		user, ok := r.db.users[saved.UserID]
+		if !ok || user.Disabled {
+			break
+		}
+		if now := time.Now().UTC(); saved.LastUsedAt == nil || now.Sub(*saved.LastUsedAt) >= lastUsedResolution {
+			saved.LastUsedAt = &now
+		}
+		key := saved.public()
+		key.Role = user.Role
+		return key, nil
+	}
+	return APIKey{}, NewAPIKeyNotFoundError()
+}
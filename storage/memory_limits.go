@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	. "hw/models"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+var _ LimitRepository = &MemoryLimitRepository{}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type usage struct {
+	tasks, pixels int64
+}
+
+// MemoryLimitRepository implements the algorithms of RedisLimitRepository
+// with maps guarded by a mutex.
+type MemoryLimitRepository struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	usage     map[string]expiring[usage]
+	failures  map[string]expiring[int64]
+	locks     map[string]time.Time
+	lastPrune time.Time
+
+	quota    Quota
+	throttle LoginThrottle
+}
+
+func NewMemoryLimitRepository(quota Quota, throttle LoginThrottle) *MemoryLimitRepository {
+	return &MemoryLimitRepository{
+		buckets:  make(map[string]*bucket),
+		usage:    make(map[string]expiring[usage]),
+		failures: make(map[string]expiring[int64]),
+		locks:    make(map[string]time.Time),
+		quota:    quota,
+		throttle: throttle,
+	}
+}
+
+// prune drops expired entries. It must be called with the lock held.
+func (r *MemoryLimitRepository) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < pruneInterval {
+		return
+	}
+	r.lastPrune = now
+	for key, b := range r.buckets {
+		if now.Sub(b.updated) > time.Hour {
+			delete(r.buckets, key)
+		}
+	}
+	for key, u := range r.usage {
+		if u.expired(now) {
+			delete(r.usage, key)
+		}
+	}
+	for key, f := range r.failures {
+		if f.expired(now) {
+			delete(r.failures, key)
+		}
+	}
+	for key, expiresAt := range r.locks {
+		if !now.Before(expiresAt) {
+			delete(r.locks, key)
+		}
+	}
+}
+
+func (r *MemoryLimitRepository) Allow(ctx context.Context, key string, limit RateLimit) error {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(max(limit.Burst, 1))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.prune(now)
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		r.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return nil
+	}
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return NewRateLimitedError(wait)
+}
+
+func (r *MemoryLimitRepository) ConsumeQuota(ctx context.Context, userID uuid.UUID, pixels int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	start, end := quotaPeriod(r.quota.Period, now)
+	key := usageKey(userID, r.quota.Period, start)
+	used := r.usage[key].value
+	if r.usage[key].expired(now) {
+		used = usage{}
+	}
+	if r.quota.MaxTasks > 0 && used.tasks+1 > r.quota.MaxTasks {
+		return NewQuotaExceededError(fmt.Sprintf("Task quota of %d per %s exceeded", r.quota.MaxTasks, r.quota.Period), end.Sub(now))
+	}
+	if r.quota.MaxPixels > 0 && used.pixels+pixels > r.quota.MaxPixels {
+		return NewQuotaExceededError(fmt.Sprintf("Quota of %g megapixels per %s exceeded", megapixels(r.quota.MaxPixels), r.quota.Period), end.Sub(now))
+	}
+	r.usage[key] = expiring[usage]{usage{used.tasks + 1, used.pixels + pixels}, end}
+	return nil
+}
+
+func (r *MemoryLimitRepository) RefundQuota(ctx context.Context, userID uuid.UUID, pixels int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	start, _ := quotaPeriod(r.quota.Period, now)
+	key := usageKey(userID, r.quota.Period, start)
+	if used, ok := r.usage[key]; ok && !used.expired(now) {
+		r.usage[key] = expiring[usage]{usage{used.value.tasks - 1, used.value.pixels - pixels}, used.expiresAt}
+	}
+	return nil
+}
+
+func (r *MemoryLimitRepository) GetUsage(ctx context.Context, userID uuid.UUID) (Usage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	start, end := quotaPeriod(r.quota.Period, now)
+	used := r.usage[usageKey(userID, r.quota.Period, start)]
+	if used.expired(now) {
+		used.value = usage{}
+	}
+	return Usage{
+		Period:        r.quota.Period,
+		ResetsAt:      end,
+		Tasks:         used.value.tasks,
+		MaxTasks:      r.quota.MaxTasks,
+		Megapixels:    megapixels(used.value.pixels),
+		MaxMegapixels: megapixels(r.quota.MaxPixels),
+	}, nil
+}
+
+func (r *MemoryLimitRepository) CheckLogin(ctx context.Context, login, ip string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, key := range []string{loginLockKey("account", login), loginLockKey("ip", ip)} {
+		if expiresAt, ok := r.locks[key]; ok {
+			retryAfter = max(retryAfter, expiresAt.Sub(now))
+		}
+	}
+	if retryAfter > 0 {
+		return NewLoginLockedError(retryAfter)
+	}
+	return nil
+}
+
+func (r *MemoryLimitRepository) RecordLoginFailure(ctx context.Context, login, ip string) error {
+	limits := []struct {
+		kind, id string
+		max      int64
+	}{
+		{"account", login, r.throttle.MaxAccountFailures},
+		{"ip", ip, r.throttle.MaxIPFailures},
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.prune(now)
+	for _, limit := range limits {
+		if limit.max <= 0 || r.throttle.Lockout <= 0 {
+			continue
+		}
+		key := loginFailuresKey(limit.kind, limit.id)
+		failures := r.failures[key]
+		if failures.expired(now) {
+			failures = expiring[int64]{0, now.Add(r.throttle.Window)}
+		}
+		failures.value++
+		if failures.value >= limit.max {
+			lock := r.throttle.lockout(failures.value - limit.max)
+			r.locks[loginLockKey(limit.kind, limit.id)] = now.Add(lock)
+			failures.expiresAt = now.Add(lock + r.throttle.Window)
+			slog.WarnContext(ctx, "login locked", "kind", limit.kind, "id", limit.id, "lockout", lock, "failures", failures.value)
+		}
+		r.failures[key] = failures
+	}
+	return nil
+}
+
+func (r *MemoryLimitRepository) RecordLoginSuccess(ctx context.Context, login string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := loginFailuresKey("account", login)
+	failures, ok := r.failures[key]
+	delete(r.failures, key)
+	if ok && !failures.expired(time.Now()) && r.throttle.MaxAccountFailures > 0 && failures.value >= r.throttle.MaxAccountFailures {
+		slog.InfoContext(ctx, "login unlocked after a successful login", "account", login)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/google/uuid"
+	. "hw/models"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _ SessionRepository = &MemorySessionRepository{}
+
+type memorySession struct {
+	Session
+	refresh   string
+	expiresAt time.Time
+}
+
+// MemorySessionRepository keeps the same records as RedisSessionRepository
+// in maps, with the expiry times Redis would enforce.
+type MemorySessionRepository struct {
+	mu            sync.Mutex
+	sessions      map[uuid.UUID]*memorySession
+	refreshTokens map[string]expiring[uuid.UUID]
+	revoked       map[uuid.UUID]time.Time
+	oidcStates    map[string]expiring[OIDCLoginState]
+	lastPrune     time.Time
+
+	signer          TokenSigner
+	accessTTL       time.Duration
+	refreshTTL      time.Duration
+	checkRevocation bool
+}
+
+func NewMemorySessionRepository(signer TokenSigner, accessTTL, refreshTTL time.Duration, checkRevocation bool) *MemorySessionRepository {
+	return &MemorySessionRepository{
+		sessions:        make(map[uuid.UUID]*memorySession),
+		refreshTokens:   make(map[string]expiring[uuid.UUID]),
+		revoked:         make(map[uuid.UUID]time.Time),
+		oidcStates:      make(map[string]expiring[OIDCLoginState]),
+		signer:          signer,
+		accessTTL:       accessTTL,
+		refreshTTL:      refreshTTL,
+		checkRevocation: checkRevocation,
+	}
+}
+
+// prune drops expired entries. It must be called with the lock held.
+func (r *MemorySessionRepository) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < pruneInterval {
+		return
+	}
+	r.lastPrune = now
+	for id, session := range r.sessions {
+		if !now.Before(session.expiresAt) {
+			delete(r.sessions, id)
+		}
+	}
+	for digest, token := range r.refreshTokens {
+		if token.expired(now) {
+			delete(r.refreshTokens, digest)
+		}
+	}
+	for id, expiresAt := range r.revoked {
+		if !now.Before(expiresAt) {
+			delete(r.revoked, id)
+		}
+	}
+	for state, login := range r.oidcStates {
+		if login.expired(now) {
+			delete(r.oidcStates, state)
+		}
+	}
+}
+
+// session returns the session unless it expired. It must be called with the
+// lock held.
+func (r *MemorySessionRepository) session(id uuid.UUID, now time.Time) *memorySession {
+	session, ok := r.sessions[id]
+	if !ok || !now.Before(session.expiresAt) {
+		return nil
+	}
+	return session
+}
+
+// issueTokens must be called with the lock held.
+func (r *MemorySessionRepository) issueTokens(session *memorySession, now time.Time) (Tokens, error) {
+	accessToken, err := r.signer.SignSession(&session.Session, r.accessTTL)
+	if err != nil {
+		return Tokens{}, err
+	}
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	session.refresh = tokenDigest(refreshToken)
+	session.expiresAt = now.Add(r.refreshTTL)
+	r.refreshTokens[session.refresh] = expiring[uuid.UUID]{session.SessionID, session.expiresAt}
+	return Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(r.accessTTL.Seconds()),
+	}, nil
+}
+
+func (r *MemorySessionRepository) AddSession(ctx context.Context, session *Session) (Tokens, error) {
+	session.SessionID = uuid.New()
+	session.CreatedAt = time.Now().UTC()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.prune(now)
+	saved := &memorySession{Session: *session}
+	tokens, err := r.issueTokens(saved, now)
+	if err != nil {
+		return Tokens{}, err
+	}
+	r.sessions[session.SessionID] = saved
+	return tokens, nil
+}
+
+func (r *MemorySessionRepository) GetSession(ctx context.Context, jwtToken string) (Session, error) {
+	session, err := r.signer.VerifySession(jwtToken)
+	if err != nil {
+		return Session{}, err
+	}
+
+	if r.checkRevocation {
+		r.mu.Lock()
+		expiresAt, revoked := r.revoked[session.SessionID]
+		r.mu.Unlock()
+		if revoked && time.Now().Before(expiresAt) {
+			return Session{}, NewInvalidTokenError("token revoked")
+		}
+	}
+	return session, nil
+}
+
+func (r *MemorySessionRepository) RefreshSession(ctx context.Context, refreshToken string, authorize func(session *Session) error) (Tokens, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	digest := tokenDigest(refreshToken)
+	token, ok := r.refreshTokens[digest]
+	if !ok || token.expired(now) {
+		return Tokens{}, NewInvalidTokenError("invalid refresh token")
+	}
+	saved := r.session(token.value, now)
+	if saved == nil {
+		return Tokens{}, NewInvalidTokenError("invalid refresh token")
+	}
+	if subtle.ConstantTimeCompare([]byte(saved.refresh), []byte(digest)) != 1 {
+		slog.WarnContext(ctx, "refresh token reuse detected, revoking session", "session_id", saved.SessionID, "user_id", saved.UserID)
+		r.revoke(saved.SessionID, now)
+		return Tokens{}, NewInvalidTokenError("refresh token reused")
+	}
+
+	session := saved.Session
+	if err := authorize(&session); err != nil {
+		return Tokens{}, err
+	}
+	saved.Role = session.Role
+	return r.issueTokens(saved, now)
+}
+
+func (r *MemorySessionRepository) ListSessions(ctx context.Context, userID uuid.UUID) ([]Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	sessions := []Session{}
+	for id, saved := range r.sessions {
+		if saved.UserID == userID && r.session(id, now) != nil {
+			sessions = append(sessions, saved.Session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// revoke must be called with the lock held.
+func (r *MemorySessionRepository) revoke(sessionID uuid.UUID, now time.Time) {
+	delete(r.sessions, sessionID)
+	r.revoked[sessionID] = now.Add(r.accessTTL)
+}
+
+func (r *MemorySessionRepository) DeleteSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if session, ok := r.sessions[sessionID]; ok && session.UserID != userID {
+		return nil
+	}
+	r.revoke(sessionID, time.Now())
+	return nil
+}
+
+func (r *MemorySessionRepository) DeleteUserSessions(ctx context.Context, userID uuid.UUID) error {
+	return r.DeleteOtherSessions(ctx, userID, uuid.Nil)
+}
+
+func (r *MemorySessionRepository) DeleteOtherSessions(ctx context.Context, userID, keepSessionID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for id, session := range r.sessions {
+		if session.UserID == userID && id != keepSessionID {
+			r.revoke(id, now)
+		}
+	}
+	return nil
+}
+
+func (r *MemorySessionRepository) SaveOIDCState(ctx context.Context, state string, login OIDCLoginState, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.oidcStates[state] = expiring[OIDCLoginState]{login, time.Now().Add(ttl)}
+	return nil
+}
+
+func (r *MemorySessionRepository) TakeOIDCState(ctx context.Context, state string) (OIDCLoginState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	login, ok := r.oidcStates[state]
+	delete(r.oidcStates, state)
+	if !ok || login.expired(time.Now()) {
+		return OIDCLoginState{}, NewInvalidTokenError("invalid or expired login state")
+	}
+	return login.value, nil
+}
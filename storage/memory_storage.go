@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"github.com/google/uuid"
+	. "hw/models"
+	"sync"
+	"time"
+)
+
+// memoryDB holds the tables of the in-memory repositories. Like the Postgres
+// repositories sharing a pool, they share one memoryDB, so that deleting a
+// user also removes their tasks and API keys.
+type memoryDB struct {
+	mu      sync.RWMutex
+	users   map[uuid.UUID]*memoryUser
+	tasks   map[uuid.UUID]*Task
+	apiKeys map[uuid.UUID]*memoryAPIKey
+	// started holds the tasks taken by a worker.
+	started map[uuid.UUID]bool
+	// created holds when each task was added.
+	created map[uuid.UUID]time.Time
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		users:   make(map[uuid.UUID]*memoryUser),
+		tasks:   make(map[uuid.UUID]*Task),
+		apiKeys: make(map[uuid.UUID]*memoryAPIKey),
+		started: make(map[uuid.UUID]bool),
+		created: make(map[uuid.UUID]time.Time),
+	}
+}
+
+// expiring is a value that disappears at expiresAt, like a Redis key with a
+// TTL.
+type expiring[T any] struct {
+	value     T
+	expiresAt time.Time
+}
+
+func (e expiring[T]) expired(now time.Time) bool {
+	return !now.Before(e.expiresAt)
+}
+
+// pruneInterval is how often the in-memory repositories drop expired
+// entries. Expired entries are never returned, pruning only frees memory.
+const pruneInterval = time.Minute
+
+// NewMemoryStorage creates a Storage that keeps everything in process memory.
+// It is meant for tests and single-node deployments: nothing survives a
+// restart and several servers cannot share it. The connection settings of
+// cfg are ignored.
+func NewMemoryStorage(cfg DatabaseConfig) *DatabaseStorage {
+	db := newMemoryDB()
+	return &DatabaseStorage{
+		TaskRepository:    tracedTaskRepository{MemoryTaskRepository{db}},
+		UserRepository:    MemoryUserRepository{db, cfg.PasswordParams},
+		SessionRepository: NewMemorySessionRepository(cfg.TokenSigner, cfg.AccessTokenTTL, cfg.RefreshTokenTTL, cfg.CheckRevocation),
+		APIKeyRepository:  MemoryAPIKeyRepository{db},
+		LimitRepository:   NewMemoryLimitRepository(cfg.Quota, cfg.LoginThrottle),
+	}
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	. "hw/models"
+	"slices"
+	"time"
+)
+
+var _ TaskRepository = MemoryTaskRepository{}
+
+type MemoryTaskRepository struct {
+	db *memoryDB
+}
+
+func (r MemoryTaskRepository) GetTask(ctx context.Context, id uuid.UUID) (Task, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+	task, ok := r.db.tasks[id]
+	if !ok {
+		return Task{}, NewTaskNotFoundError()
+	}
+	return *task, nil
+}
+
+func (r MemoryTaskRepository) AddTask(ctx context.Context, task *Task) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if _, ok := r.db.users[task.UserID]; !ok {
+		return fmt.Errorf("failed to add task: user %s does not exist", task.UserID)
+	}
+	if _, ok := r.db.tasks[task.ID]; ok {
+		return fmt.Errorf("failed to add task: task %s already exists", task.ID)
+	}
+	saved := *task
+	if task.ExpiresAt != nil {
+		expiresAt := *task.ExpiresAt
+		saved.ExpiresAt = &expiresAt
+	}
+	r.db.tasks[task.ID] = &saved
+	r.db.created[task.ID] = time.Now()
+	return nil
+}
+
+func (r MemoryTaskRepository) UpdateTaskStatus(ctx context.Context, id uuid.UUID, status, result string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if task, ok := r.db.tasks[id]; ok && task.Status == "in_progress" {
+		task.Status = status
+		task.Result = result
+		delete(r.db.started, id)
+	}
+	return nil
+}
+
+func (r MemoryTaskRepository) StartTask(ctx context.Context, id uuid.UUID, maxStarted int) (bool, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	task, ok := r.db.tasks[id]
+	if !ok || task.Status != "in_progress" || r.db.started[id] {
+		return true, nil
+	}
+	if maxStarted > 0 {
+		count := 0
+		for startedID := range r.db.started {
+			if other, ok := r.db.tasks[startedID]; ok && other.UserID == task.UserID && other.Status == "in_progress" {
+				count++
+			}
+		}
+		if count >= maxStarted {
+			return false, nil
+		}
+	}
+	r.db.started[id] = true
+	return true, nil
+}
+
+func (r MemoryTaskRepository) CountUserTasks(ctx context.Context, userID uuid.UUID, status string) (int, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+	count := 0
+	for _, task := range r.db.tasks {
+		if task.UserID == userID && task.Status == status {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r MemoryTaskRepository) FindCachedResult(ctx context.Context, cacheKey string) (string, bool, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+	now := time.Now()
+	for _, task := range r.db.tasks {
+		if cacheKey != "" && task.CacheKey == cacheKey && task.Status == "ready" && !task.Expired(now) {
+			return task.Result, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (r MemoryTaskRepository) ListTasks(ctx context.Context, status string, limit int) ([]Task, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+	tasks := []Task{}
+	for _, task := range r.db.tasks {
+		if status == "" || task.Status == status {
+			tasks = append(tasks, Task{ID: task.ID, UserID: task.UserID, Priority: task.Priority, Status: task.Status})
+		}
+	}
+	// Newest first, as the database repositories list them.
+	slices.SortFunc(tasks, func(a, b Task) int {
+		if c := r.db.created[b.ID].Compare(r.db.created[a.ID]); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+	return tasks[:min(len(tasks), limit)], nil
+}
+
+func (r MemoryTaskRepository) FailTask(ctx context.Context, id uuid.UUID, reason string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	task, ok := r.db.tasks[id]
+	if !ok {
+		return NewTaskNotFoundError()
+	} else if task.Status != "in_progress" {
+		return NewTaskNotInProgressError()
+	}
+	task.Status = "failed"
+	task.Result = reason
+	delete(r.db.started, id)
+	return nil
+}
+
+// PurgeExpiredTasks drops the payload of purged tasks, so that they are not
+// purged again.
+func (r MemoryTaskRepository) PurgeExpiredTasks(ctx context.Context, limit int) (int, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	now := time.Now()
+	purged := 0
+	for _, task := range r.db.tasks {
+		if purged == limit {
+			break
+		}
+		if task.Expired(now) && task.Status != "in_progress" && task.Payload.Image != "" {
+			task.Payload = ImageProcessorPayload{}
+			task.CacheKey = ""
+			task.Result = ""
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (r MemoryTaskRepository) DeleteExpiredTasks(ctx context.Context, expiredBefore time.Time, limit int) (int, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	deleted := 0
+	for id, task := range r.db.tasks {
+		if deleted == limit {
+			break
+		}
+		if task.ExpiresAt != nil && task.ExpiresAt.Before(expiredBefore) && task.Status != "in_progress" {
+			delete(r.db.tasks, id)
+			delete(r.db.started, id)
+			delete(r.db.created, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (r MemoryTaskRepository) Ping(ctx context.Context) error {
+	return nil
+}
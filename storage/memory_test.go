@@ -0,0 +1,15 @@
+package storage_test
+
+import (
+	. "hw/storage"
+	"hw/storage/storagetest"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	cfg, err := storagetest.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.Run(t, NewStorage(StorageMemory, cfg))
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"context"
+	"github.com/google/uuid"
+	. "hw/models"
+	"log/slog"
+	"sort"
+)
+
+var _ UserRepository = MemoryUserRepository{}
+
+// memoryUser keeps the password hash in User.Password. It is empty for users
+// signing in only through OIDC.
+type memoryUser struct {
+	User
+	oidcIssuer  string
+	oidcSubject string
+}
+
+type MemoryUserRepository struct {
+	db             *memoryDB
+	passwordParams PasswordParams
+}
+
+func (u *memoryUser) public() User {
+	user := u.User
+	user.Password = ""
+	return user
+}
+
+// findOIDC must be called with the lock held.
+func (r MemoryUserRepository) findOIDC(identity OIDCIdentity) *memoryUser {
+	for _, user := range r.db.users {
+		if user.oidcIssuer == identity.Issuer && user.oidcSubject == identity.Subject {
+			return user
+		}
+	}
+	return nil
+}
+
+// findLogin must be called with the lock held.
+func (r MemoryUserRepository) findLogin(login string) *memoryUser {
+	for _, user := range r.db.users {
+		if user.Login == login {
+			return user
+		}
+	}
+	return nil
+}
+
+func (r MemoryUserRepository) AddUser(ctx context.Context, user *User) error {
+	hash, err := r.passwordParams.Hash(user.Password)
+	if err != nil {
+		return err
+	}
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if r.findLogin(user.Login) != nil {
+		return NewUserExistsError()
+	}
+	saved := memoryUser{User: *user}
+	saved.Password = hash
+	r.db.users[user.ID] = &saved
+	return nil
+}
+
+func (r MemoryUserRepository) ValidateUser(ctx context.Context, user *User) error {
+	r.db.mu.RLock()
+	var saved memoryUser
+	if found := r.findLogin(user.Login); found != nil {
+		saved = *found
+	}
+	r.db.mu.RUnlock()
+	if saved.Password == "" {
+		_, _ = r.passwordParams.Hash(user.Password)
+		return NewInvalidCredentialsError()
+	}
+
+	ok, needsRehash, err := r.passwordParams.Verify(user.Password, saved.Password)
+	if err != nil {
+		return err
+	} else if !ok {
+		return NewInvalidCredentialsError()
+	} else if saved.Disabled {
+		return NewUserDisabledError()
+	}
+	user.ID = saved.ID
+	user.Role = saved.Role
+
+	if needsRehash {
+		if hash, err := r.passwordParams.Hash(user.Password); err != nil {
+			slog.ErrorContext(ctx, "failed to rehash password", "user_id", user.ID, "error", err)
+		} else {
+			r.setPassword(user.ID, hash)
+		}
+	}
+	return nil
+}
+
+func (r MemoryUserRepository) setPassword(id uuid.UUID, hash string) bool {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	user, ok := r.db.users[id]
+	if ok {
+		user.Password = hash
+	}
+	return ok
+}
+
+func (r MemoryUserRepository) GetUser(ctx context.Context, id uuid.UUID) (User, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+	user, ok := r.db.users[id]
+	if !ok {
+		return User{}, NewUserNotFoundError()
+	}
+	return user.public(), nil
+}
+
+func (r MemoryUserRepository) ListUsers(ctx context.Context) ([]User, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+	users := make([]User, 0, len(r.db.users))
+	for _, user := range r.db.users {
+		users = append(users, user.public())
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Login < users[j].Login
+	})
+	return users, nil
+}
+
+func (r MemoryUserRepository) SetUserDisabled(ctx context.Context, id uuid.UUID, disabled bool) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	user, ok := r.db.users[id]
+	if !ok {
+		return NewUserNotFoundError()
+	}
+	user.Disabled = disabled
+	return nil
+}
+
+func (r MemoryUserRepository) EnsureAdmin(ctx context.Context, login, password string) error {
+	err := r.AddUser(ctx, &User{ID: uuid.New(), Login: login, Password: password, Role: RoleAdmin})
+	if _, ok := err.(*UserExistsError); !ok {
+		return err
+	}
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if user := r.findLogin(login); user == nil || user.Role != RoleAdmin {
+		return NewAdminLoginTakenError()
+	}
+	return nil
+}
+
+func (r MemoryUserRepository) RenameUser(ctx context.Context, id uuid.UUID, login string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if other := r.findLogin(login); other != nil && other.ID != id {
+		return NewUserExistsError()
+	}
+	user, ok := r.db.users[id]
+	if !ok {
+		return NewUserNotFoundError()
+	}
+	user.Login = login
+	return nil
+}
+
+func (r MemoryUserRepository) CheckPassword(ctx context.Context, id uuid.UUID, password string) error {
+	r.db.mu.RLock()
+	user, ok := r.db.users[id]
+	var saved string
+	if ok {
+		saved = user.Password
+	}
+	r.db.mu.RUnlock()
+	if !ok {
+		return NewUserNotFoundError()
+	} else if saved == "" {
+		return NewNoPasswordError()
+	}
+	ok, _, err := r.passwordParams.Verify(password, saved)
+	if err != nil {
+		return err
+	} else if !ok {
+		return NewInvalidCredentialsError()
+	}
+	return nil
+}
+
+func (r MemoryUserRepository) UpdatePassword(ctx context.Context, id uuid.UUID, currentPassword, newPassword string) error {
+	if err := r.CheckPassword(ctx, id, currentPassword); err != nil {
+		return err
+	}
+	hash, err := r.passwordParams.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	if !r.setPassword(id, hash) {
+		return NewUserNotFoundError()
+	}
+	return nil
+}
+
+func (r MemoryUserRepository) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if _, ok := r.db.users[id]; !ok {
+		return NewUserNotFoundError()
+	}
+	for taskID, task := range r.db.tasks {
+		if task.UserID == id {
+			delete(r.db.tasks, taskID)
+			delete(r.db.started, taskID)
+			delete(r.db.created, taskID)
+		}
+	}
+	for keyID, key := range r.db.apiKeys {
+		if key.UserID == id {
+			delete(r.db.apiKeys, keyID)
+		}
+	}
+	delete(r.db.users, id)
+	return nil
+}
+
+func (r MemoryUserRepository) GetOIDCUser(ctx context.Context, identity OIDCIdentity) (User, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if user := r.findOIDC(identity); user != nil {
+		return user.public(), nil
+	}
+	if r.findLogin(identity.Login) != nil {
+		return User{}, NewUserExistsError()
+	}
+	user := &memoryUser{
+		User:        User{ID: uuid.New(), Login: identity.Login, Role: RoleUser},
+		oidcIssuer:  identity.Issuer,
+		oidcSubject: identity.Subject,
+	}
+	r.db.users[user.ID] = user
+	return user.public(), nil
+}
+
+func (r MemoryUserRepository) LinkOIDCUser(ctx context.Context, id uuid.UUID, identity OIDCIdentity) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	user, ok := r.db.users[id]
+	if !ok {
+		return NewUserNotFoundError()
+	} else if user.oidcSubject != "" || r.findOIDC(identity) != nil {
+		return NewOIDCLinkedError()
+	}
+	user.oidcIssuer = identity.Issuer
+	user.oidcSubject = identity.Subject
+	return nil
+}
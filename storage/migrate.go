@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"hw/logging"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are stored as migrations/<database>/<version>_<name>.up.sql and
+// the matching .down.sql that reverts it. A migration without a .down.sql
+// cannot be reverted. Versions are applied in order, each in its own
+// transaction, and recorded in schema_migrations. Postgres and SQLite have
+// their own scripts with the same versions.
+//
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the advisory lock key held while migrating Postgres, so
+// that several instances starting at once do not apply the same migration.
+// SQLite databases are used by a single server, which needs no lock.
+const migrationLock = 7_402_911_350
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	// Down is empty if the migration cannot be reverted.
+	Down string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	postgres   bool
+	migrations []Migration
+}
+
+func loadMigrations(dir string) ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, dir+"/*.up.sql")
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]Migration, 0, len(files))
+	for _, file := range files {
+		base := strings.TrimSuffix(strings.TrimPrefix(file, dir+"/"), ".up.sql")
+		var migration Migration
+		version, name, ok := strings.Cut(base, "_")
+		// Versions are zero-padded, which Sscan would read as octal.
+		migration.Version, err = strconv.ParseInt(version, 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid migration file name %q", file)
+		}
+		migration.Name = name
+
+		up, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		down, err := migrationFiles.ReadFile(strings.TrimSuffix(file, ".up.sql") + ".down.sql")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		migration.Up, migration.Down = string(up), string(down)
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// NewMigrator creates a Migrator for the Postgres or SQLite database named by
+// connString.
+func NewMigrator(connString string) *Migrator {
+	driver, dsn, dir := "pgx", connString, "migrations/postgres"
+	if path, ok := sqlitePath(connString); ok {
+		driver, dsn, dir = "sqlite", sqliteDSN(path), "migrations/sqlite"
+	}
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		logging.Fatal("failed to load migrations", "error", err)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		logging.Fatal("unable to open database", "error", err)
+	}
+	return &Migrator{db, driver == "pgx", migrations}
+}
+
+func (m *Migrator) Close() {
+	m.db.Close()
+}
+
+// locked runs fn on a single connection holding the migration lock.
+func (m *Migrator) locked(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+	              version BIGINT PRIMARY KEY,
+	              name TEXT NOT NULL,
+	              applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	          )`
+	if m.postgres {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLock)
+
+		query = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		             version BIGINT PRIMARY KEY,
+		             name TEXT NOT NULL,
+		             applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		         )`
+	}
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	return fn(ctx, conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// apply runs the migration script and records the new schema version in one
+// transaction.
+func apply(ctx context.Context, conn *sql.Conn, script string, record func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Up applies all pending migrations.
+func (m *Migrator) Up() error {
+	return m.locked(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			err := apply(ctx, conn, migration.Up, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+					migration.Version, migration.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			slog.Info("applied migration", "version", migration.Version, "name", migration.Name)
+		}
+		return nil
+	})
+}
+
+// Down reverts the last steps applied migrations. It reverts none of them if
+// any of those cannot be reverted.
+func (m *Migrator) Down(steps int) error {
+	return m.locked(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		var reverted []Migration
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d %s cannot be reverted", migration.Version, migration.Name)
+			}
+			reverted = append(reverted, migration)
+		}
+		for _, migration := range reverted {
+			err := apply(ctx, conn, migration.Down, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version=$1`, migration.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			slog.Info("reverted migration", "version", migration.Version, "name", migration.Name)
+		}
+		return nil
+	})
+}
+
+// Status lists all migrations with the time they were applied, if they were.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.locked(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Migration: migration}
+			if appliedAt, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
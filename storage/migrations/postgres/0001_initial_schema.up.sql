@@ -0,0 +1,19 @@
+-- The schema of the original init.sql. Databases created from init.sql
+-- already have these tables, possibly with columns added by later versions of
+-- it, so they are only created when missing. The migrations that follow add
+-- every later change in a way that works on either kind of database.
+CREATE TABLE IF NOT EXISTS users (
+    user_id  UUID PRIMARY KEY,
+    login    VARCHAR(50) UNIQUE NOT NULL,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS tasks (
+    task_id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(user_id),
+    payload JSONB NOT NULL,
+    status  VARCHAR(50) NOT NULL,
+    result  TEXT DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_login ON users(login);
@@ -0,0 +1,2 @@
+-- Hashing cannot be undone. The hashes keep working after a rollback.
+SELECT 1;
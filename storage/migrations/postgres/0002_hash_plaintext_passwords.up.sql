@@ -0,0 +1,8 @@
+-- Hashes passwords stored in plain text before password hashing was introduced.
+-- The server accepts the resulting bcrypt hashes and upgrades them to argon2id
+-- on the next successful login of each user.
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+UPDATE users
+SET password = crypt(password, gen_salt('bf', 10))
+WHERE password NOT LIKE '$%';
@@ -0,0 +1,17 @@
+-- Logins are stored case-folded and in Unicode NFC. Existing logins are
+-- converted unless another account already uses the converted form, or an
+-- earlier account converts to it. Those accounts keep their login and have to
+-- be renamed by hand.
+WITH normalized AS (
+    SELECT user_id,
+           lower(normalize(login, NFC)) AS login,
+           row_number() OVER (
+               PARTITION BY lower(normalize(login, NFC))
+               ORDER BY login = lower(normalize(login, NFC)) DESC, user_id
+           ) AS rank
+    FROM users
+)
+UPDATE users u
+SET login = n.login
+FROM normalized n
+WHERE u.user_id = n.user_id AND n.rank = 1 AND u.login <> n.login;
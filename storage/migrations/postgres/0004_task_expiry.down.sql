@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_tasks_expires_at;
+ALTER TABLE tasks DROP COLUMN IF EXISTS expires_at;
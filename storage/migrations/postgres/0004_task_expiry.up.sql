@@ -0,0 +1,6 @@
+-- Tasks expire when their owner's retention runs out. Existing tasks have no
+-- expiry and are kept. Purged tasks keep their row with a NULL result, so the
+-- index only covers tasks that still hold a result.
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ DEFAULT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_expires_at ON tasks(expires_at) WHERE result IS NOT NULL;
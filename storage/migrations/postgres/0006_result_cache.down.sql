@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_tasks_cache_key;
+ALTER TABLE tasks DROP COLUMN IF EXISTS cache_key;
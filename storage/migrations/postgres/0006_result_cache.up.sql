@@ -0,0 +1,3 @@
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS cache_key CHAR(64) DEFAULT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_cache_key ON tasks(cache_key) WHERE status = 'ready';
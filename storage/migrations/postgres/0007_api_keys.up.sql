@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+    key_id       UUID PRIMARY KEY,
+    user_id      UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    name         VARCHAR(100) NOT NULL,
+    scopes       TEXT[] NOT NULL,
+    key_hash     CHAR(64) UNIQUE NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ DEFAULT NULL,
+    revoked_at   TIMESTAMPTZ DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_user ON api_keys(user_id);
@@ -0,0 +1,6 @@
+-- Fails while users without a password exist, which cannot sign in without
+-- OIDC anyway.
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_oidc_issuer_oidc_subject_key;
+ALTER TABLE users DROP COLUMN IF EXISTS oidc_subject;
+ALTER TABLE users DROP COLUMN IF EXISTS oidc_issuer;
+ALTER TABLE users ALTER COLUMN password SET NOT NULL;
@@ -0,0 +1,13 @@
+-- Users signing in through an OIDC provider have no password.
+ALTER TABLE users ALTER COLUMN password DROP NOT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_issuer TEXT DEFAULT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject TEXT DEFAULT NULL;
+
+-- Postgres has no ADD CONSTRAINT IF NOT EXISTS.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint
+                   WHERE conrelid = 'users'::regclass AND conname = 'users_oidc_issuer_oidc_subject_key') THEN
+        ALTER TABLE users ADD CONSTRAINT users_oidc_issuer_oidc_subject_key UNIQUE (oidc_issuer, oidc_subject);
+    END IF;
+END $$;
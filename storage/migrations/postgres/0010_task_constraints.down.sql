@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS idx_users_login ON users(login);
+ALTER TABLE tasks DROP CONSTRAINT IF EXISTS tasks_status_check;
+ALTER TABLE tasks DROP CONSTRAINT IF EXISTS tasks_priority_check;
@@ -0,0 +1,14 @@
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint
+                   WHERE conrelid = 'tasks'::regclass AND conname = 'tasks_priority_check') THEN
+        ALTER TABLE tasks ADD CONSTRAINT tasks_priority_check CHECK (priority BETWEEN 0 AND 9);
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint
+                   WHERE conrelid = 'tasks'::regclass AND conname = 'tasks_status_check') THEN
+        ALTER TABLE tasks ADD CONSTRAINT tasks_status_check CHECK (status IN ('in_progress', 'ready', 'failed'));
+    END IF;
+END $$;
+
+-- The unique constraint on users.login already provides its index.
+DROP INDEX IF EXISTS idx_users_login;
@@ -0,0 +1,10 @@
+-- hash_plaintext_passwords skipped plaintext passwords starting with '$'.
+-- Every password that is not a well-formed argon2id or bcrypt hash is hashed
+-- now, as the server no longer accepts plaintext.
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+UPDATE users
+SET password = crypt(password, gen_salt('bf', 10))
+WHERE password IS NOT NULL
+  AND password !~ '^\$argon2id\$v=[0-9]+\$m=[0-9]+,t=[0-9]+,p=[0-9]+\$[A-Za-z0-9+/]+\$[A-Za-z0-9+/]+$'
+  AND password !~ '^\$2[aby]\$[0-9]{2}\$[./A-Za-z0-9]{53}$';
@@ -0,0 +1,6 @@
+-- Tasks are listed newest first. Tasks created before this migration have no
+-- creation time and are listed after all others.
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ DEFAULT NULL;
+ALTER TABLE tasks ALTER COLUMN created_at SET DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS idx_tasks_created_at ON tasks(created_at DESC NULLS LAST, task_id);
@@ -0,0 +1,43 @@
+-- Mirrors the Postgres schema. UUIDs and timestamps are stored as text and
+-- API key scopes as a JSON array.
+--
+-- No SQLite database predates versions 5 to 10, so their changes are made
+-- here and those migrations are empty. They have no down migration, since
+-- reverting them would leave the schema as it is: `migrate down` stops at
+-- version 10.
+CREATE TABLE users (
+    user_id      TEXT PRIMARY KEY,
+    login        VARCHAR(50) NOT NULL,
+    password     TEXT DEFAULT NULL,
+    role         VARCHAR(20) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'admin', 'auditor')),
+    disabled     BOOLEAN NOT NULL DEFAULT false,
+    oidc_issuer  TEXT DEFAULT NULL,
+    oidc_subject TEXT DEFAULT NULL,
+    CONSTRAINT users_login_key UNIQUE (login),
+    CONSTRAINT users_oidc_issuer_oidc_subject_key UNIQUE (oidc_issuer, oidc_subject)
+);
+
+CREATE TABLE tasks (
+    task_id   TEXT PRIMARY KEY,
+    user_id   TEXT NOT NULL REFERENCES users(user_id),
+    payload   TEXT NOT NULL,
+    priority  SMALLINT NOT NULL DEFAULT 0 CHECK (priority BETWEEN 0 AND 9),
+    cache_key CHAR(64) DEFAULT NULL,
+    status    VARCHAR(50) NOT NULL CHECK (status IN ('in_progress', 'ready', 'failed')),
+    result    TEXT DEFAULT NULL
+);
+
+CREATE TABLE api_keys (
+    key_id       TEXT PRIMARY KEY,
+    user_id      TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    name         VARCHAR(100) NOT NULL,
+    scopes       TEXT NOT NULL,
+    key_hash     CHAR(64) UNIQUE NOT NULL,
+    created_at   TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP DEFAULT NULL,
+    revoked_at   TIMESTAMP DEFAULT NULL
+);
+
+CREATE INDEX idx_tasks_user_status ON tasks(user_id, status);
+CREATE INDEX idx_tasks_cache_key ON tasks(cache_key) WHERE status = 'ready';
+CREATE INDEX idx_api_keys_user ON api_keys(user_id);
@@ -0,0 +1,3 @@
+-- The original spelling of the logins is lost. Normalized logins keep working
+-- after a rollback.
+SELECT 1;
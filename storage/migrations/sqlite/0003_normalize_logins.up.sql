@@ -0,0 +1,17 @@
+-- Logins are stored case-folded. Existing logins are converted unless another
+-- account already uses the converted form, or an earlier account converts to
+-- it; those accounts have to be renamed by hand. SQLite only folds ASCII
+-- letters, so logins with other capital letters have to be renamed as well.
+WITH normalized AS (
+    SELECT user_id,
+           lower(login) AS login,
+           row_number() OVER (
+               PARTITION BY lower(login)
+               ORDER BY login = lower(login) DESC, user_id
+           ) AS rank
+    FROM users
+)
+UPDATE users
+SET login = n.login
+FROM normalized n
+WHERE users.user_id = n.user_id AND n.rank = 1 AND users.login <> n.login;
@@ -0,0 +1,2 @@
+-- Included in 0001_initial_schema.
+SELECT 1;
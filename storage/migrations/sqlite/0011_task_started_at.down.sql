@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_tasks_user_started;
+ALTER TABLE tasks DROP COLUMN started_at;
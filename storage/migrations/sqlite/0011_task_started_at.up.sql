@@ -0,0 +1,6 @@
+-- Tasks are marked started when a worker takes them, so that the tasks each
+-- user has being processed can be counted and capped. Tasks queued before
+-- this migration are counted from when they are taken.
+ALTER TABLE tasks ADD COLUMN started_at TIMESTAMP DEFAULT NULL;
+
+CREATE INDEX idx_tasks_user_started ON tasks(user_id) WHERE status = 'in_progress' AND started_at IS NOT NULL;
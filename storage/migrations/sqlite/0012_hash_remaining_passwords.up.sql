@@ -0,0 +1,2 @@
+-- SQLite databases never held plaintext passwords.
+SELECT 1;
@@ -0,0 +1,3 @@
+-- Expired tasks are deleted a while after their results are purged, which the
+-- index of 0004 does not cover, as it only holds tasks that have a result.
+CREATE INDEX IF NOT EXISTS idx_tasks_expired ON tasks(expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,6 @@
+-- Tasks are listed newest first. Tasks created before this migration have no
+-- creation time and are listed after all others. SQLite cannot add a column
+-- defaulting to the current time, so it is set when a task is added.
+ALTER TABLE tasks ADD COLUMN created_at TIMESTAMP DEFAULT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_created_at ON tasks(created_at DESC, task_id);
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	. "hw/models"
+	"strings"
+	"time"
+)
+
+var _ APIKeyRepository = PostgresAPIKeyRepository{}
+
+// APIKeyPrefix starts every API key so it can be told apart from a JWT.
+const APIKeyPrefix = "ipk_"
+
+// lastUsedResolution is how stale the recorded time of last use of a key may
+// get. Keys used by busy clients would otherwise write a row on every
+// request.
+const lastUsedResolution = time.Minute
+
+type APIKeyRepository interface {
+	AddAPIKey(ctx context.Context, key *APIKey) (string, error)
+	ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]APIKey, error)
+	UpdateAPIKey(ctx context.Context, key *APIKey) error
+	RevokeAPIKey(ctx context.Context, userID, keyID uuid.UUID) error
+	UseAPIKey(ctx context.Context, secret string) (APIKey, error)
+}
+
+// PostgresAPIKeyRepository stores only SHA-256 digests of the keys. Keys are
+// 256-bit random values, so a fast hash is enough to make a leaked table
+// useless.
+type PostgresAPIKeyRepository struct {
+	pgPool *pgxpool.Pool
+}
+
+type APIKeyNotFoundError struct{}
+
+func (e *APIKeyNotFoundError) Error() string {
+	return "API key not found"
+}
+
+func NewAPIKeyNotFoundError() error {
+	return &APIKeyNotFoundError{}
+}
+
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// AddAPIKey stores a new key and returns its secret, which is never
+// available again.
+func (r PostgresAPIKeyRepository) AddAPIKey(ctx context.Context, key *APIKey) (string, error) {
+	secret, err := generateAPIKey()
+	if err != nil {
+		return "", err
+	}
+	key.ID = uuid.New()
+	query := `INSERT INTO api_keys (key_id, user_id, name, scopes, key_hash) VALUES ($1, $2, $3, $4, $5) RETURNING created_at`
+	err = r.pgPool.QueryRow(ctx, query, key.ID, key.UserID, key.Name, key.Scopes, tokenDigest(secret)).
+		Scan(&key.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (r PostgresAPIKeyRepository) ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]APIKey, error) {
+	query := `SELECT key_id, user_id, name, scopes, created_at, last_used_at FROM api_keys
+		WHERE user_id=$1 AND revoked_at IS NULL ORDER BY created_at`
+	rows, err := r.pgPool.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Scopes, &key.CreatedAt, &key.LastUsedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (r PostgresAPIKeyRepository) UpdateAPIKey(ctx context.Context, key *APIKey) error {
+	query := `UPDATE api_keys SET name=$1, scopes=$2 WHERE key_id=$3 AND user_id=$4 AND revoked_at IS NULL
+		RETURNING created_at, last_used_at`
+	err := r.pgPool.QueryRow(ctx, query, key.Name, key.Scopes, key.ID, key.UserID).
+		Scan(&key.CreatedAt, &key.LastUsedAt)
+	if err == pgx.ErrNoRows {
+		return NewAPIKeyNotFoundError()
+	}
+	return err
+}
+
+func (r PostgresAPIKeyRepository) RevokeAPIKey(ctx context.Context, userID, keyID uuid.UUID) error {
+	query := `UPDATE api_keys SET revoked_at=now() WHERE key_id=$1 AND user_id=$2 AND revoked_at IS NULL`
+	tag, err := r.pgPool.Exec(ctx, query, keyID, userID)
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return NewAPIKeyNotFoundError()
+	}
+	return nil
+}
+
+// UseAPIKey looks up an active key of an enabled user by its secret and
+// records the time of use, unless it was recorded less than
+// lastUsedResolution ago.
+func (r PostgresAPIKeyRepository) UseAPIKey(ctx context.Context, secret string) (APIKey, error) {
+	if !strings.HasPrefix(secret, APIKeyPrefix) {
+		return APIKey{}, NewAPIKeyNotFoundError()
+	}
+	var key APIKey
+	query := `SELECT k.key_id, k.user_id, k.name, k.scopes, k.created_at, k.last_used_at, u.role
+		FROM api_keys k JOIN users u ON u.user_id=k.user_id
+		WHERE k.key_hash=$1 AND k.revoked_at IS NULL AND NOT u.disabled`
+	err := r.pgPool.QueryRow(ctx, query, tokenDigest(secret)).
+		Scan(&key.ID, &key.UserID, &key.Name, &key.Scopes, &key.CreatedAt, &key.LastUsedAt, &key.Role)
+	if err == pgx.ErrNoRows {
+		return APIKey{}, NewAPIKeyNotFoundError()
+	} else if err != nil {
+		return APIKey{}, err
+	}
+	if key.LastUsedAt != nil && time.Since(*key.LastUsedAt) < lastUsedResolution {
+		return key, nil
+	}
+	query = `UPDATE api_keys SET last_used_at=now()
+		WHERE key_id=$1 AND (last_used_at IS NULL OR last_used_at < now() - $2::interval)
+		RETURNING last_used_at`
+	err = r.pgPool.QueryRow(ctx, query, key.ID, lastUsedResolution).Scan(&key.LastUsedAt)
+	if err == pgx.ErrNoRows {
+		// Another request recorded the use in the meantime.
+		return key, nil
+	}
+	return key, err
+}
@@ -7,17 +7,31 @@ import (
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"hw/logging"
 	. "hw/models"
-	"log"
-	"os"
+	"time"
 )
 
 var _ TaskRepository = PostgresTaskRepository{}
 
 type TaskRepository interface {
-	GetTask(id uuid.UUID) (Task, error)
-	AddTask(task *Task) error
-	UpdateTaskStatus(id uuid.UUID, status, result string)
+	GetTask(ctx context.Context, id uuid.UUID) (Task, error)
+	AddTask(ctx context.Context, task *Task) error
+	UpdateTaskStatus(ctx context.Context, id uuid.UUID, status, result string) error
+	// StartTask marks the task as taken by a worker. It reports false,
+	// leaving the task alone, when the owner already has maxStarted tasks
+	// taken and not finished; maxStarted <= 0 sets no limit. Tasks that were
+	// started before, have finished or do not exist are reported as started,
+	// so that redelivered messages are not held back.
+	StartTask(ctx context.Context, id uuid.UUID, maxStarted int) (bool, error)
+	CountUserTasks(ctx context.Context, userID uuid.UUID, status string) (int, error)
+	FindCachedResult(ctx context.Context, cacheKey string) (result string, found bool, err error)
+	ListTasks(ctx context.Context, status string, limit int) ([]Task, error)
+	FailTask(ctx context.Context, id uuid.UUID, reason string) error
+	PurgeExpiredTasks(ctx context.Context, limit int) (int, error)
+	DeleteExpiredTasks(ctx context.Context, expiredBefore time.Time, limit int) (int, error)
+	// Ping checks the connection to the database.
+	Ping(ctx context.Context) error
 }
 
 type PostgresTaskRepository struct {
@@ -34,41 +48,178 @@ func NewTaskNotFoundError() error {
 	return &TaskNotFoundError{}
 }
 
+type TaskNotInProgressError struct{}
+
+func (e *TaskNotInProgressError) Error() string {
+	return "Task is not in progress"
+}
+
+func NewTaskNotInProgressError() error {
+	return &TaskNotInProgressError{}
+}
+
 func NewPostgresTaskRepo(connString string) PostgresTaskRepository {
-	pool, err := pgxpool.New(context.Background(), connString)
+	config, err := pgxpool.ParseConfig(connString)
 	if err != nil {
-		log.Fatalf("Unable to create connection pool: %v", err)
+		logging.Fatal("invalid Postgres connection string", "error", err)
+	}
+	config.ConnConfig.Tracer = pgxTracer{}
+	pool, err := pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		logging.Fatal("unable to create connection pool", "error", err)
 	}
 	return PostgresTaskRepository{pool}
 }
 
-func (r PostgresTaskRepository) GetTask(id uuid.UUID) (Task, error) {
+func (r PostgresTaskRepository) GetTask(ctx context.Context, id uuid.UUID) (Task, error) {
 	var task Task
-	query := `SELECT task_id, user_id, status, result FROM tasks WHERE task_id=$1`
-	err := r.pgPool.QueryRow(context.Background(), query, id).Scan(&task.ID, &task.UserID, &task.Status, &task.Result)
+	query := `SELECT task_id, user_id, status, COALESCE(result, ''), expires_at FROM tasks WHERE task_id=$1`
+	err := r.pgPool.QueryRow(ctx, query, id).Scan(&task.ID, &task.UserID, &task.Status, &task.Result, &task.ExpiresAt)
 	if err == pgx.ErrNoRows {
 		return Task{}, NewTaskNotFoundError()
 	}
 	return task, err
 }
 
-func (r PostgresTaskRepository) AddTask(task *Task) error {
+func (r PostgresTaskRepository) AddTask(ctx context.Context, task *Task) error {
 	payloadData, err := json.Marshal(task.Payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
-	query := `INSERT INTO tasks (task_id, user_id, payload, status, result) VALUES ($1, $2, $3, $4, $5)`
-	_, err = r.pgPool.Exec(context.Background(), query, task.ID, task.UserID, payloadData, task.Status, task.Result)
+	var cacheKey *string
+	if task.CacheKey != "" {
+		cacheKey = &task.CacheKey
+	}
+	query := `INSERT INTO tasks (task_id, user_id, payload, priority, cache_key, status, result, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err = r.pgPool.Exec(ctx, query, task.ID, task.UserID, payloadData, task.Priority, cacheKey, task.Status, task.Result, task.ExpiresAt)
 	if err != nil {
 		return fmt.Errorf("failed to add task: %w", err)
 	}
 	return nil
 }
 
-func (r PostgresTaskRepository) UpdateTaskStatus(id uuid.UUID, status, result string) {
-	query := `UPDATE tasks SET status=$1, result=$2 WHERE task_id=$3`
-	_, err := r.pgPool.Exec(context.Background(), query, status, result, id)
+// UpdateTaskStatus records the outcome of processing. Tasks that were
+// force-failed in the meantime keep their status.
+func (r PostgresTaskRepository) UpdateTaskStatus(ctx context.Context, id uuid.UUID, status, result string) error {
+	query := `UPDATE tasks SET status=$1, result=$2 WHERE task_id=$3 AND status='in_progress'`
+	_, err := r.pgPool.Exec(ctx, query, status, result, id)
+	return err
+}
+
+// StartTask locks the owner of the task, so that workers starting tasks of the
+// same user at once cannot exceed maxStarted together.
+func (r PostgresTaskRepository) StartTask(ctx context.Context, id uuid.UUID, maxStarted int) (bool, error) {
+	tx, err := r.pgPool.Begin(ctx)
 	if err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, "error updating task:", err)
+		return false, err
 	}
+	defer tx.Rollback(ctx)
+
+	var userID uuid.UUID
+	var started bool
+	query := `SELECT user_id, status<>'in_progress' OR started_at IS NOT NULL FROM tasks WHERE task_id=$1`
+	err = tx.QueryRow(ctx, query, id).Scan(&userID, &started)
+	if err == pgx.ErrNoRows || started {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if maxStarted > 0 {
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM users WHERE user_id=$1 FOR UPDATE`, userID); err != nil {
+			return false, err
+		}
+		var count int
+		query = `SELECT COUNT(*) FROM tasks WHERE user_id=$1 AND status='in_progress' AND started_at IS NOT NULL`
+		if err := tx.QueryRow(ctx, query, userID).Scan(&count); err != nil {
+			return false, err
+		}
+		if count >= maxStarted {
+			return false, nil
+		}
+	}
+	if _, err := tx.Exec(ctx, `UPDATE tasks SET started_at=$1 WHERE task_id=$2`, time.Now().UTC(), id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+func (r PostgresTaskRepository) CountUserTasks(ctx context.Context, userID uuid.UUID, status string) (count int, err error) {
+	query := `SELECT COUNT(*) FROM tasks WHERE user_id=$1 AND status=$2`
+	err = r.pgPool.QueryRow(ctx, query, userID, status).Scan(&count)
+	return
+}
+
+func (r PostgresTaskRepository) FindCachedResult(ctx context.Context, cacheKey string) (result string, found bool, err error) {
+	query := `SELECT result FROM tasks WHERE cache_key=$1 AND status='ready' AND (expires_at IS NULL OR expires_at > $2) LIMIT 1`
+	err = r.pgPool.QueryRow(ctx, query, cacheKey, time.Now().UTC()).Scan(&result)
+	if err == pgx.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return result, true, nil
+}
+
+// ListTasks returns tasks without their payload and result, optionally
+// filtered by status.
+func (r PostgresTaskRepository) ListTasks(ctx context.Context, status string, limit int) ([]Task, error) {
+	query := `SELECT task_id, user_id, priority, status FROM tasks WHERE $1='' OR status=$1
+		ORDER BY created_at DESC NULLS LAST, task_id LIMIT $2`
+	rows, err := r.pgPool.Query(ctx, query, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []Task{}
+	for rows.Next() {
+		var task Task
+		if err := rows.Scan(&task.ID, &task.UserID, &task.Priority, &task.Status); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func (r PostgresTaskRepository) FailTask(ctx context.Context, id uuid.UUID, reason string) error {
+	query := `UPDATE tasks SET status='failed', result=$1 WHERE task_id=$2 AND status='in_progress'`
+	tag, err := r.pgPool.Exec(ctx, query, reason, id)
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() > 0 {
+		return nil
+	}
+	if _, err := r.GetTask(ctx, id); err != nil {
+		return err
+	}
+	return NewTaskNotInProgressError()
+}
+
+// PurgeExpiredTasks deletes the images and results of at most limit finished
+// tasks that have expired and returns how many it purged. The rows are kept
+// until DeleteExpiredTasks removes them, so that the API can tell expired
+// tasks from unknown ones in the meantime. Several servers may purge at the
+// same time without waiting for each other.
+func (r PostgresTaskRepository) PurgeExpiredTasks(ctx context.Context, limit int) (int, error) {
+	query := `UPDATE tasks SET payload='{}', cache_key=NULL, result=NULL WHERE task_id IN (
+		SELECT task_id FROM tasks WHERE expires_at <= now() AND result IS NOT NULL AND status <> 'in_progress'
+		LIMIT $1 FOR UPDATE SKIP LOCKED)`
+	tag, err := r.pgPool.Exec(ctx, query, limit)
+	return int(tag.RowsAffected()), err
+}
+
+// DeleteExpiredTasks deletes at most limit finished tasks that expired before
+// expiredBefore and returns how many it deleted.
+func (r PostgresTaskRepository) DeleteExpiredTasks(ctx context.Context, expiredBefore time.Time, limit int) (int, error) {
+	query := `DELETE FROM tasks WHERE task_id IN (
+		SELECT task_id FROM tasks WHERE expires_at < $1 AND status <> 'in_progress'
+		LIMIT $2 FOR UPDATE SKIP LOCKED)`
+	tag, err := r.pgPool.Exec(ctx, query, expiredBefore, limit)
+	return int(tag.RowsAffected()), err
+}
+
+func (r PostgresTaskRepository) Ping(ctx context.Context) error {
+	return r.pgPool.Ping(ctx)
 }
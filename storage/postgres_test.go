@@ -0,0 +1,109 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"github.com/google/uuid"
+	. "hw/models"
+	. "hw/storage"
+	"hw/storage/storagetest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// baselineSchema is the init.sql that databases were created from before
+// migrations were introduced.
+//
+//go:embed testdata/baseline_init.sql
+var baselineSchema string
+
+// TestPostgresStorage runs against the database and Redis named by
+// POSTGRES_CONN_STRING and REDIS_ADDR, as `make conformance` does.
+func TestPostgresStorage(t *testing.T) {
+	cfg, err := storagetest.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DatabaseURL = os.Getenv("POSTGRES_CONN_STRING")
+	cfg.RedisAddr = os.Getenv("REDIS_ADDR")
+	if cfg.DatabaseURL == "" || cfg.RedisAddr == "" {
+		t.Skip("POSTGRES_CONN_STRING and REDIS_ADDR are not set")
+	}
+	migrate(t, cfg.DatabaseURL)
+	storagetest.Run(t, NewStorage(StorageDatabase, cfg))
+}
+
+// TestPostgresUpgrade migrates a database created from the baseline init.sql,
+// in a schema of its own, and checks that the data it held is still usable.
+func TestPostgresUpgrade(t *testing.T) {
+	connString := os.Getenv("POSTGRES_CONN_STRING")
+	if connString == "" {
+		t.Skip("POSTGRES_CONN_STRING is not set")
+	}
+	ctx := context.Background()
+	admin, err := sql.Open("pgx", connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	schema := "upgrade_" + strings.ReplaceAll(uuid.NewString()[:8], "-", "")
+	if _, err := admin.ExecContext(ctx, `CREATE SCHEMA `+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.ExecContext(ctx, `DROP SCHEMA `+schema+` CASCADE`) })
+
+	// Extensions such as pgcrypto live in public.
+	separator := "?"
+	if strings.Contains(connString, "?") {
+		separator = "&"
+	}
+	databaseURL := connString + separator + "search_path=" + schema + ",public"
+	db, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, baselineSchema); err != nil {
+		t.Fatalf("failed to create the baseline schema: %v", err)
+	}
+	userID, taskID := uuid.New(), uuid.New()
+	_, err = db.ExecContext(ctx, `INSERT INTO users (user_id, login, password) VALUES ($1, 'Legacy_User', 'password228')`, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hash_plaintext_passwords skipped passwords starting with '$'.
+	_, err = db.ExecContext(ctx, `INSERT INTO users (user_id, login, password) VALUES ($1, 'dollar_user', '$ecret228')`, uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO tasks (task_id, user_id, payload, status, result) VALUES ($1, $2, '{}', 'ready', 'result')`, taskID, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrate(t, databaseURL)
+
+	cfg, err := storagetest.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DatabaseURL = databaseURL
+	s := NewStorage(StorageDatabase, cfg)
+	user := &User{Login: "legacy_user", Password: "password228"}
+	if _, err := s.Login(ctx, user, &Session{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("legacy user cannot log in: %v", err)
+	}
+	if _, err := s.Login(ctx, &User{Login: "dollar_user", Password: "$ecret228"}, &Session{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("legacy user with a password starting with $ cannot log in: %v", err)
+	}
+	if saved, err := s.GetUser(ctx, userID); err != nil || saved.Role != RoleUser || saved.Disabled {
+		t.Fatalf("GetUser returned %+v, %v", saved, err)
+	}
+	task, err := s.GetTask(ctx, taskID)
+	if err != nil || task.Status != "ready" || task.Result != "result" || task.Priority != 0 {
+		t.Fatalf("GetTask returned %+v, %v", task, err)
+	}
+	storagetest.Run(t, s)
+}
@@ -2,32 +2,67 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	. "hw/models"
+	"log/slog"
 )
 
 var _ UserRepository = PostgresUserRepository{}
 
 type UserRepository interface {
-	AddUser(user *User) error
-	ValidateUser(user *User) error
+	AddUser(ctx context.Context, user *User) error
+	ValidateUser(ctx context.Context, user *User) error
+	GetUser(ctx context.Context, id uuid.UUID) (User, error)
+	ListUsers(ctx context.Context) ([]User, error)
+	SetUserDisabled(ctx context.Context, id uuid.UUID, disabled bool) error
+	EnsureAdmin(ctx context.Context, login, password string) error
+	RenameUser(ctx context.Context, id uuid.UUID, login string) error
+	CheckPassword(ctx context.Context, id uuid.UUID, password string) error
+	UpdatePassword(ctx context.Context, id uuid.UUID, currentPassword, newPassword string) error
+	DeleteUser(ctx context.Context, id uuid.UUID) error
+	GetOIDCUser(ctx context.Context, identity OIDCIdentity) (User, error)
+	LinkOIDCUser(ctx context.Context, id uuid.UUID, identity OIDCIdentity) error
 }
 
 type PostgresUserRepository struct {
-	pgPool *pgxpool.Pool
+	pgPool         *pgxpool.Pool
+	passwordParams PasswordParams
 }
 
-type InvalidCredentialsError struct {
-	Message string
-}
+// InvalidCredentialsError does not tell an unknown username from a wrong
+// password, so that logins cannot be used to find out which accounts exist.
+type InvalidCredentialsError struct{}
 
 func (e *InvalidCredentialsError) Error() string {
-	return e.Message
+	return "Invalid username or password"
+}
+
+func NewInvalidCredentialsError() error {
+	return &InvalidCredentialsError{}
+}
+
+type UserDisabledError struct{}
+
+func (e *UserDisabledError) Error() string {
+	return "Account is disabled"
 }
 
-func NewInvalidCredentialsError(message string) error {
-	return &InvalidCredentialsError{Message: message}
+func NewUserDisabledError() error {
+	return &UserDisabledError{}
+}
+
+type UserNotFoundError struct{}
+
+func (e *UserNotFoundError) Error() string {
+	return "User not found"
+}
+
+func NewUserNotFoundError() error {
+	return &UserNotFoundError{}
 }
 
 type UserExistsError struct{}
@@ -40,37 +75,287 @@ func NewUserExistsError() error {
 	return &UserExistsError{}
 }
 
-func (r PostgresUserRepository) UserExists(login string) (exists bool, err error) {
-	query := `SELECT EXISTS(SELECT 1 FROM users WHERE login=$1)`
-	err = r.pgPool.QueryRow(context.Background(), query, login).Scan(&exists)
-	return
+// NoPasswordError means that the account has no password, because it signs
+// in through OIDC only.
+type NoPasswordError struct{}
+
+func (e *NoPasswordError) Error() string {
+	return "Account has no password"
+}
+
+func NewNoPasswordError() error {
+	return &NoPasswordError{}
+}
+
+// OIDCLinkedError means that the account already has an OIDC identity, or
+// that the identity belongs to another account.
+type OIDCLinkedError struct{}
+
+func (e *OIDCLinkedError) Error() string {
+	return "Account or identity is already linked"
+}
+
+func NewOIDCLinkedError() error {
+	return &OIDCLinkedError{}
+}
+
+// AdminLoginTakenError means that the bootstrap admin login belongs to an
+// account that is not an admin.
+type AdminLoginTakenError struct{}
+
+func (e *AdminLoginTakenError) Error() string {
+	return "Admin login is taken by an account that is not an admin"
+}
+
+func NewAdminLoginTakenError() error {
+	return &AdminLoginTakenError{}
+}
+
+// pgUniqueViolation is the SQLSTATE of unique_violation.
+const pgUniqueViolation = "23505"
+
+// uniqueViolation tells whether err was caused by the unique constraint.
+func uniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation && pgErr.ConstraintName == constraint
+}
+
+// loginTaken translates the violation of the unique constraint on logins.
+// Relying on the constraint rather than checking first keeps concurrent
+// registrations of one login from both succeeding.
+func loginTaken(err error) error {
+	if uniqueViolation(err, "users_login_key") {
+		return NewUserExistsError()
+	}
+	return err
 }
 
-func (r PostgresUserRepository) AddUser(user *User) error {
-	exists, err := r.UserExists(user.Login)
+func (r PostgresUserRepository) AddUser(ctx context.Context, user *User) error {
+	hash, err := r.passwordParams.Hash(user.Password)
 	if err != nil {
 		return err
 	}
-	if exists {
-		return NewUserExistsError()
+	if user.Role == "" {
+		user.Role = RoleUser
 	}
-
-	query := `INSERT INTO users (user_id, login, password) VALUES ($1, $2, $3)`
-	_, err = r.pgPool.Exec(context.Background(), query, user.ID, user.Login, user.Password)
-	return err
+	query := `INSERT INTO users (user_id, login, password, role) VALUES ($1, $2, $3, $4)`
+	_, err = r.pgPool.Exec(ctx, query, user.ID, user.Login, hash, user.Role)
+	return loginTaken(err)
 }
 
-func (r PostgresUserRepository) ValidateUser(user *User) error {
+func (r PostgresUserRepository) ValidateUser(ctx context.Context, user *User) error {
 	var savedUser User
-	query := `SELECT user_id, password FROM users WHERE login=$1`
-	err := r.pgPool.QueryRow(context.Background(), query, user.Login).Scan(&savedUser.ID, &savedUser.Password)
+	query := `SELECT user_id, COALESCE(password, ''), role, disabled FROM users WHERE login=$1`
+	err := r.pgPool.QueryRow(ctx, query, user.Login).
+		Scan(&savedUser.ID, &savedUser.Password, &savedUser.Role, &savedUser.Disabled)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	if err == pgx.ErrNoRows || savedUser.Password == "" {
+		// Spend as much time as a password check would, so that unknown
+		// usernames cannot be told apart by the response time either.
+		// Users signing in only through OIDC have no password.
+		_, _ = r.passwordParams.Hash(user.Password)
+		return NewInvalidCredentialsError()
+	}
+
+	ok, needsRehash, err := r.passwordParams.Verify(user.Password, savedUser.Password)
+	if err != nil {
+		return err
+	} else if !ok {
+		return NewInvalidCredentialsError()
+	} else if savedUser.Disabled {
+		return NewUserDisabledError()
+	}
+	user.ID = savedUser.ID
+	user.Role = savedUser.Role
+
+	if needsRehash {
+		r.rehashPassword(ctx, user)
+	}
+	return nil
+}
+
+// rehashPassword upgrades the stored hash to the current parameters. A failure
+// only postpones the upgrade to the next login, so it does not fail the login.
+func (r PostgresUserRepository) rehashPassword(ctx context.Context, user *User) {
+	hash, err := r.passwordParams.Hash(user.Password)
+	if err == nil {
+		query := `UPDATE users SET password=$1 WHERE user_id=$2`
+		_, err = r.pgPool.Exec(ctx, query, hash, user.ID)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to rehash password", "user_id", user.ID, "error", err)
+	}
+}
+
+func (r PostgresUserRepository) GetUser(ctx context.Context, id uuid.UUID) (User, error) {
+	var user User
+	query := `SELECT user_id, login, role, disabled FROM users WHERE user_id=$1`
+	err := r.pgPool.QueryRow(ctx, query, id).Scan(&user.ID, &user.Login, &user.Role, &user.Disabled)
+	if err == pgx.ErrNoRows {
+		return User{}, NewUserNotFoundError()
+	}
+	return user, err
+}
+
+func (r PostgresUserRepository) ListUsers(ctx context.Context) ([]User, error) {
+	query := `SELECT user_id, login, role, disabled FROM users ORDER BY login`
+	rows, err := r.pgPool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Login, &user.Role, &user.Disabled); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (r PostgresUserRepository) SetUserDisabled(ctx context.Context, id uuid.UUID, disabled bool) error {
+	query := `UPDATE users SET disabled=$1 WHERE user_id=$2`
+	tag, err := r.pgPool.Exec(ctx, query, disabled, id)
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return NewUserNotFoundError()
+	}
+	return nil
+}
+
+// EnsureAdmin creates the bootstrap administrator unless an account with
+// that login exists. An existing admin is left as it is, while any other
+// account holding the login is an AdminLoginTakenError: promoting it would
+// hand the admin role to whoever registered the login first.
+func (r PostgresUserRepository) EnsureAdmin(ctx context.Context, login, password string) error {
+	err := r.AddUser(ctx, &User{ID: uuid.New(), Login: login, Password: password, Role: RoleAdmin})
+	if _, ok := err.(*UserExistsError); !ok {
+		return err
+	}
+	var role string
+	query := `SELECT role FROM users WHERE login=$1`
+	if err := r.pgPool.QueryRow(ctx, query, login).Scan(&role); err != nil {
+		return err
+	} else if role != RoleAdmin {
+		return NewAdminLoginTakenError()
+	}
+	return nil
+}
+
+func (r PostgresUserRepository) RenameUser(ctx context.Context, id uuid.UUID, login string) error {
+	query := `UPDATE users SET login=$1 WHERE user_id=$2`
+	tag, err := r.pgPool.Exec(ctx, query, login, id)
+	if err != nil {
+		return loginTaken(err)
+	} else if tag.RowsAffected() == 0 {
+		return NewUserNotFoundError()
+	}
+	return nil
+}
+
+// CheckPassword returns an InvalidCredentialsError unless password is the
+// password of the user.
+func (r PostgresUserRepository) CheckPassword(ctx context.Context, id uuid.UUID, password string) error {
+	var saved string
+	query := `SELECT COALESCE(password, '') FROM users WHERE user_id=$1`
+	err := r.pgPool.QueryRow(ctx, query, id).Scan(&saved)
 	if err == pgx.ErrNoRows {
-		return NewInvalidCredentialsError("Username doesn't exist")
+		return NewUserNotFoundError()
 	} else if err != nil {
 		return err
-	} else if savedUser.Password != user.Password {
-		return NewInvalidCredentialsError("Wrong username or password")
+	} else if saved == "" {
+		return NewNoPasswordError()
+	}
+	ok, _, err := r.passwordParams.Verify(password, saved)
+	if err != nil {
+		return err
+	} else if !ok {
+		return NewInvalidCredentialsError()
 	}
-	user.ID = savedUser.ID
 	return nil
 }
+
+// UpdatePassword replaces the password after checking the current one.
+func (r PostgresUserRepository) UpdatePassword(ctx context.Context, id uuid.UUID, currentPassword, newPassword string) error {
+	if err := r.CheckPassword(ctx, id, currentPassword); err != nil {
+		return err
+	}
+	hash, err := r.passwordParams.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE users SET password=$1 WHERE user_id=$2`
+	_, err = r.pgPool.Exec(ctx, query, hash, id)
+	return err
+}
+
+// DeleteUser removes the user with all their tasks, including the submitted
+// images and the results stored with them. API keys are removed by the
+// cascading foreign key.
+func (r PostgresUserRepository) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	tx, err := r.pgPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM tasks WHERE user_id=$1`, id); err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, `DELETE FROM users WHERE user_id=$1`, id)
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return NewUserNotFoundError()
+	}
+	return tx.Commit(ctx)
+}
+
+// GetOIDCUser returns the user signed in through an OIDC provider, creating
+// it on the first login. A local user with the same login is never linked
+// implicitly, since the provider vouches for neither the login nor for any
+// claim matching a local account; see LinkOIDCUser.
+func (r PostgresUserRepository) GetOIDCUser(ctx context.Context, identity OIDCIdentity) (User, error) {
+	var user User
+	query := `SELECT user_id, login, role, disabled FROM users WHERE oidc_issuer=$1 AND oidc_subject=$2`
+	err := r.pgPool.QueryRow(ctx, query, identity.Issuer, identity.Subject).
+		Scan(&user.ID, &user.Login, &user.Role, &user.Disabled)
+	if err == nil {
+		return user, nil
+	} else if err != pgx.ErrNoRows {
+		return User{}, err
+	}
+
+	user = User{ID: uuid.New(), Login: identity.Login, Role: RoleUser}
+	query = `INSERT INTO users (user_id, login, role, oidc_issuer, oidc_subject) VALUES ($1, $2, $3, $4, $5)`
+	_, err = r.pgPool.Exec(ctx, query, user.ID, user.Login, user.Role, identity.Issuer, identity.Subject)
+	if uniqueViolation(err, "users_oidc_issuer_oidc_subject_key") {
+		// A concurrent first login of the same subject created the user.
+		return r.GetOIDCUser(ctx, identity)
+	}
+	return user, loginTaken(err)
+}
+
+// LinkOIDCUser links the identity to a user who has signed in with their
+// password, which lets local users move to single sign-on.
+func (r PostgresUserRepository) LinkOIDCUser(ctx context.Context, id uuid.UUID, identity OIDCIdentity) error {
+	query := `UPDATE users SET oidc_issuer=$1, oidc_subject=$2 WHERE user_id=$3 AND oidc_subject IS NULL`
+	tag, err := r.pgPool.Exec(ctx, query, identity.Issuer, identity.Subject, id)
+	if uniqueViolation(err, "users_oidc_issuer_oidc_subject_key") {
+		return NewOIDCLinkedError()
+	} else if err != nil {
+		return err
+	} else if tag.RowsAffected() > 0 {
+		return nil
+	}
+	if _, err := r.GetUser(ctx, id); err != nil {
+		return err
+	}
+	return NewOIDCLinkedError()
+}
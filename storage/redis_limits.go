@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	. "hw/models"
+	"time"
+)
+
+var _ LimitRepository = &RedisLimitRepository{}
+
+type LimitRepository interface {
+	Allow(ctx context.Context, key string, limit RateLimit) error
+	ConsumeQuota(ctx context.Context, userID uuid.UUID, pixels int64) error
+	RefundQuota(ctx context.Context, userID uuid.UUID, pixels int64) error
+	GetUsage(ctx context.Context, userID uuid.UUID) (Usage, error)
+	CheckLogin(ctx context.Context, login, ip string) error
+	RecordLoginFailure(ctx context.Context, login, ip string) error
+	RecordLoginSuccess(ctx context.Context, login string) error
+}
+
+const (
+	QuotaDaily   = "day"
+	QuotaMonthly = "month"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second and
+// holding at most Burst tokens. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Quota bounds the tasks created and the pixels submitted by a user per
+// Period. Zero limits are not enforced.
+type Quota struct {
+	Period    string
+	MaxTasks  int64
+	MaxPixels int64
+}
+
+type RedisLimitRepository struct {
+	redisClient *redis.Client
+	quota       Quota
+	throttle    LoginThrottle
+}
+
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return "Too many requests"
+}
+
+func NewRateLimitedError(retryAfter time.Duration) error {
+	return &RateLimitedError{RetryAfter: retryAfter}
+}
+
+type QuotaExceededError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *QuotaExceededError) Error() string {
+	return e.Message
+}
+
+func NewQuotaExceededError(message string, retryAfter time.Duration) error {
+	return &QuotaExceededError{Message: message, RetryAfter: retryAfter}
+}
+
+// tokenBucket takes one token from the bucket under KEYS[1] and returns 0,
+// or the number of milliseconds until a token is available. The bucket is
+// stored as the token count and the time of the last refill, using the Redis
+// clock so that all servers agree.
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return wait
+`)
+
+// consumeQuota adds one task and ARGV[3] pixels to the usage hash under
+// KEYS[1] unless that exceeds a limit. It returns 0 on success, 1 when the
+// task limit and 2 when the pixel limit would be exceeded.
+var consumeQuota = redis.NewScript(`
+local maxTasks = tonumber(ARGV[1])
+local maxPixels = tonumber(ARGV[2])
+local pixels = tonumber(ARGV[3])
+local tasks = tonumber(redis.call('HGET', KEYS[1], 'tasks')) or 0
+local used = tonumber(redis.call('HGET', KEYS[1], 'pixels')) or 0
+if maxTasks > 0 and tasks + 1 > maxTasks then
+	return 1
+end
+if maxPixels > 0 and used + pixels > maxPixels then
+	return 2
+end
+redis.call('HINCRBY', KEYS[1], 'tasks', 1)
+redis.call('HINCRBY', KEYS[1], 'pixels', pixels)
+redis.call('EXPIREAT', KEYS[1], ARGV[4])
+return 0
+`)
+
+// refundQuota removes one task and ARGV[1] pixels from the usage hash under
+// KEYS[1], if it has not expired in the meantime.
+var refundQuota = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('HINCRBY', KEYS[1], 'tasks', -1)
+	redis.call('HINCRBY', KEYS[1], 'pixels', -tonumber(ARGV[1]))
+end
+return 0
+`)
+
+func rateLimitKey(key string) string {
+	return "rate_limit:" + key
+}
+
+// usageKey names the usage hash of the period, e.g. usage:<user id>:2024-06
+// for monthly quotas.
+func usageKey(userID uuid.UUID, period string, start time.Time) string {
+	layout := "2006-01-02"
+	if period == QuotaMonthly {
+		layout = "2006-01"
+	}
+	return fmt.Sprintf("usage:%s:%s", userID, start.Format(layout))
+}
+
+// quotaPeriod returns the bounds of the UTC day or month containing now.
+func quotaPeriod(period string, now time.Time) (start, end time.Time) {
+	now = now.UTC()
+	if period == QuotaMonthly {
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// Allow takes a token from the bucket named key and returns a
+// RateLimitedError when the bucket is empty.
+func (r *RedisLimitRepository) Allow(ctx context.Context, key string, limit RateLimit) error {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := max(limit.Burst, 1)
+	wait, err := tokenBucket.Run(ctx, r.redisClient, []string{rateLimitKey(key)}, limit.Rate, burst).Int64()
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return NewRateLimitedError(time.Duration(wait) * time.Millisecond)
+	}
+	return nil
+}
+
+// ConsumeQuota records a new task of the user submitting the given number of
+// pixels, or returns a QuotaExceededError if that would exceed the quota.
+func (r *RedisLimitRepository) ConsumeQuota(ctx context.Context, userID uuid.UUID, pixels int64) error {
+	now := time.Now()
+	start, end := quotaPeriod(r.quota.Period, now)
+	code, err := consumeQuota.Run(ctx, r.redisClient,
+		[]string{usageKey(userID, r.quota.Period, start)},
+		r.quota.MaxTasks, r.quota.MaxPixels, pixels, end.Unix(),
+	).Int64()
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 1:
+		return NewQuotaExceededError(fmt.Sprintf("Task quota of %d per %s exceeded", r.quota.MaxTasks, r.quota.Period), end.Sub(now))
+	case 2:
+		return NewQuotaExceededError(fmt.Sprintf("Quota of %g megapixels per %s exceeded", megapixels(r.quota.MaxPixels), r.quota.Period), end.Sub(now))
+	}
+	return nil
+}
+
+// RefundQuota takes back a task and its pixels consumed in the current period
+// for a task that could not be created.
+func (r *RedisLimitRepository) RefundQuota(ctx context.Context, userID uuid.UUID, pixels int64) error {
+	start, _ := quotaPeriod(r.quota.Period, time.Now())
+	return refundQuota.Run(ctx, r.redisClient, []string{usageKey(userID, r.quota.Period, start)}, pixels).Err()
+}
+
+func (r *RedisLimitRepository) GetUsage(ctx context.Context, userID uuid.UUID) (Usage, error) {
+	start, end := quotaPeriod(r.quota.Period, time.Now())
+	fields, err := r.redisClient.HGetAll(ctx, usageKey(userID, r.quota.Period, start)).Result()
+	if err != nil {
+		return Usage{}, err
+	}
+	var tasks, pixels int64
+	fmt.Sscan(fields["tasks"], &tasks)
+	fmt.Sscan(fields["pixels"], &pixels)
+	return Usage{
+		Period:        r.quota.Period,
+		ResetsAt:      end,
+		Tasks:         tasks,
+		MaxTasks:      r.quota.MaxTasks,
+		Megapixels:    megapixels(pixels),
+		MaxMegapixels: megapixels(r.quota.MaxPixels),
+	}, nil
+}
+
+func megapixels(pixels int64) float64 {
+	return float64(pixels) / 1e6
+}
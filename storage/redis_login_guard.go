@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// LoginThrottle locks an account after MaxAccountFailures and a client
+// address after MaxIPFailures failed logins within Window. The first lockout
+// lasts Lockout and every further failure doubles it up to MaxLockout.
+// A zero limit disables the corresponding lockout.
+type LoginThrottle struct {
+	MaxAccountFailures int64
+	MaxIPFailures      int64
+	Window             time.Duration
+	Lockout            time.Duration
+	MaxLockout         time.Duration
+}
+
+// lockout returns the lockout after the given number of failures beyond the
+// limit, as computed by recordFailure.
+func (t LoginThrottle) lockout(extraFailures int64) time.Duration {
+	lock := float64(t.Lockout) * math.Pow(2, float64(extraFailures))
+	return time.Duration(math.Min(lock, float64(max(t.MaxLockout, t.Lockout))))
+}
+
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return "Too many failed login attempts, try again later"
+}
+
+func NewLoginLockedError(retryAfter time.Duration) error {
+	return &LoginLockedError{RetryAfter: retryAfter}
+}
+
+// recordFailure counts a failed login in KEYS[1] and, once the count reaches
+// ARGV[1], locks KEYS[2] for a lockout growing with every further failure.
+// It returns the count and the lockout in milliseconds, 0 if not locked.
+// The counter outlives the lockout so that the next failure escalates it.
+var recordFailure = redis.NewScript(`
+local max = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local lockout = tonumber(ARGV[3])
+local maxLockout = tonumber(ARGV[4])
+
+local failures = redis.call('INCR', KEYS[1])
+if failures < max then
+	if failures == 1 then
+		redis.call('PEXPIRE', KEYS[1], window)
+	end
+	return {failures, 0}
+end
+local lock = math.min(lockout * 2 ^ (failures - max), maxLockout)
+redis.call('SET', KEYS[2], failures, 'PX', math.floor(lock))
+redis.call('PEXPIRE', KEYS[1], math.floor(lock) + window)
+return {failures, math.floor(lock)}
+`)
+
+func loginFailuresKey(kind, id string) string {
+	return "login_failures:" + kind + ":" + id
+}
+
+func loginLockKey(kind, id string) string {
+	return "login_lock:" + kind + ":" + id
+}
+
+// CheckLogin returns a LoginLockedError if the account or the client address
+// is locked out.
+func (r *RedisLimitRepository) CheckLogin(ctx context.Context, login, ip string) error {
+	var retryAfter time.Duration
+	for _, key := range []string{loginLockKey("account", login), loginLockKey("ip", ip)} {
+		ttl, err := r.redisClient.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		retryAfter = max(retryAfter, ttl)
+	}
+	if retryAfter > 0 {
+		return NewLoginLockedError(retryAfter)
+	}
+	return nil
+}
+
+// RecordLoginFailure counts a failed login for the account and the client
+// address and locks them out once they reach their limits.
+func (r *RedisLimitRepository) RecordLoginFailure(ctx context.Context, login, ip string) error {
+	limits := []struct {
+		kind, id string
+		max      int64
+	}{
+		{"account", login, r.throttle.MaxAccountFailures},
+		{"ip", ip, r.throttle.MaxIPFailures},
+	}
+	for _, limit := range limits {
+		if limit.max <= 0 || r.throttle.Lockout <= 0 {
+			continue
+		}
+		result, err := recordFailure.Run(ctx, r.redisClient,
+			[]string{loginFailuresKey(limit.kind, limit.id), loginLockKey(limit.kind, limit.id)},
+			limit.max, r.throttle.Window.Milliseconds(), r.throttle.Lockout.Milliseconds(), max(r.throttle.MaxLockout, r.throttle.Lockout).Milliseconds(),
+		).Int64Slice()
+		if err != nil {
+			return err
+		}
+		if lock := time.Duration(result[1]) * time.Millisecond; lock > 0 {
+			slog.WarnContext(ctx, "login locked", "kind", limit.kind, "id", limit.id, "lockout", lock, "failures", result[0])
+		}
+	}
+	return nil
+}
+
+// RecordLoginSuccess clears the failed logins of the account. Failures of the
+// client address are kept, one valid account must not reset the limit for
+// guessing others.
+func (r *RedisLimitRepository) RecordLoginSuccess(ctx context.Context, login string) error {
+	key := loginFailuresKey("account", login)
+	failures, err := r.redisClient.GetDel(ctx, key).Int64()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if r.throttle.MaxAccountFailures > 0 && failures >= r.throttle.MaxAccountFailures {
+		slog.InfoContext(ctx, "login unlocked after a successful login", "account", login)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"time"
+)
+
+// OIDCLoginState is kept between redirecting the user to the identity
+// provider and the callback, under oidc_state:<state>. UserID is set when a
+// signed in user links their account rather than signing in.
+type OIDCLoginState struct {
+	Verifier string
+	Nonce    string
+	UserID   uuid.UUID
+}
+
+func oidcStateKey(state string) string {
+	return "oidc_state:" + state
+}
+
+func (r *RedisSessionRepository) SaveOIDCState(ctx context.Context, state string, login OIDCLoginState, ttl time.Duration) error {
+	key := oidcStateKey(state)
+	_, err := r.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "verifier", login.Verifier, "nonce", login.Nonce, "user_id", login.UserID.String())
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
+// TakeOIDCState returns and removes the login state, so that every
+// authorization response can be used only once.
+func (r *RedisSessionRepository) TakeOIDCState(ctx context.Context, state string) (OIDCLoginState, error) {
+	key := oidcStateKey(state)
+	var fields *redis.StringStringMapCmd
+	_, err := r.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		fields = pipe.HGetAll(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return OIDCLoginState{}, err
+	}
+	values := fields.Val()
+	if len(values) == 0 {
+		return OIDCLoginState{}, NewInvalidTokenError("invalid or expired login state")
+	}
+	// States saved before user_id was added parse as uuid.Nil, a login.
+	userID, _ := uuid.Parse(values["user_id"])
+	return OIDCLoginState{Verifier: values["verifier"], Nonce: values["nonce"], UserID: userID}, nil
+}
@@ -2,57 +2,304 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
+	. "hw/models"
+	"log/slog"
 	"time"
 )
 
 var _ SessionRepository = &RedisSessionRepository{}
 
 type SessionRepository interface {
-	AddSession(userID string) (string, error)
-	GetUserBySession(jwtToken string) (uuid.UUID, error)
+	AddSession(ctx context.Context, session *Session) (Tokens, error)
+	GetSession(ctx context.Context, jwtToken string) (Session, error)
+	RefreshSession(ctx context.Context, refreshToken string, authorize func(session *Session) error) (Tokens, error)
+	ListSessions(ctx context.Context, userID uuid.UUID) ([]Session, error)
+	DeleteSession(ctx context.Context, userID, sessionID uuid.UUID) error
+	DeleteUserSessions(ctx context.Context, userID uuid.UUID) error
+	DeleteOtherSessions(ctx context.Context, userID, keepSessionID uuid.UUID) error
+	SaveOIDCState(ctx context.Context, state string, login OIDCLoginState, ttl time.Duration) error
+	TakeOIDCState(ctx context.Context, state string) (OIDCLoginState, error)
 }
 
 type RedisSessionRepository struct {
-	redisClient *redis.Client
-	jwtSecret   []byte
+	redisClient     *redis.Client
+	signer          TokenSigner
+	accessTTL       time.Duration
+	refreshTTL      time.Duration
+	checkRevocation bool
 }
 
-func (r *RedisSessionRepository) generateToken(userID string) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Minute * 5).Unix(),
+type InvalidTokenError struct {
+	Message string
+}
+
+func (e *InvalidTokenError) Error() string {
+	return e.Message
+}
+
+func NewInvalidTokenError(message string) error {
+	return &InvalidTokenError{Message: message}
+}
+
+// Access tokens are verified statelessly by TokenSigner. Redis keeps what
+// cannot be stateless:
+//
+// A session is stored as a hash under session:<session id> holding the
+// session metadata and the digest of its current refresh token. The session
+// lives as long as its refresh token. The ids of all sessions of a user are
+// kept in the user_sessions:<user id> set, which may still contain ids of
+// sessions that already expired.
+//
+// Every refresh token ever issued maps to its session under
+// refresh:<digest>. A refresh token that is not the current one of its
+// session has already been rotated, so presenting it again means it was
+// stolen and the whole session is revoked.
+//
+// Revoked sessions are listed under revoked:<session id> until the last
+// access token issued for them expires. The denylist is only consulted when
+// checkRevocation is set; otherwise revocation takes effect when the access
+// token expires.
+func sessionKey(sessionID uuid.UUID) string {
+	return "session:" + sessionID.String()
+}
+
+func userSessionsKey(userID uuid.UUID) string {
+	return "user_sessions:" + userID.String()
+}
+
+func refreshKey(digest string) string {
+	return "refresh:" + digest
+}
+
+func revokedKey(sessionID uuid.UUID) string {
+	return "revoked:" + sessionID.String()
+}
+
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// issueTokens creates a new token pair for the session and stores it with
+// pipe, replacing the previous pair.
+func (r *RedisSessionRepository) issueTokens(ctx context.Context, pipe redis.Pipeliner, session *Session) (Tokens, error) {
+	accessToken, err := r.signer.SignSession(session, r.accessTTL)
+	if err != nil {
+		return Tokens{}, err
+	}
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	key := sessionKey(session.SessionID)
+	refreshDigest := tokenDigest(refreshToken)
+	pipe.HSet(ctx, key, "refresh", refreshDigest)
+	pipe.Expire(ctx, key, r.refreshTTL)
+	pipe.Set(ctx, refreshKey(refreshDigest), session.SessionID.String(), r.refreshTTL)
+
+	return Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(r.accessTTL.Seconds()),
+	}, nil
+}
+
+// GetSession verifies the access token. Only the user and session ids are
+// filled in, the rest of the session metadata is not read from Redis.
+func (r *RedisSessionRepository) GetSession(ctx context.Context, jwtToken string) (Session, error) {
+	session, err := r.signer.VerifySession(jwtToken)
+	if err != nil {
+		return Session{}, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(r.jwtSecret)
+	if r.checkRevocation {
+		revoked, err := r.redisClient.Exists(ctx, revokedKey(session.SessionID)).Result()
+		if err != nil {
+			return Session{}, err
+		} else if revoked > 0 {
+			return Session{}, NewInvalidTokenError("token revoked")
+		}
+	}
+	return session, nil
 }
 
-func (r *RedisSessionRepository) GetUserBySession(jwtToken string) (uuid.UUID, error) {
-	ctx := context.Background()
-	userIDStr, err := r.redisClient.Get(ctx, jwtToken).Result()
+func parseSession(sessionID uuid.UUID, fields map[string]string) (Session, error) {
+	userID, err := uuid.Parse(fields["user_id"])
+	if err != nil {
+		return Session{}, errors.New("invalid user ID format")
+	}
+	createdAt, _ := time.Parse(time.RFC3339, fields["created_at"])
+	return Session{
+		UserID:    userID,
+		SessionID: sessionID,
+		Role:      fields["role"],
+		CreatedAt: createdAt,
+		UserAgent: fields["user_agent"],
+		IP:        fields["ip"],
+	}, nil
+}
+
+func (r *RedisSessionRepository) AddSession(ctx context.Context, session *Session) (Tokens, error) {
+	session.SessionID = uuid.New()
+	session.CreatedAt = time.Now().UTC()
+
+	key := sessionKey(session.SessionID)
+	indexKey := userSessionsKey(session.UserID)
+	var tokens Tokens
+	_, err := r.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"user_id", session.UserID.String(),
+			"role", session.Role,
+			"created_at", session.CreatedAt.Format(time.RFC3339),
+			"user_agent", session.UserAgent,
+			"ip", session.IP,
+		)
+		var err error
+		tokens, err = r.issueTokens(ctx, pipe, session)
+		if err != nil {
+			return err
+		}
+		pipe.SAdd(ctx, indexKey, session.SessionID.String())
+		pipe.Expire(ctx, indexKey, r.refreshTTL)
+		return nil
+	})
+	return tokens, err
+}
+
+// RefreshSession exchanges a refresh token for a new token pair. The old
+// refresh token stops working immediately, the old access token when it
+// expires. authorize may update the session or refuse the refresh.
+func (r *RedisSessionRepository) RefreshSession(ctx context.Context, refreshToken string, authorize func(session *Session) error) (Tokens, error) {
+	digest := tokenDigest(refreshToken)
+	id, err := r.redisClient.Get(ctx, refreshKey(digest)).Result()
 	if err == redis.Nil {
-		return uuid.UUID{}, errors.New("invalid token")
+		return Tokens{}, NewInvalidTokenError("invalid refresh token")
 	} else if err != nil {
-		return uuid.UUID{}, err
+		return Tokens{}, err
+	}
+	sessionID, err := uuid.Parse(id)
+	if err != nil {
+		return Tokens{}, NewInvalidTokenError("invalid refresh token")
 	}
 
-	userID, err := uuid.Parse(userIDStr)
+	key := sessionKey(sessionID)
+	var tokens Tokens
+	var reused *Session
+	err = r.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		fields, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		} else if len(fields) == 0 {
+			return NewInvalidTokenError("invalid refresh token")
+		}
+		session, err := parseSession(sessionID, fields)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(fields["refresh"]), []byte(digest)) != 1 {
+			reused = &session
+			return NewInvalidTokenError("refresh token reused")
+		}
+		if err := authorize(&session); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, "role", session.Role)
+			tokens, err = r.issueTokens(ctx, pipe, &session)
+			return err
+		})
+		return err
+	}, key)
+
+	if reused != nil {
+		slog.WarnContext(ctx, "refresh token reuse detected, revoking session", "session_id", reused.SessionID, "user_id", reused.UserID)
+		if err := r.DeleteSession(ctx, reused.UserID, reused.SessionID); err != nil {
+			return Tokens{}, err
+		}
+	}
+	return tokens, err
+}
+
+func (r *RedisSessionRepository) ListSessions(ctx context.Context, userID uuid.UUID) ([]Session, error) {
+	ids, err := r.redisClient.SMembers(ctx, userSessionsKey(userID)).Result()
 	if err != nil {
-		return uuid.UUID{}, errors.New("invalid user ID format")
+		return nil, err
+	}
+
+	sessions := make([]Session, 0, len(ids))
+	for _, id := range ids {
+		sessionID, err := uuid.Parse(id)
+		if err != nil {
+			continue
+		}
+		fields, err := r.redisClient.HGetAll(ctx, sessionKey(sessionID)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			r.redisClient.SRem(ctx, userSessionsKey(userID), id)
+			continue
+		}
+		session, err := parseSession(sessionID, fields)
+		if err != nil || session.UserID != userID {
+			continue
+		}
+		sessions = append(sessions, session)
 	}
-	return userID, nil
+	return sessions, nil
 }
 
-func (r *RedisSessionRepository) AddSession(userID string) (string, error) {
-	jwtToken, err := r.generateToken(userID)
+func (r *RedisSessionRepository) DeleteSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	_, err := r.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(sessionID))
+		pipe.SRem(ctx, userSessionsKey(userID), sessionID.String())
+		pipe.Set(ctx, revokedKey(sessionID), userID.String(), r.accessTTL)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisSessionRepository) DeleteUserSessions(ctx context.Context, userID uuid.UUID) error {
+	return r.DeleteOtherSessions(ctx, userID, uuid.Nil)
+}
+
+// DeleteOtherSessions revokes every session of the user except keepSessionID.
+func (r *RedisSessionRepository) DeleteOtherSessions(ctx context.Context, userID, keepSessionID uuid.UUID) error {
+	indexKey := userSessionsKey(userID)
+	ids, err := r.redisClient.SMembers(ctx, indexKey).Result()
 	if err != nil {
-		return "", err
+		return err
 	}
-	ctx := context.Background()
-	err = r.redisClient.Set(ctx, jwtToken, userID, time.Minute*5).Err()
-	return jwtToken, err
+
+	_, err = r.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			sessionID, err := uuid.Parse(id)
+			if err != nil || sessionID == keepSessionID {
+				continue
+			}
+			pipe.SRem(ctx, indexKey, id)
+			pipe.Del(ctx, sessionKey(sessionID))
+			pipe.Set(ctx, revokedKey(sessionID), userID.String(), r.accessTTL)
+		}
+		return nil
+	})
+	return err
 }
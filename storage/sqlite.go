@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"hw/logging"
+	_ "modernc.org/sqlite"
+	"strings"
+)
+
+// SQLiteScheme starts connection strings that name an SQLite database file,
+// e.g. sqlite:///var/lib/image-processor/data.db or sqlite://data.db.
+// Any other connection string is handed to Postgres.
+const SQLiteScheme = "sqlite:"
+
+func sqlitePath(connString string) (string, bool) {
+	path, ok := strings.CutPrefix(connString, SQLiteScheme)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimPrefix(path, "//"), true
+}
+
+// sqliteDSN enables foreign keys, which SQLite leaves off by default, and
+// makes writers wait for each other instead of failing with SQLITE_BUSY.
+// Transactions take the write lock up front, so that a transaction that
+// starts by reading cannot deadlock with another writer.
+func sqliteDSN(path string) string {
+	return "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+}
+
+func openSQLite(path string) *sql.DB {
+	db, err := sql.Open("sqlite", sqliteDSN(path))
+	if err != nil {
+		logging.Fatal("unable to open SQLite database", "path", path, "error", err)
+	}
+	return db
+}
+
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// execAffected runs query and returns the number of rows it changed, like
+// the command tag returned by pgx.
+func execAffected(ctx context.Context, db sqlExecer, query string, args ...any) (int64, error) {
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/google/uuid"
+	. "hw/models"
+	"strings"
+	"time"
+)
+
+var _ APIKeyRepository = SQLiteAPIKeyRepository{}
+
+// SQLiteAPIKeyRepository stores the scopes as a JSON array, since SQLite has
+// no array type.
+type SQLiteAPIKeyRepository struct {
+	db *sql.DB
+}
+
+// scanAPIKey reads a key whose scopes column holds JSON.
+func scanAPIKey(row interface{ Scan(...any) error }, key *APIKey, extra ...any) error {
+	var scopes string
+	dest := append([]any{&key.ID, &key.UserID, &key.Name, &scopes, &key.CreatedAt, &key.LastUsedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(scopes), &key.Scopes)
+}
+
+func (r SQLiteAPIKeyRepository) AddAPIKey(ctx context.Context, key *APIKey) (string, error) {
+	secret, err := generateAPIKey()
+	if err != nil {
+		return "", err
+	}
+	scopes, err := json.Marshal(key.Scopes)
+	if err != nil {
+		return "", err
+	}
+	key.ID = uuid.New()
+	key.CreatedAt = time.Now().UTC()
+	query := `INSERT INTO api_keys (key_id, user_id, name, scopes, key_hash, created_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = r.db.ExecContext(ctx, query, key.ID, key.UserID, key.Name, string(scopes), tokenDigest(secret), key.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (r SQLiteAPIKeyRepository) ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]APIKey, error) {
+	query := `SELECT key_id, user_id, name, scopes, created_at, last_used_at FROM api_keys
+		WHERE user_id=$1 AND revoked_at IS NULL ORDER BY created_at`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := scanAPIKey(rows, &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (r SQLiteAPIKeyRepository) UpdateAPIKey(ctx context.Context, key *APIKey) error {
+	scopes, err := json.Marshal(key.Scopes)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE api_keys SET name=$1, scopes=$2 WHERE key_id=$3 AND user_id=$4 AND revoked_at IS NULL
+		RETURNING created_at, last_used_at`
+	err = r.db.QueryRowContext(ctx, query, key.Name, string(scopes), key.ID, key.UserID).
+		Scan(&key.CreatedAt, &key.LastUsedAt)
+	if err == sql.ErrNoRows {
+		return NewAPIKeyNotFoundError()
+	}
+	return err
+}
+
+func (r SQLiteAPIKeyRepository) RevokeAPIKey(ctx context.Context, userID, keyID uuid.UUID) error {
+	query := `UPDATE api_keys SET revoked_at=$1 WHERE key_id=$2 AND user_id=$3 AND revoked_at IS NULL`
+	n, err := execAffected(ctx, r.db, query, time.Now().UTC(), keyID, userID)
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return NewAPIKeyNotFoundError()
+	}
+	return nil
+}
+
+// UseAPIKey looks up an active key of an enabled user by its secret and
+// records the time of use, unless it was recorded less than
+// lastUsedResolution ago.
+func (r SQLiteAPIKeyRepository) UseAPIKey(ctx context.Context, secret string) (APIKey, error) {
+	if !strings.HasPrefix(secret, APIKeyPrefix) {
+		return APIKey{}, NewAPIKeyNotFoundError()
+	}
+	var key APIKey
+	query := `SELECT k.key_id, k.user_id, k.name, k.scopes, k.created_at, k.last_used_at, u.role
+		FROM api_keys k JOIN users u ON u.user_id=k.user_id
+		WHERE k.key_hash=$1 AND k.revoked_at IS NULL AND NOT u.disabled`
+	err := scanAPIKey(r.db.QueryRowContext(ctx, query, tokenDigest(secret)), &key, &key.Role)
+	if err == sql.ErrNoRows {
+		return APIKey{}, NewAPIKeyNotFoundError()
+	} else if err != nil {
+		return APIKey{}, err
+	}
+	now := time.Now().UTC()
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < lastUsedResolution {
+		return key, nil
+	}
+	// Timestamps are compared as text, which works as they are all in UTC.
+	query = `UPDATE api_keys SET last_used_at=$1 WHERE key_id=$2 AND (last_used_at IS NULL OR last_used_at < $3)`
+	if _, err := r.db.ExecContext(ctx, query, now, key.ID, now.Add(-lastUsedResolution)); err != nil {
+		return APIKey{}, err
+	}
+	key.LastUsedAt = &now
+	return key, nil
+}
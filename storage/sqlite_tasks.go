@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	. "hw/models"
+	"time"
+)
+
+var _ TaskRepository = SQLiteTaskRepository{}
+
+type SQLiteTaskRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteTaskRepo(path string) SQLiteTaskRepository {
+	return SQLiteTaskRepository{openSQLite(path)}
+}
+
+func (r SQLiteTaskRepository) GetTask(ctx context.Context, id uuid.UUID) (Task, error) {
+	var task Task
+	query := `SELECT task_id, user_id, status, COALESCE(result, ''), expires_at FROM tasks WHERE task_id=$1`
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&task.ID, &task.UserID, &task.Status, &task.Result, &task.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return Task{}, NewTaskNotFoundError()
+	}
+	return task, err
+}
+
+func (r SQLiteTaskRepository) AddTask(ctx context.Context, task *Task) error {
+	payloadData, err := json.Marshal(task.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	var cacheKey *string
+	if task.CacheKey != "" {
+		cacheKey = &task.CacheKey
+	}
+	// Timestamps are compared as text, which only orders them correctly when
+	// they are all in UTC.
+	var expiresAt *time.Time
+	if task.ExpiresAt != nil {
+		utc := task.ExpiresAt.UTC()
+		expiresAt = &utc
+	}
+	query := `INSERT INTO tasks (task_id, user_id, payload, priority, cache_key, status, result, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err = r.db.ExecContext(ctx, query, task.ID, task.UserID, string(payloadData), task.Priority, cacheKey, task.Status, task.Result, expiresAt, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to add task: %w", err)
+	}
+	return nil
+}
+
+// UpdateTaskStatus records the outcome of processing. Tasks that were
+// force-failed in the meantime keep their status.
+func (r SQLiteTaskRepository) UpdateTaskStatus(ctx context.Context, id uuid.UUID, status, result string) error {
+	query := `UPDATE tasks SET status=$1, result=$2 WHERE task_id=$3 AND status='in_progress'`
+	_, err := r.db.ExecContext(ctx, query, status, result, id)
+	return err
+}
+
+// StartTask relies on transactions taking the write lock up front, which
+// keeps workers starting tasks of the same user at once from exceeding
+// maxStarted together.
+func (r SQLiteTaskRepository) StartTask(ctx context.Context, id uuid.UUID, maxStarted int) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	var started bool
+	query := `SELECT user_id, status<>'in_progress' OR started_at IS NOT NULL FROM tasks WHERE task_id=$1`
+	err = tx.QueryRowContext(ctx, query, id).Scan(&userID, &started)
+	if err == sql.ErrNoRows || started {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if maxStarted > 0 {
+		var count int
+		query = `SELECT COUNT(*) FROM tasks WHERE user_id=$1 AND status='in_progress' AND started_at IS NOT NULL`
+		if err := tx.QueryRowContext(ctx, query, userID).Scan(&count); err != nil {
+			return false, err
+		}
+		if count >= maxStarted {
+			return false, nil
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE tasks SET started_at=$1 WHERE task_id=$2`, time.Now().UTC(), id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (r SQLiteTaskRepository) CountUserTasks(ctx context.Context, userID uuid.UUID, status string) (count int, err error) {
+	query := `SELECT COUNT(*) FROM tasks WHERE user_id=$1 AND status=$2`
+	err = r.db.QueryRowContext(ctx, query, userID, status).Scan(&count)
+	return
+}
+
+func (r SQLiteTaskRepository) FindCachedResult(ctx context.Context, cacheKey string) (result string, found bool, err error) {
+	query := `SELECT result FROM tasks WHERE cache_key=$1 AND status='ready' AND (expires_at IS NULL OR expires_at > $2) LIMIT 1`
+	err = r.db.QueryRowContext(ctx, query, cacheKey, time.Now().UTC()).Scan(&result)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return result, true, nil
+}
+
+// ListTasks returns tasks without their payload and result, optionally
+// filtered by status.
+func (r SQLiteTaskRepository) ListTasks(ctx context.Context, status string, limit int) ([]Task, error) {
+	query := `SELECT task_id, user_id, priority, status FROM tasks WHERE $1='' OR status=$1
+		ORDER BY created_at DESC NULLS LAST, task_id LIMIT $2`
+	rows, err := r.db.QueryContext(ctx, query, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []Task{}
+	for rows.Next() {
+		var task Task
+		if err := rows.Scan(&task.ID, &task.UserID, &task.Priority, &task.Status); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func (r SQLiteTaskRepository) FailTask(ctx context.Context, id uuid.UUID, reason string) error {
+	query := `UPDATE tasks SET status='failed', result=$1 WHERE task_id=$2 AND status='in_progress'`
+	n, err := execAffected(ctx, r.db, query, reason, id)
+	if err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+	if _, err := r.GetTask(ctx, id); err != nil {
+		return err
+	}
+	return NewTaskNotInProgressError()
+}
+
+func (r SQLiteTaskRepository) PurgeExpiredTasks(ctx context.Context, limit int) (int, error) {
+	query := `UPDATE tasks SET payload='{}', cache_key=NULL, result=NULL WHERE task_id IN (
+		SELECT task_id FROM tasks WHERE expires_at <= $1 AND result IS NOT NULL AND status <> 'in_progress' LIMIT $2)`
+	n, err := execAffected(ctx, r.db, query, time.Now().UTC(), limit)
+	return int(n), err
+}
+
+func (r SQLiteTaskRepository) DeleteExpiredTasks(ctx context.Context, expiredBefore time.Time, limit int) (int, error) {
+	query := `DELETE FROM tasks WHERE task_id IN (
+		SELECT task_id FROM tasks WHERE expires_at < $1 AND status <> 'in_progress' LIMIT $2)`
+	n, err := execAffected(ctx, r.db, query, expiredBefore.UTC(), limit)
+	return int(n), err
+}
+
+func (r SQLiteTaskRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
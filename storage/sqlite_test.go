@@ -0,0 +1,79 @@
+package storage_test
+
+import (
+	. "hw/storage"
+	"hw/storage/storagetest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSQLiteStorage(t *testing.T) {
+	cfg, err := storagetest.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DatabaseURL = SQLiteScheme + filepath.Join(t.TempDir(), "data.db")
+	migrate(t, cfg.DatabaseURL)
+	storagetest.Run(t, NewStorage(StorageDatabase, cfg))
+}
+
+// TestSQLiteMigrateDown checks that rolling back stops at the migrations that
+// cannot be reverted, those of versions 5 to 10, instead of recording them as
+// reverted.
+func TestSQLiteMigrateDown(t *testing.T) {
+	m := NewMigrator(SQLiteScheme + filepath.Join(t.TempDir(), "data.db"))
+	defer m.Close()
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reversible []int64
+	for _, status := range statuses {
+		if status.Version > 10 {
+			reversible = append(reversible, status.Version)
+		}
+	}
+	if err := m.Down(len(reversible) + 1); err == nil {
+		t.Fatal("Down reverted a migration that cannot be reverted")
+	}
+	if pending := pendingMigrations(t, m); len(pending) != 0 {
+		t.Fatalf("failed Down reverted %v", pending)
+	}
+	if err := m.Down(len(reversible)); err != nil {
+		t.Fatal(err)
+	}
+	if pending := pendingMigrations(t, m); !slices.Equal(pending, reversible) {
+		t.Fatalf("Down(%d) left %v pending", len(reversible), pending)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatalf("migrating up again failed: %v", err)
+	}
+}
+
+func pendingMigrations(t *testing.T, m *Migrator) []int64 {
+	t.Helper()
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending []int64
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = append(pending, status.Version)
+		}
+	}
+	return pending
+}
+
+func migrate(t *testing.T, databaseURL string) {
+	t.Helper()
+	m := NewMigrator(databaseURL)
+	defer m.Close()
+	if err := m.Up(); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+}
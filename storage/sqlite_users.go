@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	. "hw/models"
+	"log/slog"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"strings"
+)
+
+var _ UserRepository = SQLiteUserRepository{}
+
+type SQLiteUserRepository struct {
+	db             *sql.DB
+	passwordParams PasswordParams
+}
+
+// sqliteUniqueViolation tells whether err was caused by the unique
+// constraint on columns, given as in SQLite messages, e.g. "users.login".
+func sqliteUniqueViolation(err error, columns string) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE &&
+		strings.Contains(sqliteErr.Error(), "UNIQUE constraint failed: "+columns)
+}
+
+func sqliteLoginTaken(err error) error {
+	if sqliteUniqueViolation(err, "users.login") {
+		return NewUserExistsError()
+	}
+	return err
+}
+
+func (r SQLiteUserRepository) AddUser(ctx context.Context, user *User) error {
+	hash, err := r.passwordParams.Hash(user.Password)
+	if err != nil {
+		return err
+	}
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	query := `INSERT INTO users (user_id, login, password, role) VALUES ($1, $2, $3, $4)`
+	_, err = r.db.ExecContext(ctx, query, user.ID, user.Login, hash, user.Role)
+	return sqliteLoginTaken(err)
+}
+
+func (r SQLiteUserRepository) ValidateUser(ctx context.Context, user *User) error {
+	var savedUser User
+	query := `SELECT user_id, COALESCE(password, ''), role, disabled FROM users WHERE login=$1`
+	err := r.db.QueryRowContext(ctx, query, user.Login).
+		Scan(&savedUser.ID, &savedUser.Password, &savedUser.Role, &savedUser.Disabled)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == sql.ErrNoRows || savedUser.Password == "" {
+		// Spend as much time as a password check would, so that unknown
+		// usernames cannot be told apart by the response time either.
+		_, _ = r.passwordParams.Hash(user.Password)
+		return NewInvalidCredentialsError()
+	}
+
+	ok, needsRehash, err := r.passwordParams.Verify(user.Password, savedUser.Password)
+	if err != nil {
+		return err
+	} else if !ok {
+		return NewInvalidCredentialsError()
+	} else if savedUser.Disabled {
+		return NewUserDisabledError()
+	}
+	user.ID = savedUser.ID
+	user.Role = savedUser.Role
+
+	if needsRehash {
+		r.rehashPassword(ctx, user)
+	}
+	return nil
+}
+
+// rehashPassword upgrades the stored hash to the current parameters. A failure
+// only postpones the upgrade to the next login, so it does not fail the login.
+func (r SQLiteUserRepository) rehashPassword(ctx context.Context, user *User) {
+	hash, err := r.passwordParams.Hash(user.Password)
+	if err == nil {
+		query := `UPDATE users SET password=$1 WHERE user_id=$2`
+		_, err = r.db.ExecContext(ctx, query, hash, user.ID)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to rehash password", "user_id", user.ID, "error", err)
+	}
+}
+
+func (r SQLiteUserRepository) GetUser(ctx context.Context, id uuid.UUID) (User, error) {
+	var user User
+	query := `SELECT user_id, login, role, disabled FROM users WHERE user_id=$1`
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.Login, &user.Role, &user.Disabled)
+	if err == sql.ErrNoRows {
+		return User{}, NewUserNotFoundError()
+	}
+	return user, err
+}
+
+func (r SQLiteUserRepository) ListUsers(ctx context.Context) ([]User, error) {
+	query := `SELECT user_id, login, role, disabled FROM users ORDER BY login`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Login, &user.Role, &user.Disabled); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (r SQLiteUserRepository) SetUserDisabled(ctx context.Context, id uuid.UUID, disabled bool) error {
+	query := `UPDATE users SET disabled=$1 WHERE user_id=$2`
+	n, err := execAffected(ctx, r.db, query, disabled, id)
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return NewUserNotFoundError()
+	}
+	return nil
+}
+
+// EnsureAdmin creates the bootstrap administrator unless an account with
+// that login exists, see PostgresUserRepository.EnsureAdmin.
+func (r SQLiteUserRepository) EnsureAdmin(ctx context.Context, login, password string) error {
+	err := r.AddUser(ctx, &User{ID: uuid.New(), Login: login, Password: password, Role: RoleAdmin})
+	if _, ok := err.(*UserExistsError); !ok {
+		return err
+	}
+	var role string
+	query := `SELECT role FROM users WHERE login=$1`
+	if err := r.db.QueryRowContext(ctx, query, login).Scan(&role); err != nil {
+		return err
+	} else if role != RoleAdmin {
+		return NewAdminLoginTakenError()
+	}
+	return nil
+}
+
+func (r SQLiteUserRepository) RenameUser(ctx context.Context, id uuid.UUID, login string) error {
+	query := `UPDATE users SET login=$1 WHERE user_id=$2`
+	n, err := execAffected(ctx, r.db, query, login, id)
+	if err != nil {
+		return sqliteLoginTaken(err)
+	} else if n == 0 {
+		return NewUserNotFoundError()
+	}
+	return nil
+}
+
+// CheckPassword returns an InvalidCredentialsError unless password is the
+// password of the user.
+func (r SQLiteUserRepository) CheckPassword(ctx context.Context, id uuid.UUID, password string) error {
+	var saved string
+	query := `SELECT COALESCE(password, '') FROM users WHERE user_id=$1`
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&saved)
+	if err == sql.ErrNoRows {
+		return NewUserNotFoundError()
+	} else if err != nil {
+		return err
+	} else if saved == "" {
+		return NewNoPasswordError()
+	}
+	ok, _, err := r.passwordParams.Verify(password, saved)
+	if err != nil {
+		return err
+	} else if !ok {
+		return NewInvalidCredentialsError()
+	}
+	return nil
+}
+
+// UpdatePassword replaces the password after checking the current one.
+func (r SQLiteUserRepository) UpdatePassword(ctx context.Context, id uuid.UUID, currentPassword, newPassword string) error {
+	if err := r.CheckPassword(ctx, id, currentPassword); err != nil {
+		return err
+	}
+	hash, err := r.passwordParams.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE users SET password=$1 WHERE user_id=$2`
+	_, err = r.db.ExecContext(ctx, query, hash, id)
+	return err
+}
+
+// DeleteUser removes the user with all their tasks. API keys are removed by
+// the cascading foreign key.
+func (r SQLiteUserRepository) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tasks WHERE user_id=$1`, id); err != nil {
+		return err
+	}
+	n, err := execAffected(ctx, tx, `DELETE FROM users WHERE user_id=$1`, id)
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return NewUserNotFoundError()
+	}
+	return tx.Commit()
+}
+
+// GetOIDCUser returns the user signed in through an OIDC provider, creating
+// it on the first login, see PostgresUserRepository.GetOIDCUser.
+func (r SQLiteUserRepository) GetOIDCUser(ctx context.Context, identity OIDCIdentity) (User, error) {
+	var user User
+	query := `SELECT user_id, login, role, disabled FROM users WHERE oidc_issuer=$1 AND oidc_subject=$2`
+	err := r.db.QueryRowContext(ctx, query, identity.Issuer, identity.Subject).
+		Scan(&user.ID, &user.Login, &user.Role, &user.Disabled)
+	if err == nil {
+		return user, nil
+	} else if err != sql.ErrNoRows {
+		return User{}, err
+	}
+
+	user = User{ID: uuid.New(), Login: identity.Login, Role: RoleUser}
+	query = `INSERT INTO users (user_id, login, role, oidc_issuer, oidc_subject) VALUES ($1, $2, $3, $4, $5)`
+	_, err = r.db.ExecContext(ctx, query, user.ID, user.Login, user.Role, identity.Issuer, identity.Subject)
+	if sqliteUniqueViolation(err, "users.oidc_issuer, users.oidc_subject") {
+		// A concurrent first login of the same subject created the user.
+		return r.GetOIDCUser(ctx, identity)
+	}
+	return user, sqliteLoginTaken(err)
+}
+
+// LinkOIDCUser links the identity to a user who has signed in with their
+// password.
+func (r SQLiteUserRepository) LinkOIDCUser(ctx context.Context, id uuid.UUID, identity OIDCIdentity) error {
+	query := `UPDATE users SET oidc_issuer=$1, oidc_subject=$2 WHERE user_id=$3 AND oidc_subject IS NULL`
+	n, err := execAffected(ctx, r.db, query, identity.Issuer, identity.Subject, id)
+	if sqliteUniqueViolation(err, "users.oidc_issuer, users.oidc_subject") {
+		return NewOIDCLinkedError()
+	} else if err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+	if _, err := r.GetUser(ctx, id); err != nil {
+		return err
+	}
+	return NewOIDCLinkedError()
+}
@@ -0,0 +1,947 @@
+// Package storagetest checks that Storage implementations behave alike, so
+// that the in-memory backend can stand in for Postgres and Redis.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	. "hw/models"
+	. "hw/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Short lifetimes and limits, so that expiry and lockouts can be observed.
+const (
+	accessTTL   = time.Second
+	refreshTTL  = 2 * time.Second
+	maxTasks    = 3
+	maxFailures = 3
+)
+
+// Config returns the configuration the Storage passed to Run must be created
+// with. Connection settings are left to the caller.
+func Config() (DatabaseConfig, error) {
+	signer, err := NewTokenSigner(map[string]string{"test": "conformance-secret"}, "test", "storagetest", "storagetest")
+	if err != nil {
+		return DatabaseConfig{}, err
+	}
+	return DatabaseConfig{
+		TokenSigner:     signer,
+		PasswordParams:  PasswordParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		AccessTokenTTL:  accessTTL,
+		RefreshTokenTTL: refreshTTL,
+		CheckRevocation: true,
+		Quota:           Quota{Period: QuotaDaily, MaxTasks: maxTasks, MaxPixels: 10_000_000},
+		LoginThrottle: LoginThrottle{
+			MaxAccountFailures: maxFailures,
+			MaxIPFailures:      1000,
+			Window:             time.Minute,
+			Lockout:            time.Second,
+			MaxLockout:         time.Minute,
+		},
+	}, nil
+}
+
+type check struct {
+	name string
+	run  func(ctx context.Context, s Storage) error
+}
+
+var checks = []check{
+	{"users", checkUsers},
+	{"login normalization", checkLoginNormalization},
+	{"concurrent registration", checkConcurrentRegistration},
+	{"account management", checkAccountManagement},
+	{"admin bootstrap", checkAdminBootstrap},
+	{"tasks", checkTasks},
+	{"task expiry", checkTaskExpiry},
+	{"task start", checkTaskStart},
+	{"sessions", checkSessions},
+	{"session expiry", checkSessionExpiry},
+	{"API keys", checkAPIKeys},
+	{"account deletion", checkAccountDeletion},
+	{"rate limits", checkRateLimits},
+	{"quotas", checkQuotas},
+	{"login lockout", checkLoginLockout},
+	{"OIDC", checkOIDC},
+}
+
+// Run runs every check against s as a subtest of t. s must have been created
+// with Config. Each check works with new users, so s does not have to be
+// empty.
+func Run(t *testing.T, s Storage) {
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.run(context.Background(), s); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func is[E error](err error) bool {
+	var target E
+	return errors.As(err, &target)
+}
+
+// expect returns an error unless err is of type E.
+func expect[E error](what string, err error) error {
+	if is[E](err) {
+		return nil
+	}
+	var target E
+	return fmt.Errorf("%s: expected %T, got %v", what, target, err)
+}
+
+func newUser(ctx context.Context, s Storage) (*User, error) {
+	user := &User{
+		ID:       uuid.New(),
+		Login:    "user_" + uuid.NewString()[:8],
+		Password: "password228",
+	}
+	if err := s.AddUser(ctx, user); err != nil {
+		return nil, fmt.Errorf("AddUser: %w", err)
+	}
+	return user, nil
+}
+
+func login(ctx context.Context, s Storage, user *User) (Tokens, error) {
+	attempt := &User{Login: user.Login, Password: user.Password}
+	tokens, err := s.Login(ctx, attempt, &Session{IP: "192.0.2.1", UserAgent: "storagetest"})
+	if err != nil {
+		return Tokens{}, fmt.Errorf("Login: %w", err)
+	}
+	return tokens, nil
+}
+
+func checkUsers(ctx context.Context, s Storage) error {
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	duplicate := &User{ID: uuid.New(), Login: user.Login, Password: "other"}
+	if err := expect[*UserExistsError]("duplicate AddUser", s.AddUser(ctx, duplicate)); err != nil {
+		return err
+	}
+
+	saved, err := s.GetUser(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("GetUser: %w", err)
+	} else if saved.Login != user.Login || saved.Role != RoleUser || saved.Password != "" {
+		return fmt.Errorf("GetUser returned %+v", saved)
+	}
+	if _, err := s.GetUser(ctx, uuid.New()); !is[*UserNotFoundError](err) {
+		return expect[*UserNotFoundError]("GetUser of unknown user", err)
+	}
+
+	if _, err := login(ctx, s, user); err != nil {
+		return err
+	}
+	wrong := &User{Login: user.Login, Password: "wrong"}
+	_, err = s.Login(ctx, wrong, &Session{IP: "192.0.2.2"})
+	if err := expect[*InvalidCredentialsError]("Login with wrong password", err); err != nil {
+		return err
+	}
+	unknown := &User{Login: "unknown_" + uuid.NewString()[:8], Password: "password228"}
+	_, err = s.Login(ctx, unknown, &Session{IP: "192.0.2.2"})
+	if err := expect[*InvalidCredentialsError]("Login of unknown user", err); err != nil {
+		return err
+	}
+
+	if err := s.SetUserDisabled(ctx, user.ID, true); err != nil {
+		return fmt.Errorf("SetUserDisabled: %w", err)
+	}
+	_, err = s.Login(ctx, &User{Login: user.Login, Password: user.Password}, &Session{IP: "192.0.2.1"})
+	if err := expect[*UserDisabledError]("Login of disabled user", err); err != nil {
+		return err
+	}
+	if err := s.SetUserDisabled(ctx, user.ID, false); err != nil {
+		return fmt.Errorf("SetUserDisabled: %w", err)
+	}
+	if err := expect[*UserNotFoundError]("SetUserDisabled of unknown user", s.SetUserDisabled(ctx, uuid.New(), true)); err != nil {
+		return err
+	}
+
+	users, err := s.ListUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("ListUsers: %w", err)
+	}
+	for _, listed := range users {
+		if listed.ID == user.ID {
+			return nil
+		}
+	}
+	return errors.New("ListUsers does not include the new user")
+}
+
+func checkLoginNormalization(ctx context.Context, s Storage) error {
+	suffix := uuid.NewString()[:8]
+	user := &User{ID: uuid.New(), Login: "MiXeD_" + suffix, Password: "password228"}
+	if err := s.AddUser(ctx, user); err != nil {
+		return fmt.Errorf("AddUser: %w", err)
+	} else if user.Login != "mixed_"+suffix {
+		return fmt.Errorf("AddUser stored login %q", user.Login)
+	}
+	if _, err := login(ctx, s, &User{Login: "MIXED_" + suffix, Password: user.Password}); err != nil {
+		return err
+	}
+	duplicate := &User{ID: uuid.New(), Login: "mixed_" + suffix, Password: "password228"}
+	if err := expect[*UserExistsError]("AddUser of a login differing in case", s.AddUser(ctx, duplicate)); err != nil {
+		return err
+	}
+
+	// "é" composed and decomposed.
+	composed := &User{ID: uuid.New(), Login: "caf\u00e9_" + suffix, Password: "password228"}
+	if err := s.AddUser(ctx, composed); err != nil {
+		return fmt.Errorf("AddUser: %w", err)
+	}
+	decomposed := &User{ID: uuid.New(), Login: "cafe\u0301_" + suffix, Password: "password228"}
+	if err := expect[*UserExistsError]("AddUser of a login differing in normalization", s.AddUser(ctx, decomposed)); err != nil {
+		return err
+	}
+
+	for _, invalid := range []string{"ab", "with space", "semi;colon", "p\u0430ypal_" + suffix, strings.Repeat("x", 51)} {
+		err := s.AddUser(ctx, &User{ID: uuid.New(), Login: invalid, Password: "password228"})
+		if err := expect[*InvalidLoginError](fmt.Sprintf("AddUser of %q", invalid), err); err != nil {
+			return err
+		}
+	}
+	return expect[*InvalidLoginError]("RenameUser to an invalid login", s.RenameUser(ctx, user.ID, "with space"))
+}
+
+// checkConcurrentRegistration registers one login several times at once,
+// which must succeed exactly once.
+func checkConcurrentRegistration(ctx context.Context, s Storage) error {
+	name := "race_" + uuid.NewString()[:8]
+	errs := make(chan error)
+	const attempts = 8
+	for i := 0; i < attempts; i++ {
+		go func() {
+			errs <- s.AddUser(ctx, &User{ID: uuid.New(), Login: name, Password: "password228"})
+		}()
+	}
+	created := 0
+	var unexpected error
+	for i := 0; i < attempts; i++ {
+		err := <-errs
+		if err == nil {
+			created++
+		} else if !is[*UserExistsError](err) {
+			unexpected = err
+		}
+	}
+	if unexpected != nil {
+		return fmt.Errorf("AddUser: %w", unexpected)
+	} else if created != 1 {
+		return fmt.Errorf("%d concurrent AddUser calls created %d users", attempts, created)
+	}
+	return nil
+}
+
+func checkAccountManagement(ctx context.Context, s Storage) error {
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	other, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	if err := expect[*UserExistsError]("RenameUser to a taken login", s.RenameUser(ctx, user.ID, other.Login)); err != nil {
+		return err
+	}
+	user.Login = "renamed_" + uuid.NewString()[:8]
+	if err := s.RenameUser(ctx, user.ID, user.Login); err != nil {
+		return fmt.Errorf("RenameUser: %w", err)
+	}
+
+	tokens, err := login(ctx, s, user)
+	if err != nil {
+		return err
+	}
+	current, err := s.GetSession(ctx, tokens.AccessToken)
+	if err != nil {
+		return fmt.Errorf("GetSession: %w", err)
+	}
+	otherTokens, err := login(ctx, s, user)
+	if err != nil {
+		return err
+	}
+
+	err = s.ChangePassword(ctx, user.ID, current.SessionID, "192.0.2.1", "wrong", "new-password")
+	if err := expect[*InvalidCredentialsError]("ChangePassword with wrong password", err); err != nil {
+		return err
+	}
+	if err := s.ChangePassword(ctx, user.ID, current.SessionID, "192.0.2.1", user.Password, "new-password"); err != nil {
+		return fmt.Errorf("ChangePassword: %w", err)
+	}
+	// Sessions are listed rather than looked up by their access tokens,
+	// which may have expired by now.
+	sessions, err := s.ListSessions(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("ListSessions: %w", err)
+	} else if len(sessions) != 1 || sessions[0].SessionID != current.SessionID {
+		return fmt.Errorf("ChangePassword left the sessions %+v, expected only the current one", sessions)
+	}
+	if _, err := s.GetSession(ctx, otherTokens.AccessToken); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("GetSession of another session after ChangePassword", err)
+	}
+	user.Password = "new-password"
+	_, err = login(ctx, s, user)
+	return err
+}
+
+func newTask(ctx context.Context, s Storage, userID uuid.UUID, cacheKey string) (*Task, error) {
+	task := &Task{
+		ID:       uuid.New(),
+		UserID:   userID,
+		Payload:  ImageProcessorPayload{Filter: Filter{Name: "Negative"}, Image: "aW1hZ2U="},
+		Priority: 5,
+		CacheKey: cacheKey,
+		Status:   "in_progress",
+	}
+	if err := s.AddTask(ctx, task); err != nil {
+		return nil, fmt.Errorf("AddTask: %w", err)
+	}
+	return task, nil
+}
+
+// checkAdminBootstrap checks that EnsureAdmin creates the admin once and never
+// promotes an account that someone else registered with the admin login.
+func checkAdminBootstrap(ctx context.Context, s Storage) error {
+	admin := &User{Login: "admin_" + uuid.NewString()[:8], Password: "admin-password"}
+	if err := s.EnsureAdmin(ctx, admin.Login, admin.Password); err != nil {
+		return fmt.Errorf("EnsureAdmin: %w", err)
+	}
+	if err := s.EnsureAdmin(ctx, admin.Login, "other-password"); err != nil {
+		return fmt.Errorf("EnsureAdmin of existing admin: %w", err)
+	}
+	// The existing admin keeps its password.
+	if _, err := login(ctx, s, admin); err != nil {
+		return err
+	}
+
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	err = s.EnsureAdmin(ctx, user.Login, "admin-password")
+	if err := expect[*AdminLoginTakenError]("EnsureAdmin of a user", err); err != nil {
+		return err
+	}
+	if saved, err := s.GetUser(ctx, user.ID); err != nil {
+		return fmt.Errorf("GetUser: %w", err)
+	} else if saved.Role != RoleUser {
+		return fmt.Errorf("EnsureAdmin of a user changed the role to %q", saved.Role)
+	}
+	return nil
+}
+
+func checkTasks(ctx context.Context, s Storage) error {
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	cacheKey := fmt.Sprintf("%064x", uuid.New())[:64]
+	task, err := newTask(ctx, s, user.ID, cacheKey)
+	if err != nil {
+		return err
+	}
+	if _, err := s.GetTask(ctx, uuid.New()); !is[*TaskNotFoundError](err) {
+		return expect[*TaskNotFoundError]("GetTask of unknown task", err)
+	}
+
+	if count, err := s.CountUserTasks(ctx, user.ID, "in_progress"); err != nil || count != 1 {
+		return fmt.Errorf("CountUserTasks returned %d, %v", count, err)
+	}
+	if _, found, err := s.FindCachedResult(ctx, cacheKey); err != nil || found {
+		return fmt.Errorf("FindCachedResult found a task in progress: %v", err)
+	}
+
+	if err := s.UpdateTaskStatus(ctx, task.ID, "ready", "result"); err != nil {
+		return fmt.Errorf("UpdateTaskStatus: %w", err)
+	}
+	saved, err := s.GetTask(ctx, task.ID)
+	if err != nil {
+		return fmt.Errorf("GetTask: %w", err)
+	} else if saved.Status != "ready" || saved.Result != "result" || saved.UserID != user.ID {
+		return fmt.Errorf("GetTask returned %+v after UpdateTaskStatus", saved)
+	}
+	if result, found, err := s.FindCachedResult(ctx, cacheKey); err != nil || !found || result != "result" {
+		return fmt.Errorf("FindCachedResult returned %q, %v, %v", result, found, err)
+	}
+
+	if err := s.UpdateTaskStatus(ctx, task.ID, "failed", "late"); err != nil {
+		return fmt.Errorf("UpdateTaskStatus of a finished task: %w", err)
+	}
+	if saved, _ := s.GetTask(ctx, task.ID); saved.Status != "ready" {
+		return errors.New("UpdateTaskStatus changed a finished task")
+	}
+	if err := expect[*TaskNotInProgressError]("FailTask of a finished task", s.FailTask(ctx, task.ID, "reason")); err != nil {
+		return err
+	}
+	if err := expect[*TaskNotFoundError]("FailTask of unknown task", s.FailTask(ctx, uuid.New(), "reason")); err != nil {
+		return err
+	}
+
+	stuck, err := newTask(ctx, s, user.ID, "")
+	if err != nil {
+		return err
+	}
+	if err := s.FailTask(ctx, stuck.ID, "reason"); err != nil {
+		return fmt.Errorf("FailTask: %w", err)
+	}
+	if saved, _ := s.GetTask(ctx, stuck.ID); saved.Status != "failed" || saved.Result != "reason" {
+		return fmt.Errorf("GetTask returned %+v after FailTask", saved)
+	}
+
+	// Tasks are listed newest first.
+	tasks, err := s.ListTasks(ctx, "failed", 1)
+	if err != nil {
+		return fmt.Errorf("ListTasks: %w", err)
+	} else if len(tasks) != 1 || tasks[0].ID != stuck.ID || tasks[0].Status != "failed" {
+		return fmt.Errorf("ListTasks returned %+v, expected task %s", tasks, stuck.ID)
+	}
+	if tasks, _ := s.ListTasks(ctx, "", 2); len(tasks) != 2 || tasks[0].ID != stuck.ID || tasks[1].ID != task.ID {
+		return fmt.Errorf("ListTasks returned %+v, expected tasks %s and %s", tasks, stuck.ID, task.ID)
+	}
+	return nil
+}
+
+func checkTaskStart(ctx context.Context, s Storage) error {
+	const maxStarted = 2
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	var tasks []*Task
+	for i := 0; i < maxStarted+1; i++ {
+		task, err := newTask(ctx, s, user.ID, "")
+		if err != nil {
+			return err
+		}
+		tasks = append(tasks, task)
+	}
+	for _, task := range tasks[:maxStarted] {
+		if started, err := s.StartTask(ctx, task.ID, maxStarted); err != nil || !started {
+			return fmt.Errorf("StartTask under the limit returned %v, %v", started, err)
+		}
+	}
+	if started, err := s.StartTask(ctx, tasks[0].ID, maxStarted); err != nil || !started {
+		return fmt.Errorf("StartTask of a started task returned %v, %v", started, err)
+	}
+	if started, err := s.StartTask(ctx, tasks[maxStarted].ID, maxStarted); err != nil || started {
+		return fmt.Errorf("StartTask over the limit returned %v, %v", started, err)
+	}
+	if started, err := s.StartTask(ctx, tasks[maxStarted].ID, 0); err != nil || !started {
+		return fmt.Errorf("StartTask without a limit returned %v, %v", started, err)
+	}
+
+	other, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	task, err := newTask(ctx, s, other.ID, "")
+	if err != nil {
+		return err
+	}
+	if started, err := s.StartTask(ctx, task.ID, 1); err != nil || !started {
+		return fmt.Errorf("StartTask was limited by the tasks of another user: %v, %v", started, err)
+	}
+
+	if err := s.UpdateTaskStatus(ctx, tasks[0].ID, "ready", "result"); err != nil {
+		return fmt.Errorf("UpdateTaskStatus: %w", err)
+	}
+	next, err := newTask(ctx, s, user.ID, "")
+	if err != nil {
+		return err
+	}
+	if started, err := s.StartTask(ctx, next.ID, maxStarted); err != nil || started {
+		return fmt.Errorf("StartTask over the limit returned %v, %v", started, err)
+	}
+	if err := s.FailTask(ctx, tasks[1].ID, "reason"); err != nil {
+		return fmt.Errorf("FailTask: %w", err)
+	}
+	if started, err := s.StartTask(ctx, next.ID, maxStarted); err != nil || !started {
+		return fmt.Errorf("StartTask after tasks finished returned %v, %v", started, err)
+	}
+	if started, err := s.StartTask(ctx, uuid.New(), maxStarted); err != nil || !started {
+		return fmt.Errorf("StartTask of unknown task returned %v, %v", started, err)
+	}
+	return nil
+}
+
+func checkTaskExpiry(ctx context.Context, s Storage) error {
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	cacheKey := fmt.Sprintf("%064x", uuid.New())[:64]
+	expiresAt := time.Now().Add(time.Second).Truncate(time.Millisecond)
+	task := &Task{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		Payload:   ImageProcessorPayload{Filter: Filter{Name: "Negative"}, Image: "aW1hZ2U="},
+		CacheKey:  cacheKey,
+		Status:    "in_progress",
+		ExpiresAt: &expiresAt,
+	}
+	if err := s.AddTask(ctx, task); err != nil {
+		return fmt.Errorf("AddTask: %w", err)
+	}
+	kept, err := newTask(ctx, s, user.ID, "")
+	if err != nil {
+		return err
+	}
+	for _, id := range []uuid.UUID{task.ID, kept.ID} {
+		if err := s.UpdateTaskStatus(ctx, id, "ready", "result"); err != nil {
+			return fmt.Errorf("UpdateTaskStatus: %w", err)
+		}
+	}
+
+	saved, err := s.GetTask(ctx, task.ID)
+	if err != nil {
+		return fmt.Errorf("GetTask: %w", err)
+	} else if saved.ExpiresAt == nil || !saved.ExpiresAt.Equal(expiresAt) {
+		return fmt.Errorf("GetTask returned expiry %v, expected %v", saved.ExpiresAt, expiresAt)
+	}
+	if _, err := s.PurgeExpiredTasks(ctx, 100); err != nil {
+		return fmt.Errorf("PurgeExpiredTasks: %w", err)
+	}
+	if saved, _ := s.GetTask(ctx, task.ID); saved.Result != "result" {
+		return errors.New("PurgeExpiredTasks purged a task before it expired")
+	}
+	if _, found, err := s.FindCachedResult(ctx, cacheKey); err != nil || !found {
+		return fmt.Errorf("FindCachedResult did not find a task before it expired: %v", err)
+	}
+
+	time.Sleep(time.Until(expiresAt))
+	if _, found, err := s.FindCachedResult(ctx, cacheKey); err != nil || found {
+		return fmt.Errorf("FindCachedResult found an expired task: %v", err)
+	}
+	for {
+		n, err := s.PurgeExpiredTasks(ctx, 1)
+		if err != nil {
+			return fmt.Errorf("PurgeExpiredTasks: %w", err)
+		} else if n > 1 {
+			return fmt.Errorf("PurgeExpiredTasks purged %d tasks with a limit of 1", n)
+		} else if n == 0 {
+			break
+		}
+	}
+	saved, err = s.GetTask(ctx, task.ID)
+	if err != nil {
+		return fmt.Errorf("GetTask of a purged task: %w", err)
+	} else if saved.Result != "" || !saved.Expired(time.Now()) {
+		return fmt.Errorf("GetTask returned %+v after PurgeExpiredTasks", saved)
+	}
+	if saved, _ := s.GetTask(ctx, kept.ID); saved.Result != "result" || saved.ExpiresAt != nil {
+		return fmt.Errorf("GetTask returned %+v for a task without expiry", saved)
+	}
+
+	if _, err := s.DeleteExpiredTasks(ctx, expiresAt, 100); err != nil {
+		return fmt.Errorf("DeleteExpiredTasks: %w", err)
+	}
+	if _, err := s.GetTask(ctx, task.ID); err != nil {
+		return fmt.Errorf("DeleteExpiredTasks deleted a task that expired later: %w", err)
+	}
+	if n, err := s.DeleteExpiredTasks(ctx, time.Now(), 100); err != nil || n == 0 {
+		return fmt.Errorf("DeleteExpiredTasks deleted %d tasks: %v", n, err)
+	}
+	if _, err := s.GetTask(ctx, task.ID); !is[*TaskNotFoundError](err) {
+		return expect[*TaskNotFoundError]("GetTask of a deleted task", err)
+	}
+	if _, err := s.GetTask(ctx, kept.ID); err != nil {
+		return fmt.Errorf("DeleteExpiredTasks deleted a task without expiry: %w", err)
+	}
+	return nil
+}
+
+func checkSessions(ctx context.Context, s Storage) error {
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	tokens, err := login(ctx, s, user)
+	if err != nil {
+		return err
+	}
+	session, err := s.GetSession(ctx, tokens.AccessToken)
+	if err != nil {
+		return fmt.Errorf("GetSession: %w", err)
+	} else if session.UserID != user.ID || session.Role != RoleUser {
+		return fmt.Errorf("GetSession returned %+v", session)
+	}
+	if _, err := s.GetSession(ctx, "not a token"); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("GetSession of garbage", err)
+	}
+
+	sessions, err := s.ListSessions(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("ListSessions: %w", err)
+	} else if len(sessions) != 1 || sessions[0].SessionID != session.SessionID || sessions[0].UserAgent != "storagetest" {
+		return fmt.Errorf("ListSessions returned %+v", sessions)
+	}
+
+	rotated, err := s.RefreshSession(ctx, tokens.RefreshToken)
+	if err != nil {
+		return fmt.Errorf("RefreshSession: %w", err)
+	} else if rotated.RefreshToken == tokens.RefreshToken {
+		return errors.New("RefreshSession did not rotate the refresh token")
+	}
+	if _, err := s.GetSession(ctx, rotated.AccessToken); err != nil {
+		return fmt.Errorf("GetSession of refreshed token: %w", err)
+	}
+
+	// Reusing a rotated refresh token revokes the session.
+	if _, err := s.RefreshSession(ctx, tokens.RefreshToken); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("RefreshSession with a rotated token", err)
+	}
+	if _, err := s.RefreshSession(ctx, rotated.RefreshToken); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("RefreshSession after reuse", err)
+	}
+	if _, err := s.GetSession(ctx, rotated.AccessToken); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("GetSession after reuse", err)
+	}
+
+	first, err := login(ctx, s, user)
+	if err != nil {
+		return err
+	}
+	second, err := login(ctx, s, user)
+	if err != nil {
+		return err
+	}
+	firstSession, _ := s.GetSession(ctx, first.AccessToken)
+	if err := s.DeleteSession(ctx, user.ID, firstSession.SessionID); err != nil {
+		return fmt.Errorf("DeleteSession: %w", err)
+	}
+	if _, err := s.GetSession(ctx, first.AccessToken); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("GetSession after DeleteSession", err)
+	}
+	if _, err := s.GetSession(ctx, second.AccessToken); err != nil {
+		return fmt.Errorf("DeleteSession revoked another session: %w", err)
+	}
+	if err := s.DeleteUserSessions(ctx, user.ID); err != nil {
+		return fmt.Errorf("DeleteUserSessions: %w", err)
+	}
+	if _, err := s.GetSession(ctx, second.AccessToken); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("GetSession after DeleteUserSessions", err)
+	}
+	if _, err := s.RefreshSession(ctx, second.RefreshToken); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("RefreshSession after DeleteUserSessions", err)
+	}
+
+	// Refreshing picks up role changes and refuses disabled users.
+	third, err := login(ctx, s, user)
+	if err != nil {
+		return err
+	}
+	if err := s.SetUserDisabled(ctx, user.ID, true); err != nil {
+		return fmt.Errorf("SetUserDisabled: %w", err)
+	}
+	_, err = s.RefreshSession(ctx, third.RefreshToken)
+	return expect[*UserDisabledError]("RefreshSession of disabled user", err)
+}
+
+func checkSessionExpiry(ctx context.Context, s Storage) error {
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	tokens, err := login(ctx, s, user)
+	if err != nil {
+		return err
+	}
+	// JWT expiry has a resolution of one second.
+	time.Sleep(accessTTL + time.Second)
+	if _, err := s.GetSession(ctx, tokens.AccessToken); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("GetSession of expired token", err)
+	}
+	time.Sleep(refreshTTL - accessTTL)
+	if _, err := s.RefreshSession(ctx, tokens.RefreshToken); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("RefreshSession of expired session", err)
+	}
+	sessions, err := s.ListSessions(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("ListSessions: %w", err)
+	} else if len(sessions) != 0 {
+		return fmt.Errorf("ListSessions returned expired sessions %+v", sessions)
+	}
+	return nil
+}
+
+func checkAPIKeys(ctx context.Context, s Storage) error {
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	key := &APIKey{UserID: user.ID, Name: "ci", Scopes: []string{ScopeTasksRead}}
+	secret, err := s.AddAPIKey(ctx, key)
+	if err != nil {
+		return fmt.Errorf("AddAPIKey: %w", err)
+	}
+
+	used, err := s.UseAPIKey(ctx, secret)
+	if err != nil {
+		return fmt.Errorf("UseAPIKey: %w", err)
+	} else if used.ID != key.ID || used.UserID != user.ID || used.Role != RoleUser || !used.HasScope(ScopeTasksRead) {
+		return fmt.Errorf("UseAPIKey returned %+v", used)
+	}
+	if _, err := s.UseAPIKey(ctx, APIKeyPrefix+"unknown"); !is[*APIKeyNotFoundError](err) {
+		return expect[*APIKeyNotFoundError]("UseAPIKey of unknown key", err)
+	}
+
+	keys, err := s.ListAPIKeys(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("ListAPIKeys: %w", err)
+	} else if len(keys) != 1 || keys[0].LastUsedAt == nil {
+		return fmt.Errorf("ListAPIKeys returned %+v", keys)
+	}
+	if used, err := s.UseAPIKey(ctx, secret); err != nil || used.LastUsedAt == nil || !used.LastUsedAt.Equal(*keys[0].LastUsedAt) {
+		return fmt.Errorf("UseAPIKey right after a use recorded it again: %+v, %v", used, err)
+	}
+
+	update := &APIKey{ID: key.ID, UserID: uuid.New(), Name: "stolen", Scopes: []string{ScopeTasksWrite}}
+	if err := expect[*APIKeyNotFoundError]("UpdateAPIKey of another user", s.UpdateAPIKey(ctx, update)); err != nil {
+		return err
+	}
+	update.UserID = user.ID
+	if err := s.UpdateAPIKey(ctx, update); err != nil {
+		return fmt.Errorf("UpdateAPIKey: %w", err)
+	}
+	if used, _ := s.UseAPIKey(ctx, secret); used.Name != "stolen" || !used.HasScope(ScopeTasksWrite) {
+		return fmt.Errorf("UseAPIKey returned %+v after UpdateAPIKey", used)
+	}
+
+	if err := s.SetUserDisabled(ctx, user.ID, true); err != nil {
+		return fmt.Errorf("SetUserDisabled: %w", err)
+	}
+	if _, err := s.UseAPIKey(ctx, secret); !is[*APIKeyNotFoundError](err) {
+		return expect[*APIKeyNotFoundError]("UseAPIKey of disabled user", err)
+	}
+	if err := s.SetUserDisabled(ctx, user.ID, false); err != nil {
+		return fmt.Errorf("SetUserDisabled: %w", err)
+	}
+
+	if err := s.RevokeAPIKey(ctx, user.ID, key.ID); err != nil {
+		return fmt.Errorf("RevokeAPIKey: %w", err)
+	}
+	if _, err := s.UseAPIKey(ctx, secret); !is[*APIKeyNotFoundError](err) {
+		return expect[*APIKeyNotFoundError]("UseAPIKey of revoked key", err)
+	}
+	return expect[*APIKeyNotFoundError]("second RevokeAPIKey", s.RevokeAPIKey(ctx, user.ID, key.ID))
+}
+
+func checkAccountDeletion(ctx context.Context, s Storage) error {
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	tokens, err := login(ctx, s, user)
+	if err != nil {
+		return err
+	}
+	task, err := newTask(ctx, s, user.ID, "")
+	if err != nil {
+		return err
+	}
+	secret, err := s.AddAPIKey(ctx, &APIKey{UserID: user.ID, Name: "ci", Scopes: []string{ScopeTasksRead}})
+	if err != nil {
+		return fmt.Errorf("AddAPIKey: %w", err)
+	}
+
+	if err := s.DeleteAccount(ctx, user.ID); err != nil {
+		return fmt.Errorf("DeleteAccount: %w", err)
+	}
+	if _, err := s.GetUser(ctx, user.ID); !is[*UserNotFoundError](err) {
+		return expect[*UserNotFoundError]("GetUser after DeleteAccount", err)
+	}
+	if _, err := s.GetTask(ctx, task.ID); !is[*TaskNotFoundError](err) {
+		return expect[*TaskNotFoundError]("GetTask after DeleteAccount", err)
+	}
+	if _, err := s.UseAPIKey(ctx, secret); !is[*APIKeyNotFoundError](err) {
+		return expect[*APIKeyNotFoundError]("UseAPIKey after DeleteAccount", err)
+	}
+	if _, err := s.GetSession(ctx, tokens.AccessToken); !is[*InvalidTokenError](err) {
+		return expect[*InvalidTokenError]("GetSession after DeleteAccount", err)
+	}
+	return expect[*UserNotFoundError]("second DeleteAccount", s.DeleteAccount(ctx, user.ID))
+}
+
+func checkRateLimits(ctx context.Context, s Storage) error {
+	key := "storagetest:" + uuid.NewString()
+	limit := RateLimit{Rate: 1, Burst: 2}
+	for i := 0; i < limit.Burst; i++ {
+		if err := s.Allow(ctx, key, limit); err != nil {
+			return fmt.Errorf("Allow within burst: %w", err)
+		}
+	}
+	err := s.Allow(ctx, key, limit)
+	if !is[*RateLimitedError](err) {
+		return expect[*RateLimitedError]("Allow beyond burst", err)
+	}
+	if retryAfter := err.(*RateLimitedError).RetryAfter; retryAfter <= 0 || retryAfter > time.Second {
+		return fmt.Errorf("Allow returned Retry-After %s", retryAfter)
+	}
+	time.Sleep(time.Second)
+	if err := s.Allow(ctx, key, limit); err != nil {
+		return fmt.Errorf("Allow after refill: %w", err)
+	}
+	return s.Allow(ctx, key, RateLimit{})
+}
+
+func checkQuotas(ctx context.Context, s Storage) error {
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	if err := s.ConsumeQuota(ctx, user.ID, 20_000_000); !is[*QuotaExceededError](err) {
+		return expect[*QuotaExceededError]("ConsumeQuota beyond the pixel quota", err)
+	}
+	for i := 0; i < maxTasks; i++ {
+		if err := s.ConsumeQuota(ctx, user.ID, 1_000_000); err != nil {
+			return fmt.Errorf("ConsumeQuota within quota: %w", err)
+		}
+	}
+	if err := s.ConsumeQuota(ctx, user.ID, 0); !is[*QuotaExceededError](err) {
+		return expect[*QuotaExceededError]("ConsumeQuota beyond the task quota", err)
+	}
+
+	usage, err := s.GetUsage(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("GetUsage: %w", err)
+	} else if usage.Tasks != maxTasks || usage.Megapixels != maxTasks || usage.MaxTasks != maxTasks || !usage.ResetsAt.After(time.Now()) {
+		return fmt.Errorf("GetUsage returned %+v", usage)
+	}
+
+	if err := s.RefundQuota(ctx, user.ID, 1_000_000); err != nil {
+		return fmt.Errorf("RefundQuota: %w", err)
+	}
+	if usage, err := s.GetUsage(ctx, user.ID); err != nil {
+		return fmt.Errorf("GetUsage: %w", err)
+	} else if usage.Tasks != maxTasks-1 || usage.Megapixels != maxTasks-1 {
+		return fmt.Errorf("GetUsage returned %+v after RefundQuota", usage)
+	}
+	if err := s.ConsumeQuota(ctx, user.ID, 1_000_000); err != nil {
+		return fmt.Errorf("ConsumeQuota of refunded quota: %w", err)
+	}
+	return nil
+}
+
+func checkLoginLockout(ctx context.Context, s Storage) error {
+	user, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < maxFailures; i++ {
+		_, err := s.Login(ctx, &User{Login: user.Login, Password: "wrong"}, &Session{IP: "192.0.2.3"})
+		if !is[*InvalidCredentialsError](err) {
+			return expect[*InvalidCredentialsError]("Login with wrong password", err)
+		}
+	}
+	_, err = login(ctx, s, user)
+	var locked *LoginLockedError
+	if !errors.As(err, &locked) {
+		return expect[*LoginLockedError]("Login of locked account", err)
+	}
+	time.Sleep(locked.RetryAfter)
+	if _, err := login(ctx, s, user); err != nil {
+		return fmt.Errorf("Login after lockout: %w", err)
+	}
+
+	// Signed in users guessing their password are locked out alike.
+	for i := 0; i < maxFailures; i++ {
+		if err := expect[*InvalidCredentialsError]("VerifyPassword of wrong password", s.VerifyPassword(ctx, user.ID, "192.0.2.3", "wrong")); err != nil {
+			return err
+		}
+	}
+	if err := s.VerifyPassword(ctx, user.ID, "192.0.2.3", user.Password); !errors.As(err, &locked) {
+		return expect[*LoginLockedError]("VerifyPassword of locked account", err)
+	}
+	err = s.ChangePassword(ctx, user.ID, uuid.New(), "192.0.2.3", user.Password, "new-password")
+	if !errors.As(err, &locked) {
+		return expect[*LoginLockedError]("ChangePassword of locked account", err)
+	}
+	time.Sleep(locked.RetryAfter)
+	if err := s.VerifyPassword(ctx, user.ID, "192.0.2.3", user.Password); err != nil {
+		return fmt.Errorf("VerifyPassword after lockout: %w", err)
+	}
+	return nil
+}
+
+func checkOIDC(ctx context.Context, s Storage) error {
+	identity := OIDCIdentity{Issuer: "https://idp.example.com", Subject: uuid.NewString(), Login: "sso_" + uuid.NewString()[:8]}
+	tokens, err := s.LoginOIDC(ctx, identity, &Session{IP: "192.0.2.4"})
+	if err != nil {
+		return fmt.Errorf("LoginOIDC: %w", err)
+	}
+	first, _ := s.GetSession(ctx, tokens.AccessToken)
+	tokens, err = s.LoginOIDC(ctx, identity, &Session{IP: "192.0.2.4"})
+	if err != nil {
+		return fmt.Errorf("second LoginOIDC: %w", err)
+	}
+	second, _ := s.GetSession(ctx, tokens.AccessToken)
+	if first.UserID != second.UserID || first.UserID == uuid.Nil {
+		return errors.New("LoginOIDC created a second user for the same subject")
+	}
+	_, err = s.Login(ctx, &User{Login: identity.Login, Password: ""}, &Session{IP: "192.0.2.4"})
+	if err := expect[*InvalidCredentialsError]("password Login of OIDC user", err); err != nil {
+		return err
+	}
+	if err := expect[*NoPasswordError]("VerifyPassword of OIDC user", s.VerifyPassword(ctx, first.UserID, "192.0.2.4", "")); err != nil {
+		return err
+	}
+
+	local, err := newUser(ctx, s)
+	if err != nil {
+		return err
+	}
+	clash := OIDCIdentity{Issuer: "https://other.example.com", Subject: uuid.NewString(), Login: local.Login}
+	tokens, err = s.LoginOIDC(ctx, clash, &Session{})
+	if err != nil {
+		return fmt.Errorf("LoginOIDC with a taken login: %w", err)
+	}
+	session, _ := s.GetSession(ctx, tokens.AccessToken)
+	if session.UserID == local.ID || session.UserID == uuid.Nil {
+		return errors.New("LoginOIDC with a taken login signed in the local user")
+	}
+	if created, err := s.GetUser(ctx, session.UserID); err != nil || !strings.HasPrefix(created.Login, local.Login+"-") {
+		return fmt.Errorf("LoginOIDC with a taken login created %+v, %v", created, err)
+	}
+
+	linked := OIDCIdentity{Issuer: identity.Issuer, Subject: uuid.NewString(), Login: local.Login}
+	if err := expect[*OIDCLinkedError]("LinkOIDC of a linked identity", s.LinkOIDC(ctx, local.ID, identity)); err != nil {
+		return err
+	}
+	if err := s.LinkOIDC(ctx, local.ID, linked); err != nil {
+		return fmt.Errorf("LinkOIDC: %w", err)
+	}
+	if err := expect[*OIDCLinkedError]("second LinkOIDC", s.LinkOIDC(ctx, local.ID, OIDCIdentity{Issuer: identity.Issuer, Subject: uuid.NewString()})); err != nil {
+		return err
+	}
+	if err := expect[*UserNotFoundError]("LinkOIDC of unknown user", s.LinkOIDC(ctx, uuid.New(), OIDCIdentity{Issuer: identity.Issuer, Subject: uuid.NewString()})); err != nil {
+		return err
+	}
+	tokens, err = s.LoginOIDC(ctx, linked, &Session{})
+	if err != nil {
+		return fmt.Errorf("LoginOIDC of linked identity: %w", err)
+	}
+	if session, _ := s.GetSession(ctx, tokens.AccessToken); session.UserID != local.ID {
+		return errors.New("LoginOIDC did not sign in the linked user")
+	}
+
+	state := uuid.NewString()
+	if err := s.SaveOIDCState(ctx, state, OIDCLoginState{Verifier: "verifier", Nonce: "nonce", UserID: local.ID}, time.Minute); err != nil {
+		return fmt.Errorf("SaveOIDCState: %w", err)
+	}
+	if saved, err := s.TakeOIDCState(ctx, state); err != nil || saved.Verifier != "verifier" || saved.Nonce != "nonce" || saved.UserID != local.ID {
+		return fmt.Errorf("TakeOIDCState returned %+v, %v", saved, err)
+	}
+	_, err = s.TakeOIDCState(ctx, state)
+	return expect[*InvalidTokenError]("second TakeOIDCState", err)
+}
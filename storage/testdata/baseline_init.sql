@@ -12,4 +12,4 @@ CREATE TABLE tasks (
                        result TEXT DEFAULT NULL
 );
 
-CREATE INDEX idx_users_login ON users(login);
\ No newline at end of file
+CREATE INDEX idx_users_login ON users(login);
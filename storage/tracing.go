@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	. "hw/models"
+	"strings"
+	"time"
+)
+
+var tracer = otel.Tracer("hw/storage")
+
+// startSpan starts a span only as part of a trace that is already recorded,
+// so that background work such as purging expired tasks does not start a
+// trace for each of its queries.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedTaskRepository records a span for every operation on tasks, whatever
+// the database.
+type tracedTaskRepository struct {
+	TaskRepository
+}
+
+func traced(ctx context.Context, name string, op func(ctx context.Context) error) error {
+	ctx, span := startSpan(ctx, name)
+	err := op(ctx)
+	endSpan(span, err)
+	return err
+}
+
+func (r tracedTaskRepository) GetTask(ctx context.Context, id uuid.UUID) (task Task, err error) {
+	err = traced(ctx, "GetTask", func(ctx context.Context) error {
+		task, err = r.TaskRepository.GetTask(ctx, id)
+		return err
+	})
+	return task, err
+}
+
+func (r tracedTaskRepository) AddTask(ctx context.Context, task *Task) error {
+	return traced(ctx, "AddTask", func(ctx context.Context) error {
+		return r.TaskRepository.AddTask(ctx, task)
+	})
+}
+
+func (r tracedTaskRepository) UpdateTaskStatus(ctx context.Context, id uuid.UUID, status, result string) error {
+	return traced(ctx, "UpdateTaskStatus", func(ctx context.Context) error {
+		return r.TaskRepository.UpdateTaskStatus(ctx, id, status, result)
+	})
+}
+
+func (r tracedTaskRepository) StartTask(ctx context.Context, id uuid.UUID, maxStarted int) (started bool, err error) {
+	err = traced(ctx, "StartTask", func(ctx context.Context) error {
+		started, err = r.TaskRepository.StartTask(ctx, id, maxStarted)
+		return err
+	})
+	return started, err
+}
+
+func (r tracedTaskRepository) CountUserTasks(ctx context.Context, userID uuid.UUID, status string) (count int, err error) {
+	err = traced(ctx, "CountUserTasks", func(ctx context.Context) error {
+		count, err = r.TaskRepository.CountUserTasks(ctx, userID, status)
+		return err
+	})
+	return count, err
+}
+
+func (r tracedTaskRepository) FindCachedResult(ctx context.Context, cacheKey string) (result string, found bool, err error) {
+	err = traced(ctx, "FindCachedResult", func(ctx context.Context) error {
+		result, found, err = r.TaskRepository.FindCachedResult(ctx, cacheKey)
+		return err
+	})
+	return result, found, err
+}
+
+func (r tracedTaskRepository) ListTasks(ctx context.Context, status string, limit int) (tasks []Task, err error) {
+	err = traced(ctx, "ListTasks", func(ctx context.Context) error {
+		tasks, err = r.TaskRepository.ListTasks(ctx, status, limit)
+		return err
+	})
+	return tasks, err
+}
+
+func (r tracedTaskRepository) FailTask(ctx context.Context, id uuid.UUID, reason string) error {
+	return traced(ctx, "FailTask", func(ctx context.Context) error {
+		return r.TaskRepository.FailTask(ctx, id, reason)
+	})
+}
+
+func (r tracedTaskRepository) PurgeExpiredTasks(ctx context.Context, limit int) (n int, err error) {
+	err = traced(ctx, "PurgeExpiredTasks", func(ctx context.Context) error {
+		n, err = r.TaskRepository.PurgeExpiredTasks(ctx, limit)
+		return err
+	})
+	return n, err
+}
+
+func (r tracedTaskRepository) DeleteExpiredTasks(ctx context.Context, expiredBefore time.Time, limit int) (n int, err error) {
+	err = traced(ctx, "DeleteExpiredTasks", func(ctx context.Context) error {
+		n, err = r.TaskRepository.DeleteExpiredTasks(ctx, expiredBefore, limit)
+		return err
+	})
+	return n, err
+}
+
+// pgxTracer records a span for every Postgres query made as part of a trace.
+type pgxTracer struct{}
+
+var _ pgx.QueryTracer = pgxTracer{}
+
+func (pgxTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	operation := "query"
+	if words := strings.Fields(data.SQL); len(words) > 0 {
+		operation = strings.ToUpper(words[0])
+	}
+	ctx, _ = startSpan(ctx, "postgres "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBQueryText(data.SQL),
+		))
+	return ctx
+}
+
+func (pgxTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	endSpan(trace.SpanFromContext(ctx), data.Err)
+}
@@ -1,8 +1,10 @@
 import base64
+import os
 import pytest
 import requests
 import uuid
 import time
+from urllib.parse import parse_qs, urlparse
 
 BASE_URL = "http://server:8000"
 
@@ -28,12 +30,12 @@ def auth_token(user_data):
 
     return data['token']
 
-def get_image_processor_payload():
+def get_image_processor_payload(no_cache=True):
     with open("static/sigma.png", "rb") as image_file:
         image_bytes = image_file.read()
 
     image_base64 = base64.b64encode(image_bytes).decode('utf-8')
-    return {"filter": {"name": "Negative"}, "image": image_base64}
+    return {"filter": {"name": "Negative"}, "image": image_base64, "no_cache": no_cache}
 
 def test_create_task(auth_token):
     task_url = f"{BASE_URL}/task"
@@ -77,6 +79,47 @@ def test_task_status_and_result(auth_token):
     data = response.json()
     assert 'result' in data
 
+def test_cached_result(auth_token):
+    test_task_status_and_result(auth_token)
+
+    task_url = f"{BASE_URL}/task"
+    headers = {'Authorization': f'Bearer {auth_token}'}
+
+    response = requests.post(task_url, headers=headers, json=get_image_processor_payload(no_cache=False))
+    assert response.status_code == 201
+    task_id = response.json()['task_id']
+
+    response = requests.get(f"{BASE_URL}/status/{task_id}", headers=headers)
+    assert response.status_code == 200
+    assert response.json()['status'] == 'ready'
+
+def cache_hits():
+    response = requests.get(f"{BASE_URL}/metrics")
+    assert response.status_code == 200
+    for line in response.text.splitlines():
+        if line.startswith('result_cache_lookups_total{outcome="hit"}'):
+            return float(line.split()[-1])
+    return 0
+
+def test_cache_is_per_user(auth_token):
+    test_cached_result(auth_token)
+    hits = cache_hits()
+
+    headers = {'Authorization': f'Bearer {login(new_user())}'}
+    response = requests.post(f"{BASE_URL}/task", headers=headers, json=get_image_processor_payload(no_cache=False))
+    assert response.status_code == 201
+    assert cache_hits() == hits
+
+def test_unsupported_image(auth_token):
+    task_url = f"{BASE_URL}/task"
+    headers = {'Authorization': f'Bearer {auth_token}'}
+
+    payload = get_image_processor_payload()
+    payload['image'] = base64.b64encode(b'definitely not an image').decode('utf-8')
+
+    response = requests.post(task_url, headers=headers, json=payload)
+    assert response.status_code == 415
+
 def test_task_not_found(auth_token):
     invalid_task_id = str(uuid.uuid4())
     status_url = f"{BASE_URL}/status/{invalid_task_id}"
@@ -89,6 +132,58 @@ def test_task_not_found(auth_token):
     response = requests.get(result_url, headers=headers)
     assert response.status_code == 404
 
+def test_forged_token():
+    # A token signed with a key the server does not know must be rejected.
+    header = base64.urlsafe_b64encode(b'{"alg":"HS256","typ":"JWT","kid":"default"}').rstrip(b'=')
+    claims = base64.urlsafe_b64encode(
+        f'{{"user_id":"{uuid.uuid4()}","jti":"{uuid.uuid4()}","exp":{int(time.time()) + 300}}}'.encode()
+    ).rstrip(b'=')
+    token = b'.'.join([header, claims, b'c2lnbmF0dXJl']).decode()
+
+    response = requests.get(f"{BASE_URL}/sessions", headers={'Authorization': f'Bearer {token}'})
+    assert response.status_code == 401
+
+def test_health():
+    response = requests.get(f"{BASE_URL}/healthz")
+    assert response.status_code == 200
+    assert response.json()['status'] == 'ok'
+
+    response = requests.get(f"{BASE_URL}/readyz")
+    assert response.status_code == 200
+    report = response.json()
+    assert report['status'] == 'ok'
+    assert report['checks']['queue'] == 'ok'
+    assert all(status == 'ok' for status in report['checks'].values())
+
+def test_metrics(auth_token):
+    test_create_task(auth_token)
+    response = requests.get(f"{BASE_URL}/metrics")
+    assert response.status_code == 200
+    assert 'http_requests_total{code="201",method="POST",route="/task"}' in response.text
+    assert 'tasks_created_total{source="queue"}' in response.text
+
+def test_request_id():
+    response = requests.get(f"{BASE_URL}/healthz")
+    assert response.headers['X-Request-ID']
+
+    request_id = f'test-{uuid.uuid4()}'
+    response = requests.get(f"{BASE_URL}/healthz", headers={'X-Request-ID': request_id})
+    assert response.headers['X-Request-ID'] == request_id
+
+    response = requests.get(f"{BASE_URL}/healthz", headers={'X-Request-ID': 'not a valid id'})
+    assert response.headers['X-Request-ID'] != 'not a valid id'
+
+def test_trace_context():
+    trace_id = uuid.uuid4().hex
+    traceparent = f'00-{trace_id}-{uuid.uuid4().hex[:16]}-01'
+    # The trace of the client is linked, not continued.
+    response = requests.get(f"{BASE_URL}/status/{uuid.uuid4()}", headers={'traceparent': traceparent})
+    assert len(response.headers['X-Trace-ID']) == 32
+    assert response.headers['X-Trace-ID'] != trace_id
+
+    response = requests.get(f"{BASE_URL}/status/{uuid.uuid4()}")
+    assert len(response.headers['X-Trace-ID']) == 32
+
 def test_unauthorized_access():
     invalid_task_id = str(uuid.uuid4())
     status_url = f"{BASE_URL}/status/{invalid_task_id}"
@@ -103,3 +198,341 @@ def test_unauthorized_access():
 
     response = requests.get(result_url)
     assert response.status_code == 401
+
+# Set by docker-compose.test.yml.
+ADMIN = {'username': os.environ['ADMIN_LOGIN'], 'password': os.environ['ADMIN_PASSWORD']}
+
+def new_user():
+    user = {'username': f'user_{uuid.uuid4()}', 'password': 'password228'}
+    response = requests.post(f"{BASE_URL}/register", json=user)
+    assert response.status_code == 201
+    return user
+
+def login(user):
+    response = requests.post(f"{BASE_URL}/login", json=user)
+    assert response.status_code == 200
+    return response.json()['token']
+
+def test_login_errors_are_uniform():
+    user = new_user()
+    wrong_password = requests.post(f"{BASE_URL}/login", json={**user, 'password': 'wrong'})
+    unknown_user = requests.post(f"{BASE_URL}/login", json={**user, 'username': f'user_{uuid.uuid4()}'})
+    assert wrong_password.status_code == unknown_user.status_code == 400
+    assert wrong_password.text == unknown_user.text
+
+def test_usernames_are_normalized():
+    username = f'User_{uuid.uuid4()}'
+    user = {'username': username, 'password': 'password228'}
+    assert requests.post(f"{BASE_URL}/register", json=user).status_code == 201
+    login({**user, 'username': username.upper()})
+
+    response = requests.post(f"{BASE_URL}/register", json={**user, 'username': username.lower()})
+    assert response.status_code == 400
+    assert response.text.strip() == 'User already exists'
+
+    response = requests.post(f"{BASE_URL}/register", json={**user, 'username': 'with space'})
+    assert response.status_code == 400
+
+    headers = {'Authorization': f'Bearer {login(user)}'}
+    for invalid in ['ab', 'semi;colon', 'p\u0430ypal']:
+        response = requests.patch(f"{BASE_URL}/me", headers=headers, json={'username': invalid})
+        assert response.status_code == 400
+
+def test_login_lockout():
+    user = new_user()
+    for _ in range(5):
+        response = requests.post(f"{BASE_URL}/login", json={**user, 'password': 'wrong'})
+        assert response.status_code == 400
+
+    # Even the right password is refused while the account is locked.
+    response = requests.post(f"{BASE_URL}/login", json=user)
+    assert response.status_code == 429
+    assert int(response.headers['Retry-After']) >= 1
+
+def test_logout():
+    user = new_user()
+    first = {'Authorization': f'Bearer {login(user)}'}
+    second = {'Authorization': f'Bearer {login(user)}'}
+
+    response = requests.get(f"{BASE_URL}/sessions", headers=first)
+    assert response.status_code == 200
+    sessions = response.json()
+    assert len(sessions) == 2
+    assert sum(session['current'] for session in sessions) == 1
+
+    response = requests.post(f"{BASE_URL}/logout", headers=first)
+    assert response.status_code == 204
+    response = requests.get(f"{BASE_URL}/sessions", headers=first)
+    assert response.status_code == 401
+
+    response = requests.get(f"{BASE_URL}/sessions", headers=second)
+    assert response.status_code == 200
+    assert len(response.json()) == 1
+
+def test_logout_all():
+    user = new_user()
+    headers = [{'Authorization': f'Bearer {login(user)}'} for _ in range(3)]
+
+    response = requests.post(f"{BASE_URL}/logout/all", headers=headers[0])
+    assert response.status_code == 204
+
+    for h in headers:
+        response = requests.get(f"{BASE_URL}/sessions", headers=h)
+        assert response.status_code == 401
+
+def test_refresh_token_rotation():
+    user = new_user()
+    response = requests.post(f"{BASE_URL}/login", json=user)
+    assert response.status_code == 200
+    tokens = response.json()
+    assert 'refresh_token' in tokens
+
+    refresh_url = f"{BASE_URL}/token/refresh"
+    response = requests.post(refresh_url, json={'refresh_token': tokens['refresh_token']})
+    assert response.status_code == 200
+    rotated = response.json()
+    assert rotated['refresh_token'] != tokens['refresh_token']
+
+    response = requests.get(f"{BASE_URL}/sessions", headers={'Authorization': f"Bearer {rotated['token']}"})
+    assert response.status_code == 200
+
+    # Reusing a rotated refresh token revokes the whole session.
+    response = requests.post(refresh_url, json={'refresh_token': tokens['refresh_token']})
+    assert response.status_code == 401
+    response = requests.post(refresh_url, json={'refresh_token': rotated['refresh_token']})
+    assert response.status_code == 401
+    response = requests.get(f"{BASE_URL}/sessions", headers={'Authorization': f"Bearer {rotated['token']}"})
+    assert response.status_code == 401
+
+def test_api_keys(auth_token):
+    headers = {'Authorization': f'Bearer {auth_token}'}
+    response = requests.post(f"{BASE_URL}/api-keys", headers=headers,
+                             json={'name': 'ci', 'scopes': ['tasks:read', 'tasks:write']})
+    assert response.status_code == 201
+    created = response.json()
+    key_headers = {'X-API-Key': created['key']}
+
+    response = requests.post(f"{BASE_URL}/task", headers=key_headers, json=get_image_processor_payload())
+    assert response.status_code == 201
+    task_id = response.json()['task_id']
+    response = requests.get(f"{BASE_URL}/status/{task_id}", headers={'Authorization': f"Bearer {created['key']}"})
+    assert response.status_code == 200
+
+    # API keys cannot manage credentials.
+    response = requests.get(f"{BASE_URL}/api-keys", headers=key_headers)
+    assert response.status_code == 403
+
+    response = requests.get(f"{BASE_URL}/api-keys", headers=headers)
+    assert response.status_code == 200
+    keys = [key for key in response.json() if key['key_id'] == created['key_id']]
+    assert len(keys) == 1
+    assert keys[0]['last_used_at'] is not None
+    assert 'key' not in keys[0]
+
+    response = requests.patch(f"{BASE_URL}/api-keys/{created['key_id']}", headers=headers,
+                              json={'name': 'ci-read-only', 'scopes': ['tasks:read']})
+    assert response.status_code == 200
+    response = requests.post(f"{BASE_URL}/task", headers=key_headers, json=get_image_processor_payload())
+    assert response.status_code == 403
+
+    response = requests.delete(f"{BASE_URL}/api-keys/{created['key_id']}", headers=headers)
+    assert response.status_code == 204
+    response = requests.get(f"{BASE_URL}/status/{task_id}", headers=key_headers)
+    assert response.status_code == 401
+
+def test_profile():
+    user = new_user()
+    headers = {'Authorization': f'Bearer {login(user)}'}
+    response = requests.get(f"{BASE_URL}/me", headers=headers)
+    assert response.status_code == 200
+    assert response.json()['username'] == user['username']
+    assert 'password' not in response.json()
+
+    renamed = f'user_{uuid.uuid4()}'
+    response = requests.patch(f"{BASE_URL}/me", headers=headers, json={'username': renamed})
+    assert response.status_code == 200
+    assert response.json()['username'] == renamed
+    login({**user, 'username': renamed})
+
+def test_change_password():
+    user = new_user()
+    current = {'Authorization': f'Bearer {login(user)}'}
+    other = {'Authorization': f'Bearer {login(user)}'}
+
+    response = requests.post(f"{BASE_URL}/me/password", headers=current,
+                             json={'current_password': 'wrong', 'new_password': 'new-password'})
+    assert response.status_code == 403
+    response = requests.post(f"{BASE_URL}/me/password", headers=current,
+                             json={'current_password': user['password'], 'new_password': 'new-password'})
+    assert response.status_code == 204
+
+    assert requests.get(f"{BASE_URL}/sessions", headers=current).status_code == 200
+    assert requests.get(f"{BASE_URL}/sessions", headers=other).status_code == 401
+    login({**user, 'password': 'new-password'})
+
+def test_delete_account():
+    user = new_user()
+    token = login(user)
+    headers = {'Authorization': f'Bearer {token}'}
+    task_id = test_create_task(token)
+
+    response = requests.delete(f"{BASE_URL}/me", headers=headers)
+    assert response.status_code == 403
+    response = requests.delete(f"{BASE_URL}/me", headers=headers, json={'current_password': 'wrong'})
+    assert response.status_code == 403
+    response = requests.delete(f"{BASE_URL}/me", headers=headers, json={'current_password': user['password']})
+    assert response.status_code == 204
+    assert requests.get(f"{BASE_URL}/me", headers=headers).status_code == 401
+
+    admin_headers = {'Authorization': f'Bearer {login(ADMIN)}'}
+    response = requests.get(f"{BASE_URL}/status/{task_id}", headers=admin_headers)
+    assert response.status_code == 404
+    response = requests.post(f"{BASE_URL}/login", json=user)
+    assert response.status_code == 400
+
+def oidc_login(subject, path='/oidc/login', headers=None):
+    # The session keeps the state cookie, as the browser does.
+    browser = requests.Session()
+    response = browser.get(f"{BASE_URL}{path}", headers=headers, allow_redirects=False)
+    assert response.status_code == 302
+    authorize_url = response.headers['Location']
+    query = parse_qs(urlparse(authorize_url).query)
+    assert query['code_challenge_method'] == ['S256']
+
+    # The mock provider signs in the subject given as login_hint.
+    response = browser.get(authorize_url, params={'login_hint': subject}, allow_redirects=False)
+    assert response.status_code == 302
+    return browser.get(response.headers['Location'], allow_redirects=False)
+
+def test_oidc_login():
+    subject = f'sso_{uuid.uuid4()}'
+    response = oidc_login(subject)
+    assert response.status_code == 200
+    headers = {'Authorization': f"Bearer {response.json()['token']}"}
+    response = requests.get(f"{BASE_URL}/me", headers=headers)
+    assert response.status_code == 200
+    user_id = response.json()['user_id']
+    assert response.json()['username'] == subject
+
+    # The second login is linked to the same user.
+    response = oidc_login(subject)
+    assert response.status_code == 200
+    headers = {'Authorization': f"Bearer {response.json()['token']}"}
+    assert requests.get(f"{BASE_URL}/me", headers=headers).json()['user_id'] == user_id
+
+    # OIDC users have no local password and delete their account by having
+    # signed in recently.
+    response = requests.post(f"{BASE_URL}/login", json={'username': subject, 'password': 'password228'})
+    assert response.status_code == 400
+    response = requests.delete(f"{BASE_URL}/me", headers=headers)
+    assert response.status_code == 204
+
+def test_oidc_state_is_single_use():
+    browser = requests.Session()
+    response = browser.get(f"{BASE_URL}/oidc/login", allow_redirects=False)
+    state = browser.cookies['oidc_state']
+    response = browser.get(response.headers['Location'], allow_redirects=False)
+    callback = response.headers['Location']
+    assert browser.get(callback, allow_redirects=False).status_code == 200
+    assert browser.get(callback, allow_redirects=False, cookies={'oidc_state': state}).status_code == 400
+
+def test_oidc_callback_requires_state_cookie():
+    response = requests.get(f"{BASE_URL}/oidc/login", allow_redirects=False)
+    response = requests.get(response.headers['Location'], allow_redirects=False)
+    # Another browser, without the cookie set by /oidc/login.
+    assert requests.get(response.headers['Location'], allow_redirects=False).status_code == 400
+
+def test_oidc_link():
+    user = new_user()
+    headers = {'Authorization': f'Bearer {login(user)}'}
+    user_id = requests.get(f"{BASE_URL}/me", headers=headers).json()['user_id']
+
+    # An OIDC login named like a local user gets an account of its own.
+    other = new_user()
+    response = oidc_login(other['username'])
+    assert response.status_code == 200
+    response = requests.get(f"{BASE_URL}/me", headers={'Authorization': f"Bearer {response.json()['token']}"})
+    assert response.json()['username'].startswith(other['username'] + '-')
+
+    subject = user['username']
+    assert requests.get(f"{BASE_URL}/oidc/link", allow_redirects=False).status_code == 401
+    assert oidc_login(subject, '/oidc/link', headers).status_code == 204
+    response = oidc_login(subject)
+    assert response.status_code == 200
+    headers = {'Authorization': f"Bearer {response.json()['token']}"}
+    assert requests.get(f"{BASE_URL}/me", headers=headers).json()['user_id'] == user_id
+
+def test_task_rate_limit():
+    headers = {'Authorization': f'Bearer {login(new_user())}'}
+    responses = [requests.post(f"{BASE_URL}/task", headers=headers, data='{') for _ in range(40)]
+    assert responses[0].status_code == 400
+    limited = [r for r in responses if r.status_code == 429]
+    assert limited
+    assert int(limited[0].headers['Retry-After']) >= 1
+
+def test_usage():
+    headers = {'Authorization': f'Bearer {login(new_user())}'}
+    response = requests.get(f"{BASE_URL}/me/usage", headers=headers)
+    assert response.status_code == 200
+    assert response.json()['tasks'] == 0
+
+    test_create_task(headers['Authorization'].removeprefix('Bearer '))
+    response = requests.get(f"{BASE_URL}/me/usage", headers=headers)
+    assert response.status_code == 200
+    usage = response.json()
+    assert usage['tasks'] == 1
+    assert usage['megapixels'] > 0
+
+
+def test_admin_endpoints(auth_token):
+    headers = {'Authorization': f'Bearer {auth_token}'}
+    response = requests.get(f"{BASE_URL}/admin/users", headers=headers)
+    assert response.status_code == 403
+
+    admin_headers = {'Authorization': f'Bearer {login(ADMIN)}'}
+    response = requests.get(f"{BASE_URL}/admin/users", headers=admin_headers)
+    assert response.status_code == 200
+    users = response.json()
+    assert all('password' not in u for u in users)
+
+    task_id = test_create_task(auth_token)
+    response = requests.get(f"{BASE_URL}/status/{task_id}", headers=admin_headers)
+    assert response.status_code == 200
+    response = requests.get(f"{BASE_URL}/admin/tasks?limit=10", headers=admin_headers)
+    assert response.status_code == 200
+    assert len(response.json()) <= 10
+
+def test_task_expiry():
+    # The compose file keeps tasks of admins for 3 seconds.
+    admin_token = login(ADMIN)
+    headers = {'Authorization': f'Bearer {admin_token}'}
+    task_id = test_create_task(admin_token)
+    response = requests.get(f"{BASE_URL}/status/{task_id}", headers=headers)
+    assert response.status_code == 200
+
+    time.sleep(5)
+    response = requests.get(f"{BASE_URL}/status/{task_id}", headers=headers)
+    assert response.status_code == 410
+    response = requests.get(f"{BASE_URL}/result/{task_id}", headers=headers)
+    assert response.status_code == 410
+    response = requests.get(f"{BASE_URL}/result/{uuid.uuid4()}", headers=headers)
+    assert response.status_code == 404
+
+def test_disable_user():
+    user = new_user()
+    user_headers = {'Authorization': f'Bearer {login(user)}'}
+    admin_headers = {'Authorization': f'Bearer {login(ADMIN)}'}
+
+    response = requests.get(f"{BASE_URL}/admin/users", headers=admin_headers)
+    user_id = next(u['user_id'] for u in response.json() if u['username'] == user['username'])
+
+    response = requests.post(f"{BASE_URL}/admin/users/{user_id}/disable", headers=admin_headers)
+    assert response.status_code == 204
+    response = requests.get(f"{BASE_URL}/sessions", headers=user_headers)
+    assert response.status_code == 401
+    response = requests.post(f"{BASE_URL}/login", json=user)
+    assert response.status_code == 403
+
+    response = requests.post(f"{BASE_URL}/admin/users/{user_id}/enable", headers=admin_headers)
+    assert response.status_code == 204
+    login(user)
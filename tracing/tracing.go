@@ -0,0 +1,87 @@
+// Package tracing configures OpenTelemetry for the server and the worker, so
+// that a task can be followed in a single trace from the API request through
+// the queue to the worker that processes it.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"hw/config"
+	"hw/logging"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// shutdownTimeout bounds the export of the last spans when a process exits.
+const shutdownTimeout = 5 * time.Second
+
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+// Setup installs the tracer provider named by TRACE_EXPORTER: otlp sends
+// spans to the collector at OTEL_EXPORTER_OTLP_ENDPOINT over HTTP, stdout
+// writes them to the standard output, and none, the default, records
+// nothing. TRACE_SAMPLE_RATIO is the share of new traces that are recorded;
+// spans whose parent is sampled, such as the processing of a task queued by a
+// sampled request, are always recorded. The server starts a new trace for
+// every API request rather than follow the sampling of its clients.
+//
+// Trace context is propagated in W3C headers whatever the exporter, so that
+// a process without one does not break the traces of the others. The
+// returned function flushes the spans that are not exported yet; it is meant
+// to be deferred by main.
+func Setup(ctx context.Context, service string) (shutdown func()) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter, err := newExporter(ctx, config.String("TRACE_EXPORTER", ExporterNone))
+	if err != nil {
+		logging.Fatal("invalid TRACE_EXPORTER", "error", err)
+	}
+	if exporter == nil {
+		return func() {}
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(service),
+	))
+	if err != nil {
+		logging.Fatal("failed to describe the service for tracing", "error", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Float("TRACE_SAMPLE_RATIO", 1)))),
+	)
+	otel.SetTracerProvider(provider)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Error("failed to flush spans", "error", err)
+		}
+	}
+}
+
+func newExporter(ctx context.Context, name string) (sdktrace.SpanExporter, error) {
+	switch strings.ToLower(name) {
+	case "", ExporterNone:
+		return nil, nil
+	case ExporterOTLP:
+		return otlptracehttp.New(ctx)
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	}
+	return nil, fmt.Errorf("unknown exporter %q, expected %s, %s or %s", name, ExporterOTLP, ExporterStdout, ExporterNone)
+}